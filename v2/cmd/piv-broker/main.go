@@ -0,0 +1,293 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command piv-broker shares a YubiKey between multiple local processes.
+//
+// The broker opens the card and serves clients, such as SSH agents and git
+// signing helpers, over a Unix socket using the protocol of the
+// github.com/go-piv/piv-go/v2/piv/broker package.
+//
+//	piv-broker -socket=$XDG_RUNTIME_DIR/piv-broker.sock -config=broker.json
+//
+// The optional configuration file lists the clients allowed to connect and
+// the policy applied to each. Every client must name a user ID, and may
+// additionally be matched, on Linux, by the path of the connecting
+// executable:
+//
+//	{
+//		"clients": [
+//			{"name": "ssh", "uid": 1000, "exe": "/usr/bin/ssh-agent", "pin_cache": "15m", "slots": ["9a"]},
+//			{"name": "git", "uid": 1000, "pin_cache": "1m", "slots": ["9c"]}
+//		]
+//	}
+//
+// The executable is read from /proc/<pid>/exe after the client connects. A
+// client that exits and has its PID reused before the check is attributed the
+// new process's executable, so exe matching narrows the processes of a user
+// and must not be relied on to separate users.
+//
+// Without a configuration file, processes running as the same user as the
+// broker may use any slot, and PINs are cached for the duration given by the
+// -pin-cache flag.
+//
+// The socket is only accessible to the broker's user. To serve clients running
+// as other users, pass -group to make the socket accessible to the members of
+// a group; the configuration file still decides which users are served.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"github.com/go-piv/piv-go/v2/piv/broker"
+)
+
+var (
+	flagSocket   = flag.String("socket", "", "path of the unix socket to listen on")
+	flagSerial   = flag.Uint("serial", 0, "serial number of the YubiKey to use, defaults to the first one found")
+	flagConfig   = flag.String("config", "", "path of a JSON file configuring client policies")
+	flagPINCache = flag.Duration("pin-cache", 0, "how long to cache PINs when no configuration file is given")
+	flagGroup    = flag.String("group", "", "group allowed to connect to the socket, which is otherwise only accessible to the broker's user")
+)
+
+type config struct {
+	Clients []clientConfig `json:"clients"`
+}
+
+type clientConfig struct {
+	Name     string   `json:"name"`
+	UID      *uint32  `json:"uid"`
+	Exe      string   `json:"exe"`
+	PINCache string   `json:"pin_cache"`
+	Slots    []string `json:"slots"`
+}
+
+// rule is a parsed client configuration.
+type rule struct {
+	uid    uint32
+	exe    string
+	policy broker.Policy
+}
+
+func (r *rule) matches(cred broker.PeerCred) bool {
+	if r.uid != cred.UID {
+		return false
+	}
+	if r.exe != "" {
+		// Racy against PID reuse, see the package documentation.
+		exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", cred.PID))
+		if err != nil || exe != r.exe {
+			return false
+		}
+	}
+	return true
+}
+
+func parseSlot(s string) (piv.Slot, error) {
+	key, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 8)
+	if err != nil {
+		return piv.Slot{}, fmt.Errorf("invalid slot %q", s)
+	}
+	switch key {
+	case 0x9a:
+		return piv.SlotAuthentication, nil
+	case 0x9c:
+		return piv.SlotSignature, nil
+	case 0x9d:
+		return piv.SlotKeyManagement, nil
+	case 0x9e:
+		return piv.SlotCardAuthentication, nil
+	}
+	if slot, ok := piv.RetiredKeyManagementSlot(uint32(key)); ok {
+		return slot, nil
+	}
+	return piv.Slot{}, fmt.Errorf("invalid slot %q", s)
+}
+
+func loadConfig(path string) ([]rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	var rules []rule
+	for i, cc := range c.Clients {
+		if cc.UID == nil {
+			return nil, fmt.Errorf("client %d: missing uid", i)
+		}
+		r := rule{
+			uid:    *cc.UID,
+			exe:    cc.Exe,
+			policy: broker.Policy{Name: cc.Name},
+		}
+		if cc.PINCache != "" {
+			d, err := time.ParseDuration(cc.PINCache)
+			if err != nil {
+				return nil, fmt.Errorf("client %d: parsing pin_cache: %w", i, err)
+			}
+			r.policy.PINCache = d
+		}
+		for _, s := range cc.Slots {
+			slot, err := parseSlot(s)
+			if err != nil {
+				return nil, fmt.Errorf("client %d: %w", i, err)
+			}
+			r.policy.Slots = append(r.policy.Slots, slot)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func openCard(serial uint32) (*piv.YubiKey, error) {
+	if serial != 0 {
+		return piv.OpenBySerial(serial)
+	}
+	cards, err := piv.ListCards()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cards {
+		if c.YubiKey {
+			return piv.Open(c.Reader)
+		}
+	}
+	return nil, errors.New("no yubikey found")
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	if *flagSocket == "" {
+		return errors.New("-socket is required")
+	}
+
+	uid := uint32(os.Getuid())
+	rules := []rule{{uid: uid, policy: broker.Policy{PINCache: *flagPINCache}}}
+	if *flagConfig != "" {
+		var err error
+		if rules, err = loadConfig(*flagConfig); err != nil {
+			return fmt.Errorf("loading config: %w", err)
+		}
+	}
+
+	yk, err := openCard(uint32(*flagSerial))
+	if err != nil {
+		return fmt.Errorf("opening yubikey: %w", err)
+	}
+	defer yk.Close()
+
+	l, err := listen(*flagSocket, *flagGroup)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*flagSocket)
+
+	s := &broker.Server{
+		Card: yk,
+		Authorize: func(cred broker.PeerCred) (*broker.Policy, error) {
+			for _, r := range rules {
+				if r.matches(cred) {
+					p := r.policy
+					return &p, nil
+				}
+			}
+			return nil, fmt.Errorf("no policy for pid %d uid %d", cred.PID, cred.UID)
+		},
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+	if err := s.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("serving: %w", err)
+	}
+	return nil
+}
+
+// listen creates the socket in a directory only accessible to the broker's
+// user, so that nobody can connect before its permissions are set, then moves
+// it to path, replacing a socket left behind by a previous run.
+func listen(path, group string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".piv-broker-")
+	if err != nil {
+		return nil, fmt.Errorf("creating socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("listening: %w", err)
+	}
+	if err := setSocketPermissions(tmp, group); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("moving socket into place: %w", err)
+	}
+	// The socket is removed by the caller, since it's no longer at the path
+	// the listener was created with.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return l, nil
+}
+
+// setSocketPermissions keeps other users from connecting at all, unless a
+// group was given.
+func setSocketPermissions(path, group string) error {
+	mode := os.FileMode(0o600)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("looking up group: %w", err)
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("parsing group id %q: %w", g.Gid, err)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("setting socket group: %w", err)
+		}
+		mode = 0o660
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("setting socket permissions: %w", err)
+	}
+	return nil
+}
@@ -1,3 +1,3 @@
 module github.com/go-piv/piv-go/v2
 
-go 1.20
+go 1.21
@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"fmt"
+)
+
+// atr holds information parsed from a card's Answer To Reset.
+//
+// https://en.wikipedia.org/wiki/Answer_to_reset
+type atr struct {
+	// protocols are the transmission protocols indicated by the ATR, such as
+	// 0 for T=0 and 1 for T=1.
+	protocols []byte
+	// historical holds the historical bytes of the ATR.
+	historical []byte
+	// extendedLength indicates the card supports extended length APDUs, as
+	// reported by the card capabilities in the historical bytes.
+	extendedLength bool
+	// contactless indicates the ATR was constructed by a contactless reader
+	// from the card's answer to select, as defined by PC/SC part 3.
+	contactless bool
+	// yubiKey indicates the card issuer's data in the historical bytes
+	// identifies a YubiKey.
+	yubiKey bool
+}
+
+// parseATR parses the structure of an ATR as defined by ISO/IEC 7816-3 and
+// the card capabilities in its historical bytes as defined by ISO/IEC 7816-4.
+func parseATR(b []byte) (*atr, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("atr too short: %d bytes", len(b))
+	}
+	if b[0] != 0x3b && b[0] != 0x3f {
+		return nil, fmt.Errorf("invalid initial character: 0x%02x", b[0])
+	}
+	var a atr
+	y := b[1] >> 4
+	k := int(b[1] & 0x0f)
+	i := 2
+	for {
+		// TAi, TBi, and TCi are present if the corresponding bit is set.
+		for _, bit := range []byte{0x1, 0x2, 0x4} {
+			if y&bit != 0 {
+				i++
+			}
+		}
+		if y&0x8 == 0 {
+			break
+		}
+		if i >= len(b) {
+			return nil, fmt.Errorf("atr truncated in interface bytes")
+		}
+		td := b[i]
+		i++
+		a.protocols = append(a.protocols, td&0x0f)
+		y = td >> 4
+	}
+	if i+k > len(b) {
+		return nil, fmt.Errorf("atr truncated in historical bytes")
+	}
+	a.historical = b[i : i+k]
+	a.extendedLength = historicalExtendedLength(a.historical)
+	a.yubiKey = historicalYubiKey(a.historical)
+	// PC/SC part 3 3.1.3.2.3: contactless cards are reported with TD1 and
+	// TD2 indicating T=0 and T=1, and no other interface bytes.
+	//
+	// https://pcscworkgroup.com/Download/Specifications/pcsc3_v2.01.09.pdf
+	a.contactless = len(b) >= 4 && b[1]&0xf0 == 0x80 && b[2] == 0x80 && b[3] == 0x01
+	return &a, nil
+}
+
+// compactTLV returns the data of the first object in the historical bytes
+// with the given tag, if the historical bytes use the compact-TLV format.
+//
+// https://cardwerk.com/smart-card-standard-iso7816-4-section-8-historical-bytes/
+func compactTLV(historical []byte, tag byte) ([]byte, bool) {
+	if len(historical) == 0 {
+		return nil, false
+	}
+	var objs []byte
+	switch historical[0] {
+	case 0x80:
+		objs = historical[1:]
+	case 0x00:
+		// Followed by a mandatory three byte status indicator.
+		if len(historical) < 4 {
+			return nil, false
+		}
+		objs = historical[1 : len(historical)-3]
+	default:
+		return nil, false
+	}
+	for len(objs) > 0 {
+		t := objs[0] >> 4
+		n := int(objs[0] & 0x0f)
+		if 1+n > len(objs) {
+			return nil, false
+		}
+		if t == tag {
+			return objs[1 : 1+n], true
+		}
+		objs = objs[1+n:]
+	}
+	return nil, false
+}
+
+func historicalYubiKey(historical []byte) bool {
+	// YubiKeys report their name as the card issuer's data.
+	data, ok := compactTLV(historical, 0x5)
+	return ok && string(data) == "YubiKey"
+}
+
+func historicalExtendedLength(historical []byte) bool {
+	// The third software function table of the card capabilities object
+	// indicates support for extended Lc and Le fields.
+	caps, ok := compactTLV(historical, 0x7)
+	return ok && len(caps) >= 3 && caps[2]&0x40 != 0
+}
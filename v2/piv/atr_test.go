@@ -0,0 +1,113 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testYubiKeyATR is the ATR reported by a YubiKey 5 over USB.
+var testYubiKeyATR = []byte{
+	0x3b, 0xfd, 0x13, 0x00, 0x00, 0x81, 0x31, 0xfe, 0x15, 0x80, 0x73, 0xc0,
+	0x21, 0xc0, 0x57, 0x59, 0x75, 0x62, 0x69, 0x4b, 0x65, 0x79, 0x40,
+}
+
+// testYubiKeyNFCATR is the ATR reported for a YubiKey 5 NFC by a contactless
+// reader.
+var testYubiKeyNFCATR = []byte{
+	0x3b, 0x8d, 0x80, 0x01, 0x80, 0x73, 0xc0, 0x21, 0xc0, 0x57, 0x59, 0x75,
+	0x62, 0x69, 0x4b, 0x65, 0x79, 0xf9,
+}
+
+func TestParseATR(t *testing.T) {
+	tests := []struct {
+		name           string
+		atr            []byte
+		protocols      []byte
+		historical     []byte
+		extendedLength bool
+		contactless    bool
+		yubiKey        bool
+	}{
+		{
+			name:           "YubiKey",
+			atr:            testYubiKeyATR,
+			protocols:      []byte{1, 1},
+			historical:     testYubiKeyATR[9:22],
+			extendedLength: true,
+			yubiKey:        true,
+		},
+		{
+			name:       "NoHistoricalBytes",
+			atr:        []byte{0x3b, 0x00},
+			historical: []byte{},
+		},
+		{
+			// Card capabilities without extended length support.
+			name:        "ShortOnly",
+			atr:         []byte{0x3b, 0x85, 0x80, 0x01, 0x80, 0x73, 0xc0, 0x21, 0x80},
+			protocols:   []byte{0, 1},
+			historical:  []byte{0x80, 0x73, 0xc0, 0x21, 0x80},
+			contactless: true,
+		},
+		{
+			name:           "YubiKeyNFC",
+			atr:            testYubiKeyNFCATR,
+			protocols:      []byte{0, 1},
+			historical:     testYubiKeyNFCATR[4:17],
+			extendedLength: true,
+			contactless:    true,
+			yubiKey:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := parseATR(test.atr)
+			if err != nil {
+				t.Fatalf("parsing atr: %v", err)
+			}
+			if !bytes.Equal(a.protocols, test.protocols) {
+				t.Errorf("protocols got=%v, want=%v", a.protocols, test.protocols)
+			}
+			if !bytes.Equal(a.historical, test.historical) {
+				t.Errorf("historical bytes got=%x, want=%x", a.historical, test.historical)
+			}
+			if a.extendedLength != test.extendedLength {
+				t.Errorf("extended length got=%t, want=%t", a.extendedLength, test.extendedLength)
+			}
+			if a.contactless != test.contactless {
+				t.Errorf("contactless got=%t, want=%t", a.contactless, test.contactless)
+			}
+			if a.yubiKey != test.yubiKey {
+				t.Errorf("yubikey got=%t, want=%t", a.yubiKey, test.yubiKey)
+			}
+		})
+	}
+}
+
+func TestParseATRInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		{0x3b},
+		{0x00, 0x00},
+		{0x3b, 0x80},
+		{0x3b, 0x05, 0x01},
+	} {
+		if _, err := parseATR(b); err == nil {
+			t.Errorf("parseATR(%x) expected error", b)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package broker shares a YubiKey between multiple local processes.
+//
+// A YubiKey opened with piv.Open is held exclusively by one process. The
+// broker owns that connection and serves clients over a Unix socket, running
+// their operations one at a time on the card. Clients use an API similar to
+// piv.YubiKey:
+//
+//	c, err := broker.Dial("/run/user/1000/piv-broker.sock")
+//	if err != nil {
+//		// ...
+//	}
+//	defer c.Close()
+//	cert, err := c.Certificate(piv.SlotSignature)
+//	if err != nil {
+//		// ...
+//	}
+//	priv, err := c.PrivateKey(piv.SlotSignature, cert.PublicKey, piv.KeyAuth{PINPrompt: prompt})
+//
+// The broker identifies clients by the credentials of the connecting process,
+// and applies a Policy to each, controlling which slots it may use and how long
+// its PIN is cached. PINs are verified within the same card transaction as the
+// operation that requires them, so one client's PIN verification never allows
+// another client to use a key.
+package broker
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+// ErrPINRequired is returned by operations that require a PIN when the client
+// didn't supply one and the broker has none cached.
+var ErrPINRequired = errors.New("pin required but wasn't provided")
+
+// Card is the subset of *piv.YubiKey used by the broker.
+type Card interface {
+	Certificate(slot piv.Slot) (*x509.Certificate, error)
+	KeyInfo(slot piv.Slot) (piv.KeyInfo, error)
+	PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error)
+}
+
+// PeerCred holds the credentials of a process connected to the broker, as
+// reported by the operating system.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// Policy controls what a client may do.
+type Policy struct {
+	// Name identifies the client for PIN caching. Connections with the same
+	// name share cached PINs, allowing short lived clients such as git
+	// signing helpers to benefit from the cache. If empty, a PIN is only
+	// cached for the connection that supplied it.
+	Name string
+	// PINCache is how long a PIN supplied by the client is remembered. Zero
+	// disables caching, and the client must supply the PIN for every
+	// operation that requires one. A negative value caches the PIN until the
+	// broker exits or the PIN is rejected.
+	PINCache time.Duration
+	// Slots lists the slots the client may use. If empty, all slots are
+	// allowed.
+	Slots []piv.Slot
+}
+
+func (p *Policy) allowed(slot piv.Slot) bool {
+	if len(p.Slots) == 0 {
+		return true
+	}
+	for _, s := range p.Slots {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+// Server serves a card to clients connecting over a Unix socket.
+type Server struct {
+	// Card is the card to share, usually a *piv.YubiKey. It must be safe for
+	// concurrent use.
+	Card Card
+	// Authorize is called for each connection with the credentials of the
+	// connecting process, and returns the policy applied to the client. If
+	// it returns an error, the connection is closed.
+	//
+	// If nil, processes running as the same user as the broker are allowed,
+	// and PINs are never cached.
+	Authorize func(cred PeerCred) (*Policy, error)
+
+	mu   sync.Mutex
+	pins map[string]cachedPIN
+	// conns counts connections, to generate cache keys for unnamed clients.
+	conns int
+}
+
+type cachedPIN struct {
+	pin string
+	// expires is zero if the PIN doesn't expire.
+	expires time.Time
+}
+
+// Serve accepts connections on l, which must be a Unix socket listener, until
+// it returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) authorize(conn net.Conn) (*Policy, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("connection isn't a unix socket")
+	}
+	cred, err := peerCred(uc)
+	if err != nil {
+		return nil, fmt.Errorf("getting peer credentials: %w", err)
+	}
+	if s.Authorize != nil {
+		return s.Authorize(cred)
+	}
+	if uid := os.Getuid(); uid < 0 || cred.UID != uint32(uid) {
+		return nil, fmt.Errorf("uid %d not permitted", cred.UID)
+	}
+	return &Policy{}, nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	policy, err := s.authorize(conn)
+	if err != nil {
+		return
+	}
+	ss := &session{s: s, policy: policy, name: policy.Name}
+	if ss.name == "" {
+		s.mu.Lock()
+		s.conns++
+		ss.name = fmt.Sprintf("\x00conn%d", s.conns)
+		s.mu.Unlock()
+		defer s.forget(ss.name)
+	}
+
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		resp := ss.handle(&req)
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) cached(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pins[name]
+	if !ok {
+		return "", false
+	}
+	if !p.expires.IsZero() && time.Now().After(p.expires) {
+		delete(s.pins, name)
+		return "", false
+	}
+	return p.pin, true
+}
+
+func (s *Server) cache(name, pin string, d time.Duration) {
+	if d == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pins == nil {
+		s.pins = make(map[string]cachedPIN)
+	}
+	p := cachedPIN{pin: pin}
+	if d > 0 {
+		p.expires = time.Now().Add(d)
+	}
+	s.pins[name] = p
+}
+
+func (s *Server) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pins, name)
+}
+
+// Operations of the wire protocol.
+const (
+	opCertificate = "Certificate"
+	opKeyInfo     = "KeyInfo"
+	opSign        = "Sign"
+	opDecrypt     = "Decrypt"
+	opECDH        = "ECDH"
+)
+
+// request is sent by clients, encoded with encoding/gob.
+type request struct {
+	Op   string
+	Slot piv.Slot
+	// PIN is set if the client supplies a PIN for the operation.
+	PIN string
+	// Data holds the digest to sign, the ciphertext to decrypt, or the peer's
+	// public key for ECDH.
+	Data []byte
+	// Hash and SaltLength are the signing options. SaltLength is only used
+	// if PSS is set.
+	Hash       crypto.Hash
+	PSS        bool
+	SaltLength int
+}
+
+// response is sent by the broker for each request.
+type response struct {
+	Data    []byte
+	KeyInfo *keyInfo
+	// Err describes a failure. PINRequired and AuthErr identify failures
+	// clients can act on.
+	Err         string
+	PINRequired bool
+	AuthErr     *piv.AuthErr
+}
+
+// keyInfo is piv.KeyInfo with the public key encoded in PKIX form.
+type keyInfo struct {
+	Algorithm   piv.Algorithm
+	PINPolicy   piv.PINPolicy
+	TouchPolicy piv.TouchPolicy
+	Origin      piv.Origin
+	PublicKey   []byte
+}
+
+// session is the state of a client connection.
+type session struct {
+	s      *Server
+	policy *Policy
+	// name is the key of the client's cached PIN.
+	name string
+}
+
+func (ss *session) handle(req *request) *response {
+	if !ss.policy.allowed(req.Slot) {
+		return &response{Err: fmt.Sprintf("slot %x not permitted", req.Slot.Key)}
+	}
+	var (
+		resp response
+		err  error
+	)
+	switch req.Op {
+	case opCertificate:
+		var cert *x509.Certificate
+		if cert, err = ss.s.Card.Certificate(req.Slot); err == nil {
+			resp.Data = cert.Raw
+		}
+	case opKeyInfo:
+		var ki piv.KeyInfo
+		if ki, err = ss.s.Card.KeyInfo(req.Slot); err == nil {
+			resp.KeyInfo = &keyInfo{
+				Algorithm:   ki.Algorithm,
+				PINPolicy:   ki.PINPolicy,
+				TouchPolicy: ki.TouchPolicy,
+				Origin:      ki.Origin,
+			}
+			resp.KeyInfo.PublicKey, err = x509.MarshalPKIXPublicKey(ki.PublicKey)
+		}
+	case opSign, opDecrypt, opECDH:
+		resp.Data, err = ss.private(req)
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		resp.Err = err.Error()
+		var authErr piv.AuthErr
+		if errors.As(err, &authErr) {
+			resp.AuthErr = &authErr
+		}
+		resp.PINRequired = errors.Is(err, ErrPINRequired)
+	}
+	return &resp
+}
+
+// private runs an operation using the private key of a slot.
+func (ss *session) private(req *request) ([]byte, error) {
+	// Keys that require a PIN are verified for every operation, so that a PIN
+	// verified by one client doesn't carry over to others.
+	pp := piv.PINPolicyAlways
+	var pub crypto.PublicKey
+	if ki, err := ss.s.Card.KeyInfo(req.Slot); err == nil {
+		pub = ki.PublicKey
+		if ki.PINPolicy == piv.PINPolicyNever {
+			pp = piv.PINPolicyNever
+		}
+	} else {
+		// Older YubiKeys don't report key metadata.
+		cert, err := ss.s.Card.Certificate(req.Slot)
+		if err != nil {
+			return nil, fmt.Errorf("determining public key: %w", err)
+		}
+		pub = cert.PublicKey
+	}
+
+	// The PIN is passed to the card directly rather than through PINPrompt,
+	// so that a PIN cached by a YubiKey opened with Client.PINCache, possibly
+	// supplied by another client, is never used.
+	pin := req.PIN
+	if pp != piv.PINPolicyNever && pin == "" {
+		cached, ok := ss.s.cached(ss.name)
+		if !ok {
+			return nil, ErrPINRequired
+		}
+		pin = cached
+	}
+	auth := piv.KeyAuth{PIN: pin, PINPolicy: pp}
+	priv, err := ss.s.Card.PrivateKey(req.Slot, pub, auth)
+	if err != nil {
+		return nil, err
+	}
+	b, err := run(priv, req)
+	var authErr piv.AuthErr
+	if errors.As(err, &authErr) {
+		ss.s.forget(ss.name)
+	} else if err == nil && req.PIN != "" {
+		ss.s.cache(ss.name, req.PIN, ss.policy.PINCache)
+	}
+	return b, err
+}
+
+func run(priv crypto.PrivateKey, req *request) ([]byte, error) {
+	switch req.Op {
+	case opSign:
+		s, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key doesn't support signing")
+		}
+		var opts crypto.SignerOpts = req.Hash
+		if req.PSS {
+			opts = &rsa.PSSOptions{SaltLength: req.SaltLength, Hash: req.Hash}
+		}
+		return s.Sign(nil, req.Data, opts)
+	case opDecrypt:
+		d, ok := priv.(crypto.Decrypter)
+		if !ok {
+			return nil, fmt.Errorf("key doesn't support decryption")
+		}
+		return d.Decrypt(nil, req.Data, nil)
+	case opECDH:
+		k, ok := priv.(ecdhKey)
+		if !ok {
+			return nil, fmt.Errorf("key doesn't support ecdh")
+		}
+		curve, err := ecdhCurve(k)
+		if err != nil {
+			return nil, err
+		}
+		peer, err := curve.NewPublicKey(req.Data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing peer public key: %w", err)
+		}
+		return k.ECDH(peer)
+	}
+	return nil, fmt.Errorf("unknown operation %q", req.Op)
+}
+
+// ecdhKey is implemented by keys supporting key agreement, such as
+// *piv.ECDSAPrivateKey and *piv.X25519PrivateKey.
+type ecdhKey interface {
+	Public() crypto.PublicKey
+	ECDH(peer *ecdh.PublicKey) ([]byte, error)
+}
+
+// ecdhCurve returns the curve of a key agreement key.
+func ecdhCurve(k ecdhKey) (ecdh.Curve, error) {
+	switch pub := k.Public().(type) {
+	case *ecdsa.PublicKey:
+		p, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return p.Curve(), nil
+	case *ecdh.PublicKey:
+		return pub.Curve(), nil
+	}
+	return nil, fmt.Errorf("unsupported public key type: %T", k.Public())
+}
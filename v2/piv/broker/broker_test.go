@@ -0,0 +1,373 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"github.com/go-piv/piv-go/v2/piv/emulator"
+)
+
+const testPIN = "123456"
+
+// fakeCard is a Card holding software ECDSA keys.
+type fakeCard struct {
+	mu   sync.Mutex
+	keys map[piv.Slot]*ecdsa.PrivateKey
+	// pp is the PIN policy of every key.
+	pp piv.PINPolicy
+	// verifies counts PIN verifications.
+	verifies int
+}
+
+func newFakeCard(t *testing.T, pp piv.PINPolicy, slots ...piv.Slot) *fakeCard {
+	c := &fakeCard{keys: make(map[piv.Slot]*ecdsa.PrivateKey), pp: pp}
+	for _, s := range slots {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		c.keys[s] = k
+	}
+	return c
+}
+
+func (c *fakeCard) Certificate(slot piv.Slot) (*x509.Certificate, error) {
+	k, ok := c.keys[slot]
+	if !ok {
+		return nil, piv.ErrNotFound
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (c *fakeCard) KeyInfo(slot piv.Slot) (piv.KeyInfo, error) {
+	k, ok := c.keys[slot]
+	if !ok {
+		return piv.KeyInfo{}, piv.ErrNotFound
+	}
+	return piv.KeyInfo{Algorithm: piv.AlgorithmEC256, PINPolicy: c.pp, PublicKey: k.Public()}, nil
+}
+
+func (c *fakeCard) PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error) {
+	k, ok := c.keys[slot]
+	if !ok {
+		return nil, piv.ErrNotFound
+	}
+	return &fakeKey{c: c, k: k, auth: auth}, nil
+}
+
+type fakeKey struct {
+	c    *fakeCard
+	k    *ecdsa.PrivateKey
+	auth piv.KeyAuth
+}
+
+func (k *fakeKey) Public() crypto.PublicKey { return k.k.Public() }
+
+func (k *fakeKey) login() error {
+	if k.auth.PINPolicy == piv.PINPolicyNever {
+		return nil
+	}
+	pin := k.auth.PIN
+	if pin == "" {
+		var err error
+		if pin, err = k.auth.PINPrompt(); err != nil {
+			return err
+		}
+	}
+	k.c.mu.Lock()
+	k.c.verifies++
+	k.c.mu.Unlock()
+	if pin != testPIN {
+		return piv.AuthErr{Retries: 2}
+	}
+	return nil
+}
+
+func (k *fakeKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := k.login(); err != nil {
+		return nil, err
+	}
+	return k.k.Sign(rand.Reader, digest, opts)
+}
+
+func (k *fakeKey) ECDH(peer *ecdh.PublicKey) ([]byte, error) {
+	if err := k.login(); err != nil {
+		return nil, err
+	}
+	priv, err := k.k.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return priv.ECDH(peer)
+}
+
+func startServer(t *testing.T, s *Server) string {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return path
+}
+
+func dial(t *testing.T, path string) *Client {
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("dialing broker: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestBrokerSign(t *testing.T) {
+	card := newFakeCard(t, piv.PINPolicyOnce, piv.SlotSignature)
+	path := startServer(t, &Server{Card: card})
+	c := dial(t, path)
+
+	cert, err := c.Certificate(piv.SlotSignature)
+	if err != nil {
+		t.Fatalf("getting certificate: %v", err)
+	}
+	prompts := 0
+	auth := piv.KeyAuth{PINPrompt: func() (string, error) {
+		prompts++
+		return testPIN, nil
+	}}
+	priv, err := c.PrivateKey(piv.SlotSignature, cert.PublicKey, auth)
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	s, ok := priv.(crypto.Signer)
+	if !ok {
+		t.Fatalf("expected private key to implement crypto.Signer")
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	for i := 0; i < 2; i++ {
+		sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), digest[:], sig) {
+			t.Errorf("signature didn't verify")
+		}
+	}
+	// PINs aren't cached by default.
+	if prompts != 2 {
+		t.Errorf("got %d pin prompts, want 2", prompts)
+	}
+
+	if _, err := c.Certificate(piv.SlotAuthentication); err == nil {
+		t.Errorf("expected error getting certificate of empty slot")
+	}
+}
+
+func TestBrokerPINCache(t *testing.T) {
+	card := newFakeCard(t, piv.PINPolicyAlways, piv.SlotSignature, piv.SlotAuthentication)
+	path := startServer(t, &Server{
+		Card: card,
+		Authorize: func(cred PeerCred) (*Policy, error) {
+			return &Policy{
+				Name:     "git",
+				PINCache: time.Hour,
+				Slots:    []piv.Slot{piv.SlotSignature},
+			}, nil
+		},
+	})
+
+	sign := func(c *Client, auth piv.KeyAuth) error {
+		ki, err := c.KeyInfo(piv.SlotSignature)
+		if err != nil {
+			return err
+		}
+		priv, err := c.PrivateKey(piv.SlotSignature, ki.PublicKey, auth)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256([]byte("hello"))
+		_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+		return err
+	}
+
+	c1 := dial(t, path)
+	if err := sign(c1, piv.KeyAuth{}); !errors.Is(err, ErrPINRequired) {
+		t.Fatalf("signing without pin: got err=%v, want ErrPINRequired", err)
+	}
+	if err := sign(c1, piv.KeyAuth{PIN: "000000"}); !errors.As(err, new(piv.AuthErr)) {
+		t.Fatalf("signing with wrong pin: got err=%v, want AuthErr", err)
+	}
+	if err := sign(c1, piv.KeyAuth{PIN: testPIN}); err != nil {
+		t.Fatalf("signing with pin: %v", err)
+	}
+	// A new connection of the same client uses the cached PIN.
+	c2 := dial(t, path)
+	if err := sign(c2, piv.KeyAuth{}); err != nil {
+		t.Fatalf("signing with cached pin: %v", err)
+	}
+	// The PIN is verified for every operation, since the key's policy
+	// requires it.
+	if card.verifies != 3 {
+		t.Errorf("got %d pin verifications, want 3", card.verifies)
+	}
+
+	if _, err := c2.Certificate(piv.SlotAuthentication); err == nil {
+		t.Errorf("expected error accessing slot not permitted by policy")
+	}
+}
+
+func TestBrokerECDH(t *testing.T) {
+	card := newFakeCard(t, piv.PINPolicyNever, piv.SlotKeyManagement)
+	path := startServer(t, &Server{Card: card})
+	c := dial(t, path)
+
+	ki, err := c.KeyInfo(piv.SlotKeyManagement)
+	if err != nil {
+		t.Fatalf("getting key info: %v", err)
+	}
+	priv, err := c.PrivateKey(piv.SlotKeyManagement, ki.PublicKey, piv.KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	k, ok := priv.(*ECDSAPrivateKey)
+	if !ok {
+		t.Fatalf("expected *ECDSAPrivateKey, got %T", priv)
+	}
+
+	peer, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating peer key: %v", err)
+	}
+	got, err := k.ECDH(peer.PublicKey())
+	if err != nil {
+		t.Fatalf("ecdh: %v", err)
+	}
+	pub, err := ki.PublicKey.(*ecdsa.PublicKey).ECDH()
+	if err != nil {
+		t.Fatalf("converting public key: %v", err)
+	}
+	want, err := peer.ECDH(pub)
+	if err != nil {
+		t.Fatalf("peer ecdh: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("shared secret got=%x, want=%x", got, want)
+	}
+}
+
+func TestBrokerUnauthorized(t *testing.T) {
+	card := newFakeCard(t, piv.PINPolicyNever, piv.SlotSignature)
+	path := startServer(t, &Server{
+		Card: card,
+		Authorize: func(cred PeerCred) (*Policy, error) {
+			return nil, errors.New("denied")
+		},
+	})
+	c := dial(t, path)
+	if _, err := c.Certificate(piv.SlotSignature); err == nil {
+		t.Errorf("expected error from unauthorized client")
+	}
+}
+
+func TestBrokerYubiKeyPINCache(t *testing.T) {
+	card, err := emulator.New(emulator.Config{})
+	if err != nil {
+		t.Fatalf("creating emulator: %v", err)
+	}
+	// The YubiKey remembers prompted PINs, which must not let one client use
+	// a PIN supplied by another.
+	c := piv.Client{PINCache: time.Hour}
+	yk, err := c.OpenTransport(card)
+	if err != nil {
+		t.Fatalf("opening emulator: %v", err)
+	}
+	defer yk.Close()
+	key := piv.Key{
+		Algorithm:   piv.AlgorithmEC256,
+		PINPolicy:   piv.PINPolicyAlways,
+		TouchPolicy: piv.TouchPolicyNever,
+	}
+	if _, err := yk.GenerateKey(piv.DefaultManagementKey, piv.SlotSignature, key); err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	path := startServer(t, &Server{
+		Card: yk,
+		Authorize: func(cred PeerCred) (*Policy, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			conns++
+			return &Policy{Name: fmt.Sprintf("client%d", conns), PINCache: time.Hour}, nil
+		},
+	})
+	sign := func(c *Client, auth piv.KeyAuth) error {
+		ki, err := c.KeyInfo(piv.SlotSignature)
+		if err != nil {
+			return err
+		}
+		priv, err := c.PrivateKey(piv.SlotSignature, ki.PublicKey, auth)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256([]byte("hello"))
+		_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+		return err
+	}
+
+	c1 := dial(t, path)
+	if err := sign(c1, piv.KeyAuth{PIN: piv.DefaultPIN}); err != nil {
+		t.Fatalf("signing with pin: %v", err)
+	}
+	c2 := dial(t, path)
+	if err := sign(c2, piv.KeyAuth{}); !errors.Is(err, ErrPINRequired) {
+		t.Errorf("signing without pin: got err=%v, want ErrPINRequired", err)
+	}
+	// The first client's PIN is still cached by the broker.
+	if err := sign(c1, piv.KeyAuth{}); err != nil {
+		t.Errorf("signing with cached pin: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+// Client is a connection to a broker. It's safe for concurrent use, though
+// operations are sent to the broker one at a time.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+// Dial connects to the broker listening on the Unix socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to broker: %w", err)
+	}
+	return &Client{conn: conn, enc: gob.NewEncoder(conn), dec: gob.NewDecoder(conn)}, nil
+}
+
+// Close closes the connection to the broker.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(req *request) (*response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	var resp response
+	if err := c.dec.Decode(&resp); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("broker closed connection")
+		}
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	switch {
+	case resp.PINRequired:
+		return nil, ErrPINRequired
+	case resp.AuthErr != nil:
+		return nil, fmt.Errorf("broker: %w", *resp.AuthErr)
+	case resp.Err != "":
+		return nil, fmt.Errorf("broker: %s", resp.Err)
+	}
+	return &resp, nil
+}
+
+// Certificate returns the certificate stored in a slot. See
+// piv.YubiKey.Certificate.
+func (c *Client) Certificate(slot piv.Slot) (*x509.Certificate, error) {
+	resp, err := c.call(&request{Op: opCertificate, Slot: slot})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(resp.Data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// KeyInfo returns metadata about the key in a slot. See piv.YubiKey.KeyInfo.
+func (c *Client) KeyInfo(slot piv.Slot) (piv.KeyInfo, error) {
+	resp, err := c.call(&request{Op: opKeyInfo, Slot: slot})
+	if err != nil {
+		return piv.KeyInfo{}, err
+	}
+	if resp.KeyInfo == nil {
+		return piv.KeyInfo{}, fmt.Errorf("broker returned no key info")
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.KeyInfo.PublicKey)
+	if err != nil {
+		return piv.KeyInfo{}, fmt.Errorf("parsing public key: %w", err)
+	}
+	return piv.KeyInfo{
+		Algorithm:   resp.KeyInfo.Algorithm,
+		PINPolicy:   resp.KeyInfo.PINPolicy,
+		TouchPolicy: resp.KeyInfo.TouchPolicy,
+		Origin:      resp.KeyInfo.Origin,
+		PublicKey:   pub,
+	}, nil
+}
+
+// PrivateKey returns a key that runs operations on the private key in a slot
+// through the broker. Like piv.YubiKey.PrivateKey, the returned key implements
+// crypto.Signer, crypto.Decrypter or an ECDH method depending on the key type.
+//
+// The PIN of auth is sent with every operation if set. Otherwise, PINPrompt is
+// only called when the broker requires a PIN and has none cached for this
+// client. The PINPolicy and PINPad fields are ignored.
+func (c *Client) PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error) {
+	k := key{c: c, slot: slot, pub: public, auth: auth}
+	switch public.(type) {
+	case *ecdsa.PublicKey:
+		return &ECDSAPrivateKey{k}, nil
+	case ed25519.PublicKey:
+		return &ed25519Key{k}, nil
+	case *rsa.PublicKey:
+		return &rsaKey{k}, nil
+	case *ecdh.PublicKey:
+		return &X25519PrivateKey{k}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type: %T", public)
+}
+
+// key implements the operations shared by all key types.
+type key struct {
+	c    *Client
+	slot piv.Slot
+	pub  crypto.PublicKey
+	auth piv.KeyAuth
+}
+
+func (k *key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *key) do(req *request) ([]byte, error) {
+	req.Slot = k.slot
+	req.PIN = k.auth.PIN
+	resp, err := k.c.call(req)
+	if errors.Is(err, ErrPINRequired) && req.PIN == "" && k.auth.PINPrompt != nil {
+		// The broker has no PIN cached for this client.
+		pin, perr := k.auth.PINPrompt()
+		if perr != nil {
+			return nil, fmt.Errorf("pin prompt: %w", perr)
+		}
+		req.PIN = pin
+		resp, err = k.c.call(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (k *key) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := &request{Op: opSign, Data: digest}
+	if opts != nil {
+		req.Hash = opts.HashFunc()
+	}
+	if o, ok := opts.(*rsa.PSSOptions); ok {
+		req.PSS = true
+		req.SaltLength = o.SaltLength
+	}
+	return k.do(req)
+}
+
+func (k *key) ecdh(peer *ecdh.PublicKey) ([]byte, error) {
+	return k.do(&request{Op: opECDH, Data: peer.Bytes()})
+}
+
+// ECDSAPrivateKey is an ECDSA key accessed through the broker, implementing
+// crypto.Signer and key agreement.
+type ECDSAPrivateKey struct {
+	key
+}
+
+// Sign implements crypto.Signer. The rand argument is ignored.
+func (k *ECDSAPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.sign(digest, opts)
+}
+
+// ECDH performs a Diffie-Hellman key agreement with the peer.
+func (k *ECDSAPrivateKey) ECDH(peer *ecdh.PublicKey) ([]byte, error) {
+	return k.ecdh(peer)
+}
+
+// X25519PrivateKey is an X25519 key accessed through the broker.
+type X25519PrivateKey struct {
+	key
+}
+
+// ECDH performs a Diffie-Hellman key agreement with the peer.
+func (k *X25519PrivateKey) ECDH(peer *ecdh.PublicKey) ([]byte, error) {
+	return k.ecdh(peer)
+}
+
+type ed25519Key struct {
+	key
+}
+
+func (k *ed25519Key) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.sign(message, opts)
+}
+
+type rsaKey struct {
+	key
+}
+
+func (k *rsaKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.sign(digest, opts)
+}
+
+// Decrypt decrypts a PKCS #1 v1.5 encrypted message. The rand and opts
+// arguments are ignored.
+func (k *rsaKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.do(&request{Op: opDecrypt, Data: msg})
+}
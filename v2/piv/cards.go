@@ -0,0 +1,206 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CardInfo describes a smart card reader and the card it holds, as returned by
+// ListCards.
+type CardInfo struct {
+	// Reader is the name of the reader, as accepted by Open.
+	Reader string
+	// ATR is the Answer To Reset of the card, if one is present.
+	ATR []byte
+	// Present indicates a card is inserted in the reader.
+	Present bool
+	// Contactless indicates the card is accessed through a contactless (NFC)
+	// reader. See YubiKey.Contactless.
+	Contactless bool
+
+	// YubiKey is set if the card responded to the YubiKey PIV commands. The
+	// following fields are only populated for YubiKeys.
+	YubiKey bool
+	// Serial is the YubiKey's serial number, or zero if it couldn't be read.
+	// For example, YubiKeys older than version 5 only report it if the
+	// "Serial number visible" flag is set.
+	Serial uint32
+	// Version is the version reported by the PIV applet. See YubiKey.Version.
+	Version Version
+	// Formfactor is the physical form of the YubiKey, or zero if it's unknown.
+	// It's only reported by YubiKeys version 5 and above.
+	Formfactor Formfactor
+}
+
+// ListCards describes all smart card readers available via the PC/SC
+// interface, including the serial number, version and form factor of any
+// YubiKeys.
+//
+// ListCards connects to each card in shared mode, so cards in use by another
+// process are still listed, but without YubiKey details if that process holds
+// the card exclusively.
+func ListCards() ([]CardInfo, error) {
+	var c Client
+	return c.ListCards()
+}
+
+// OpenBySerial connects to the YubiKey with the given serial number. If no
+// such YubiKey is present, the returned error wraps ErrNotFound.
+func OpenBySerial(serial uint32) (*YubiKey, error) {
+	var c Client
+	return c.OpenBySerial(serial)
+}
+
+// ListCards lists the cards available through the client's backend. See
+// ListCards.
+func (c *Client) ListCards() ([]CardInfo, error) {
+	ctx, err := c.backend()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to smart card daemon: %w", err)
+	}
+	defer ctx.Close()
+
+	readers, err := ctx.ListReaders()
+	if err != nil {
+		return nil, fmt.Errorf("listing readers: %w", err)
+	}
+	states := make([]scReaderState, len(readers))
+	for i, r := range readers {
+		states[i] = scReaderState{reader: r, currentState: scStateUnaware}
+	}
+	// Readers in an unaware state report their current state immediately.
+	if err := ctx.GetStatusChange(states, 0); err != nil {
+		var e *scErr
+		if !errors.As(err, &e) || e.rc != rcTimeout {
+			return nil, fmt.Errorf("querying reader states: %w", err)
+		}
+	}
+
+	cards := make([]CardInfo, len(readers))
+	for i, s := range states {
+		cards[i] = CardInfo{
+			Reader:      s.reader,
+			ATR:         s.atr,
+			Present:     s.eventState&scStatePresent != 0,
+			Contactless: readerContactless(s.reader),
+		}
+		if a, err := parseATR(s.atr); err == nil && a.contactless {
+			cards[i].Contactless = true
+		}
+		if cards[i].Present {
+			// Cards that can't be queried, for example because they aren't
+			// YubiKeys, are listed without the YubiKey details.
+			c.yubiKeyInfo(ctx, &cards[i])
+		}
+	}
+	return cards, nil
+}
+
+// yubiKeyInfo fills in the YubiKey details of a card.
+func (c *Client) yubiKeyInfo(ctx scBackend, info *CardInfo) error {
+	h, err := ctx.connect(info.Reader, scShareShared)
+	if err != nil {
+		return fmt.Errorf("connecting to smart card: %w", err)
+	}
+	defer h.Close()
+	tx, err := beginTx(h)
+	if err != nil {
+		return fmt.Errorf("beginning smart card transaction: %w", err)
+	}
+	defer tx.Close()
+	tx.op = "ListCards"
+	tx.tracer = c.Tracer
+
+	if err := ykSelectApplication(tx, aidPIV[:]); err != nil {
+		return fmt.Errorf("selecting piv applet: %w", err)
+	}
+	v, err := ykVersion(tx)
+	if err != nil {
+		return fmt.Errorf("getting yubikey version: %w", err)
+	}
+	info.YubiKey = true
+	info.Version = Version{int(v.major), int(v.minor), int(v.patch)}
+	if serial, err := ykSerial(tx, v); err == nil {
+		info.Serial = serial
+	}
+	if v.major < 5 {
+		return nil
+	}
+	if err := ykSelectApplication(tx, aidManagement[:]); err != nil {
+		return fmt.Errorf("selecting management applet: %w", err)
+	}
+	defer ykSelectApplication(tx, aidPIV[:])
+	ff, err := ykFormfactor(tx)
+	if err != nil {
+		return fmt.Errorf("reading device info: %w", err)
+	}
+	info.Formfactor = ff
+	return nil
+}
+
+// OpenBySerial connects to the YubiKey with the given serial number using the
+// client's configuration. See OpenBySerial.
+func (c *Client) OpenBySerial(serial uint32) (*YubiKey, error) {
+	cards, err := c.ListCards()
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		if card.YubiKey && card.Serial == serial {
+			return c.Open(card.Reader)
+		}
+	}
+	return nil, fmt.Errorf("yubikey with serial %d: %w", serial, ErrNotFound)
+}
+
+const (
+	// insReadConfig reads the device info from the management applet.
+	insReadConfig = 0x1d
+
+	// Device info tags.
+	//
+	// https://github.com/Yubico/yubikey-manager/blob/main/yubikit/management.py
+	tagDeviceFormfactor = 0x04
+)
+
+// ykFormfactor reads the form factor from the device info of the management
+// applet, which must be selected.
+func ykFormfactor(tx *scTx) (Formfactor, error) {
+	resp, err := tx.Transmit(apdu{instruction: insReadConfig})
+	if err != nil {
+		return 0, err
+	}
+	// The device info is prefixed by its length, and consists of single byte
+	// tags and lengths.
+	if len(resp) < 1 || int(resp[0]) > len(resp)-1 {
+		return 0, fmt.Errorf("invalid device info length")
+	}
+	b := resp[1 : 1+int(resp[0])]
+	for len(b) >= 2 {
+		tag, n := b[0], int(b[1])
+		if 2+n > len(b) {
+			return 0, fmt.Errorf("device info truncated")
+		}
+		if tag == tagDeviceFormfactor && n == 1 {
+			// Bit 0x40 indicates a Security Key series YubiKey, which has no
+			// corresponding Formfactor value.
+			return Formfactor(b[2] &^ 0x40), nil
+		}
+		b = b[2+n:]
+	}
+	return 0, nil
+}
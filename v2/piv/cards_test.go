@@ -0,0 +1,73 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestListCards(t *testing.T) {
+	cards, err := ListCards()
+	if err != nil {
+		t.Fatalf("listing cards: %v", err)
+	}
+	for _, c := range cards {
+		t.Logf("%q: present=%t yubikey=%t serial=%d version=%v formfactor=%v",
+			c.Reader, c.Present, c.YubiKey, c.Serial, c.Version, c.Formfactor)
+	}
+}
+
+func TestOpenBySerialNotFound(t *testing.T) {
+	cards, err := ListCards()
+	if err != nil {
+		t.Fatalf("listing cards: %v", err)
+	}
+	for _, c := range cards {
+		if c.YubiKey && c.Serial == 0xffffffff {
+			t.Skip("yubikey with test serial present")
+		}
+	}
+	if _, err := OpenBySerial(0xffffffff); !errors.Is(err, ErrNotFound) {
+		t.Errorf("open by serial: got err=%v, want=ErrNotFound", err)
+	}
+}
+
+func TestFormfactor(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{
+				0x0b,
+				0x01, 0x02, 0x02, 0x3f, // USB supported
+				0x04, 0x01, 0x83, // formfactor
+				0x0a, 0x02, 0x00, 0x01, // unknown tag, ignored
+				0x90, 0x00,
+			},
+		},
+	}
+	tx, err := beginTx(ft)
+	if err != nil {
+		t.Fatalf("beginning transaction: %v", err)
+	}
+	defer tx.Close()
+
+	got, err := ykFormfactor(tx)
+	if err != nil {
+		t.Fatalf("reading formfactor: %v", err)
+	}
+	if want := Formfactor(FormfactorUSBCKeychainFIPS); got != want {
+		t.Errorf("formfactor got=%v, want=%v", got, want)
+	}
+}
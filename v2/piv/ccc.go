@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CCC is the Card Capability Container data object, which describes the data
+// model of the card to middleware that supports multiple types of cards, such
+// as the Windows smart card minidriver.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=40
+type CCC struct {
+	// CardIdentifier is the 21 byte card identifier: the 5 byte GSC-RID
+	// 0xa000000116, a manufacturer ID, a card type, and a 14 byte card ID.
+	CardIdentifier []byte
+	// CapabilityContainerVersion is the version of the container, 0x21 for
+	// PIV cards.
+	CapabilityContainerVersion byte
+	// CapabilityGrammarVersion is the version of the grammar, 0x21 for PIV
+	// cards.
+	CapabilityGrammarVersion byte
+	// ApplicationsCardURL is usually empty for PIV cards.
+	ApplicationsCardURL []byte
+	// PKCS15 indicates whether the card supports PKCS#15, 0x00 for PIV cards.
+	PKCS15 byte
+	// DataModelNumber is the registered data model number, 0x10 for PIV
+	// cards.
+	DataModelNumber byte
+	// AccessControlRuleTable is usually empty for PIV cards.
+	AccessControlRuleTable []byte
+	// ExtendedApplicationCardURL is optional, and usually empty.
+	ExtendedApplicationCardURL []byte
+	// SecurityObjectBuffer is optional, and usually empty.
+	SecurityObjectBuffer []byte
+}
+
+// CCC tags.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=40
+const (
+	tagCCCCardIdentifier             = 0xf0
+	tagCCCContainerVersion           = 0xf1
+	tagCCCGrammarVersion             = 0xf2
+	tagCCCApplicationsCardURL        = 0xf3
+	tagCCCPKCS15                     = 0xf4
+	tagCCCDataModelNumber            = 0xf5
+	tagCCCAccessControlRuleTable     = 0xf6
+	tagCCCCardAPDUs                  = 0xf7
+	tagCCCRedirectionTag             = 0xfa
+	tagCCCCapabilityTuples           = 0xfb
+	tagCCCStatusTuples               = 0xfc
+	tagCCCNextCCC                    = 0xfd
+	tagCCCExtendedApplicationCardURL = 0xe3
+	tagCCCSecurityObjectBuffer       = 0xb4
+)
+
+// cccIdentifierPrefix is the GSC-RID, manufacturer ID and card type used in
+// card identifiers created by NewCCC, matching other YubiKey tools.
+var cccIdentifierPrefix = []byte{0xa0, 0x00, 0x00, 0x01, 0x16, 0xff, 0x02}
+
+// NewCCC returns a Card Capability Container for a PIV card, with a random
+// card ID.
+func NewCCC(rand io.Reader) (*CCC, error) {
+	id := make([]byte, 21)
+	copy(id, cccIdentifierPrefix)
+	if _, err := io.ReadFull(rand, id[len(cccIdentifierPrefix):]); err != nil {
+		return nil, fmt.Errorf("generating card id: %w", err)
+	}
+	return &CCC{
+		CardIdentifier:             id,
+		CapabilityContainerVersion: 0x21,
+		CapabilityGrammarVersion:   0x21,
+		PKCS15:                     0x00,
+		DataModelNumber:            0x10,
+	}, nil
+}
+
+// ParseCCC decodes a Card Capability Container, as stored in the
+// ObjectCardCapabilityContainer data object.
+func ParseCCC(b []byte) (*CCC, error) {
+	elems, err := parseObjectElements(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ccc: %v", err)
+	}
+	c := &CCC{}
+	// Single byte elements.
+	one := map[byte]*byte{
+		tagCCCContainerVersion: &c.CapabilityContainerVersion,
+		tagCCCGrammarVersion:   &c.CapabilityGrammarVersion,
+		tagCCCPKCS15:           &c.PKCS15,
+		tagCCCDataModelNumber:  &c.DataModelNumber,
+	}
+	for _, e := range elems {
+		if p, ok := one[e.tag]; ok {
+			if len(e.value) != 1 {
+				return nil, fmt.Errorf("invalid length of ccc element 0x%x: %d", e.tag, len(e.value))
+			}
+			*p = e.value[0]
+			continue
+		}
+		switch e.tag {
+		case tagCCCCardIdentifier:
+			c.CardIdentifier = e.value
+		case tagCCCApplicationsCardURL:
+			c.ApplicationsCardURL = e.value
+		case tagCCCAccessControlRuleTable:
+			c.AccessControlRuleTable = e.value
+		case tagCCCExtendedApplicationCardURL:
+			c.ExtendedApplicationCardURL = e.value
+		case tagCCCSecurityObjectBuffer:
+			c.SecurityObjectBuffer = e.value
+		default:
+			// Ignore the elements that are always empty for PIV cards, and
+			// unknown elements.
+		}
+	}
+	if len(c.CardIdentifier) == 0 {
+		return nil, errors.New("ccc missing card identifier")
+	}
+	return c, nil
+}
+
+// Marshal encodes the Card Capability Container, to be stored in the
+// ObjectCardCapabilityContainer data object.
+func (c *CCC) Marshal() ([]byte, error) {
+	if len(c.CardIdentifier) != 21 {
+		return nil, fmt.Errorf("invalid card identifier length: %d bytes (expected 21)", len(c.CardIdentifier))
+	}
+	b := marshalASN1(tagCCCCardIdentifier, c.CardIdentifier)
+	b = append(b, marshalASN1(tagCCCContainerVersion, []byte{c.CapabilityContainerVersion})...)
+	b = append(b, marshalASN1(tagCCCGrammarVersion, []byte{c.CapabilityGrammarVersion})...)
+	b = append(b, marshalASN1(tagCCCApplicationsCardURL, c.ApplicationsCardURL)...)
+	b = append(b, marshalASN1(tagCCCPKCS15, []byte{c.PKCS15})...)
+	b = append(b, marshalASN1(tagCCCDataModelNumber, []byte{c.DataModelNumber})...)
+	b = append(b, marshalASN1(tagCCCAccessControlRuleTable, c.AccessControlRuleTable)...)
+	for _, tag := range []byte{
+		tagCCCCardAPDUs,
+		tagCCCRedirectionTag,
+		tagCCCCapabilityTuples,
+		tagCCCStatusTuples,
+		tagCCCNextCCC,
+	} {
+		b = append(b, marshalASN1(tag, nil)...)
+	}
+	if len(c.ExtendedApplicationCardURL) > 0 {
+		b = append(b, marshalASN1(tagCCCExtendedApplicationCardURL, c.ExtendedApplicationCardURL)...)
+	}
+	if len(c.SecurityObjectBuffer) > 0 {
+		b = append(b, marshalASN1(tagCCCSecurityObjectBuffer, c.SecurityObjectBuffer)...)
+	}
+	return append(b, marshalASN1(tagErrorDetectionCode, nil)...), nil
+}
+
+// CCC reads the Card Capability Container from the card.
+//
+// If the card has no CCC, the returned error wraps ErrNotFound.
+func (yk *YubiKey) CCC() (*CCC, error) {
+	var b []byte
+	err := yk.with("CCC", func(tx *scTx) (err error) {
+		b, err = ykGetData(tx, ObjectCardCapabilityContainer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseCCC(b)
+}
+
+// SetCCC stores the Card Capability Container on the card, which requires
+// authenticating with the management key.
+func (yk *YubiKey) SetCCC(key []byte, c *CCC) error {
+	b, err := c.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding ccc: %w", err)
+	}
+	return yk.with("SetCCC", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykPutData(tx, ObjectCardCapabilityContainer, b)
+	})
+}
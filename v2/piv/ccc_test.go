@@ -0,0 +1,82 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestParseCCC(t *testing.T) {
+	// The CCC written by ykman's "piv objects generate ccc".
+	b, err := hex.DecodeString("f015a000000116ff02b91f7c4ee10c39c68a85fb3a39a4" +
+		"f10121f20121f300f40100f50110f600f700fa00fb00fc00fd00fe00")
+	if err != nil {
+		t.Fatalf("decoding ccc: %v", err)
+	}
+	c, err := ParseCCC(b)
+	if err != nil {
+		t.Fatalf("parsing ccc: %v", err)
+	}
+	if got, want := hex.EncodeToString(c.CardIdentifier), "a000000116ff02b91f7c4ee10c39c68a85fb3a39a4"; got != want {
+		t.Errorf("card identifier got=%s, want=%s", got, want)
+	}
+	if c.CapabilityContainerVersion != 0x21 || c.CapabilityGrammarVersion != 0x21 {
+		t.Errorf("versions got=0x%x,0x%x, want=0x21,0x21", c.CapabilityContainerVersion, c.CapabilityGrammarVersion)
+	}
+	if c.DataModelNumber != 0x10 {
+		t.Errorf("data model number got=0x%x, want=0x10", c.DataModelNumber)
+	}
+	got, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling ccc: %v", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Errorf("marshaled ccc got=%x, want=%x", got, b)
+	}
+
+	if _, err := ParseCCC(b[23:]); err == nil {
+		t.Errorf("expected parsing ccc without card identifier to fail")
+	}
+}
+
+func TestYubiKeyCCC(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+
+	if _, err := yk.CCC(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting ccc after reset returned %v, want ErrNotFound", err)
+	}
+	want, err := NewCCC(rand.Reader)
+	if err != nil {
+		t.Fatalf("creating ccc: %v", err)
+	}
+	if err := yk.SetCCC(DefaultManagementKey, want); err != nil {
+		t.Fatalf("setting ccc: %v", err)
+	}
+	got, err := yk.CCC()
+	if err != nil {
+		t.Fatalf("getting ccc: %v", err)
+	}
+	if !bytes.Equal(got.CardIdentifier, want.CardIdentifier) || got.DataModelNumber != want.DataModelNumber {
+		t.Errorf("ccc got=%+v, want=%+v", got, want)
+	}
+}
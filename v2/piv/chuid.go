@@ -0,0 +1,244 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// CHUID is the Card Holder Unique Identifier data object, which identifies the
+// card to physical and logical access control systems.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=42
+type CHUID struct {
+	// FASCN is the 25 byte Federal Agency Smart Credential Number, encoded as
+	// specified by the Technical Implementation Guidance: Smart Card Enabled
+	// Physical Access Control Systems.
+	FASCN []byte
+	// OrganizationalIdentifier optionally identifies the issuing
+	// organization, using 4 bytes.
+	OrganizationalIdentifier []byte
+	// DUNS is the optional 9 byte Data Universal Numbering System number of
+	// the issuer.
+	DUNS []byte
+	// GUID is the 16 byte Global Unique Identifier of the card.
+	GUID []byte
+	// Expiration is the date the CHUID expires. Only the date is stored.
+	Expiration time.Time
+	// CardholderUUID optionally identifies the cardholder, using 16 bytes.
+	CardholderUUID []byte
+	// Signature is the issuer asymmetric signature, a CMS SignedData
+	// structure. It's empty for unsigned CHUIDs. See Sign and Verify.
+	Signature []byte
+
+	// signed holds the signed content of a CHUID read from a card, to verify
+	// its signature as stored.
+	signed []byte
+}
+
+// CHUID tags.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=42
+const (
+	tagCHUIDFASCN          = 0x30
+	tagCHUIDOrgIdentifier  = 0x32
+	tagCHUIDDUNS           = 0x33
+	tagCHUIDGUID           = 0x34
+	tagCHUIDExpiration     = 0x35
+	tagCHUIDCardholderUUID = 0x36
+	tagCHUIDSignature      = 0x3e
+
+	// chuidDateFormat is the format of the expiration date, YYYYMMDD.
+	chuidDateFormat = "20060102"
+)
+
+// oidCHUIDSecurityObject is the content type of CHUID signatures.
+var oidCHUIDSecurityObject = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 6, 1}
+
+// ParseCHUID decodes a CHUID, as stored in the ObjectCHUID data object.
+func ParseCHUID(b []byte) (*CHUID, error) {
+	elems, err := parseObjectElements(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing chuid: %v", err)
+	}
+	c := &CHUID{}
+	for _, e := range elems {
+		switch e.tag {
+		case tagCHUIDFASCN:
+			c.FASCN = e.value
+		case tagCHUIDOrgIdentifier:
+			c.OrganizationalIdentifier = e.value
+		case tagCHUIDDUNS:
+			c.DUNS = e.value
+		case tagCHUIDGUID:
+			c.GUID = e.value
+		case tagCHUIDExpiration:
+			t, err := time.Parse(chuidDateFormat, string(e.value))
+			if err != nil {
+				return nil, fmt.Errorf("parsing expiration date: %v", err)
+			}
+			c.Expiration = t
+		case tagCHUIDCardholderUUID:
+			c.CardholderUUID = e.value
+		case tagCHUIDSignature:
+			c.Signature = e.value
+			// The signature covers all preceding elements.
+			c.signed = b[:e.offset]
+		default:
+			// Ignore the buffer length, error detection code, and deprecated
+			// or unknown elements.
+		}
+	}
+	if len(c.FASCN) == 0 || len(c.GUID) == 0 || c.Expiration.IsZero() {
+		return nil, errors.New("chuid missing fasc-n, guid or expiration date")
+	}
+	return c, nil
+}
+
+// content encodes the elements of the CHUID covered by its signature.
+func (c *CHUID) content() ([]byte, error) {
+	for _, f := range []struct {
+		name     string
+		value    []byte
+		size     int
+		optional bool
+	}{
+		{"fasc-n", c.FASCN, 25, false},
+		{"organizational identifier", c.OrganizationalIdentifier, 4, true},
+		{"duns", c.DUNS, 9, true},
+		{"guid", c.GUID, 16, false},
+		{"cardholder uuid", c.CardholderUUID, 16, true},
+	} {
+		if len(f.value) == 0 && f.optional {
+			continue
+		}
+		if len(f.value) != f.size {
+			return nil, fmt.Errorf("invalid %s length: %d bytes (expected %d)", f.name, len(f.value), f.size)
+		}
+	}
+	if c.Expiration.IsZero() {
+		return nil, errors.New("chuid missing expiration date")
+	}
+
+	b := marshalASN1(tagCHUIDFASCN, c.FASCN)
+	if len(c.OrganizationalIdentifier) > 0 {
+		b = append(b, marshalASN1(tagCHUIDOrgIdentifier, c.OrganizationalIdentifier)...)
+	}
+	if len(c.DUNS) > 0 {
+		b = append(b, marshalASN1(tagCHUIDDUNS, c.DUNS)...)
+	}
+	b = append(b, marshalASN1(tagCHUIDGUID, c.GUID)...)
+	b = append(b, marshalASN1(tagCHUIDExpiration, []byte(c.Expiration.Format(chuidDateFormat)))...)
+	if len(c.CardholderUUID) > 0 {
+		b = append(b, marshalASN1(tagCHUIDCardholderUUID, c.CardholderUUID)...)
+	}
+	return b, nil
+}
+
+// Marshal encodes the CHUID, to be stored in the ObjectCHUID data object.
+func (c *CHUID) Marshal() ([]byte, error) {
+	b, err := c.content()
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, marshalASN1(tagCHUIDSignature, c.Signature)...)
+	return append(b, marshalASN1(tagErrorDetectionCode, nil)...), nil
+}
+
+// Sign sets the issuer asymmetric signature of the CHUID, signing its current
+// contents with key, the private key of the content signing certificate cert.
+// RSA, P-256 and P-384 keys are supported, including keys held by a YubiKey.
+func (c *CHUID) Sign(rand io.Reader, cert *x509.Certificate, key crypto.Signer) error {
+	content, err := c.content()
+	if err != nil {
+		return err
+	}
+	sig, err := cmsSign(rand, content, oidCHUIDSecurityObject, cert, key)
+	if err != nil {
+		return fmt.Errorf("signing chuid: %w", err)
+	}
+	c.Signature = sig
+	c.signed = nil
+	return nil
+}
+
+// Verify checks the issuer asymmetric signature of the CHUID against the
+// content signing certificate cert. It doesn't verify the certificate itself,
+// which callers should verify against their trusted roots. The certificate is
+// usually included in the signature, see SignerCertificate.
+//
+// For a CHUID read from a card, the signature is checked against the CHUID as
+// stored on the card.
+func (c *CHUID) Verify(cert *x509.Certificate) error {
+	if len(c.Signature) == 0 {
+		return errors.New("chuid isn't signed")
+	}
+	content := c.signed
+	if content == nil {
+		var err error
+		if content, err = c.content(); err != nil {
+			return err
+		}
+	}
+	if err := cmsVerify(c.Signature, content, oidCHUIDSecurityObject, cert); err != nil {
+		return fmt.Errorf("verifying chuid signature: %w", err)
+	}
+	return nil
+}
+
+// SignerCertificate returns the content signing certificate included in the
+// issuer asymmetric signature.
+func (c *CHUID) SignerCertificate() (*x509.Certificate, error) {
+	if len(c.Signature) == 0 {
+		return nil, errors.New("chuid isn't signed")
+	}
+	return cmsCertificate(c.Signature)
+}
+
+// CHUID reads the Card Holder Unique Identifier from the card.
+//
+// If the card has no CHUID, the returned error wraps ErrNotFound.
+func (yk *YubiKey) CHUID() (*CHUID, error) {
+	var b []byte
+	err := yk.with("CHUID", func(tx *scTx) (err error) {
+		b, err = ykGetData(tx, ObjectCHUID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseCHUID(b)
+}
+
+// SetCHUID stores the Card Holder Unique Identifier on the card, which
+// requires authenticating with the management key.
+func (yk *YubiKey) SetCHUID(key []byte, c *CHUID) error {
+	b, err := c.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding chuid: %w", err)
+	}
+	return yk.with("SetCHUID", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykPutData(tx, ObjectCHUID, b)
+	})
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCHUID is the CHUID written by ykman's "piv objects generate chuid".
+const testCHUID = "3019d4e739da739ced39ce739d836858210842108421c84210c3eb" +
+	"3410000102030405060708090a0b0c0d0e0f" +
+	"350832303330303130313e00fe00"
+
+func newTestCHUID(t *testing.T) *CHUID {
+	t.Helper()
+	c := &CHUID{
+		FASCN:      make([]byte, 25),
+		GUID:       make([]byte, 16),
+		Expiration: time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if _, err := rand.Read(c.FASCN); err != nil {
+		t.Fatalf("generating fasc-n: %v", err)
+	}
+	if _, err := rand.Read(c.GUID); err != nil {
+		t.Fatalf("generating guid: %v", err)
+	}
+	return c
+}
+
+// newTestSigner creates a self-signed content signing certificate for the key.
+func newTestSigner(t *testing.T, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "content signer"},
+		SerialNumber: big.NewInt(100),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	return cert
+}
+
+func TestParseCHUID(t *testing.T) {
+	b, err := hex.DecodeString(testCHUID)
+	if err != nil {
+		t.Fatalf("decoding chuid: %v", err)
+	}
+	c, err := ParseCHUID(b)
+	if err != nil {
+		t.Fatalf("parsing chuid: %v", err)
+	}
+	if got, want := hex.EncodeToString(c.FASCN), "d4e739da739ced39ce739d836858210842108421c84210c3eb"; got != want {
+		t.Errorf("fasc-n got=%s, want=%s", got, want)
+	}
+	if got, want := hex.EncodeToString(c.GUID), "000102030405060708090a0b0c0d0e0f"; got != want {
+		t.Errorf("guid got=%s, want=%s", got, want)
+	}
+	if want := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC); !c.Expiration.Equal(want) {
+		t.Errorf("expiration got=%v, want=%v", c.Expiration, want)
+	}
+	if len(c.Signature) != 0 {
+		t.Errorf("expected unsigned chuid, got signature %x", c.Signature)
+	}
+	got, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling chuid: %v", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Errorf("marshaled chuid got=%x, want=%x", got, b)
+	}
+
+	if _, err := ParseCHUID(b[:27]); err == nil {
+		t.Errorf("expected parsing chuid without guid to fail")
+	}
+}
+
+func TestCHUIDMarshal(t *testing.T) {
+	c := newTestCHUID(t)
+	c.OrganizationalIdentifier = []byte{0x01, 0x02, 0x03, 0x04}
+	c.DUNS = bytes.Repeat([]byte{0x09}, 9)
+	c.CardholderUUID = bytes.Repeat([]byte{0x36}, 16)
+	b, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling chuid: %v", err)
+	}
+	got, err := ParseCHUID(b)
+	if err != nil {
+		t.Fatalf("parsing chuid: %v", err)
+	}
+	if !bytes.Equal(got.FASCN, c.FASCN) || !bytes.Equal(got.GUID, c.GUID) ||
+		!bytes.Equal(got.OrganizationalIdentifier, c.OrganizationalIdentifier) ||
+		!bytes.Equal(got.DUNS, c.DUNS) || !bytes.Equal(got.CardholderUUID, c.CardholderUUID) ||
+		!got.Expiration.Equal(c.Expiration) {
+		t.Errorf("round trip got=%+v, want=%+v", got, c)
+	}
+
+	c.GUID = c.GUID[:15]
+	if _, err := c.Marshal(); err == nil {
+		t.Errorf("expected marshaling chuid with short guid to fail")
+	}
+}
+
+func TestCHUIDSignature(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ec key: %v", err)
+	}
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ec key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating rsa key: %v", err)
+	}
+	tests := []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"EC256", ecKey},
+		{"EC384", ec384Key},
+		{"RSA2048", rsaKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert := newTestSigner(t, test.key)
+			c := newTestCHUID(t)
+			if err := c.Verify(cert); err == nil {
+				t.Errorf("expected verifying unsigned chuid to fail")
+			}
+			if err := c.Sign(rand.Reader, cert, test.key); err != nil {
+				t.Fatalf("signing chuid: %v", err)
+			}
+			if err := c.Verify(cert); err != nil {
+				t.Errorf("verifying chuid: %v", err)
+			}
+
+			b, err := c.Marshal()
+			if err != nil {
+				t.Fatalf("marshaling chuid: %v", err)
+			}
+			parsed, err := ParseCHUID(b)
+			if err != nil {
+				t.Fatalf("parsing chuid: %v", err)
+			}
+			signer, err := parsed.SignerCertificate()
+			if err != nil {
+				t.Fatalf("getting signer certificate: %v", err)
+			}
+			if !signer.Equal(cert) {
+				t.Errorf("signer certificate doesn't match signing certificate")
+			}
+			if err := parsed.Verify(signer); err != nil {
+				t.Errorf("verifying parsed chuid: %v", err)
+			}
+
+			parsed.GUID[0] ^= 0xff
+			b, err = parsed.Marshal()
+			if err != nil {
+				t.Fatalf("marshaling modified chuid: %v", err)
+			}
+			tampered, err := ParseCHUID(b)
+			if err != nil {
+				t.Fatalf("parsing modified chuid: %v", err)
+			}
+			if err := tampered.Verify(cert); err == nil {
+				t.Errorf("expected verifying modified chuid to fail")
+			}
+
+			other := newTestSigner(t, ecKey)
+			if test.key == crypto.Signer(ecKey) {
+				other = newTestSigner(t, rsaKey)
+			}
+			if err := c.Verify(other); err == nil {
+				t.Errorf("expected verifying chuid with wrong certificate to fail")
+			}
+		})
+	}
+}
+
+func TestYubiKeyCHUID(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+
+	if _, err := yk.CHUID(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting chuid after reset returned %v, want ErrNotFound", err)
+	}
+
+	// Sign the CHUID with a key held by the card.
+	pub, err := yk.GenerateKey(DefaultManagementKey, SlotCardAuthentication, Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	})
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	priv, err := yk.PrivateKey(SlotCardAuthentication, pub, KeyAuth{})
+	if err != nil {
+		t.Fatalf("getting private key: %v", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		t.Fatalf("private key is not a crypto.Signer")
+	}
+	cert := newTestSigner(t, signer)
+
+	want := newTestCHUID(t)
+	if err := want.Sign(rand.Reader, cert, signer); err != nil {
+		t.Fatalf("signing chuid: %v", err)
+	}
+	if err := yk.SetCHUID(DefaultManagementKey, want); err != nil {
+		t.Fatalf("setting chuid: %v", err)
+	}
+	got, err := yk.CHUID()
+	if err != nil {
+		t.Fatalf("getting chuid: %v", err)
+	}
+	if !bytes.Equal(got.FASCN, want.FASCN) || !bytes.Equal(got.GUID, want.GUID) {
+		t.Errorf("chuid got=%+v, want=%+v", got, want)
+	}
+	if err := got.Verify(cert); err != nil {
+		t.Errorf("verifying chuid: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Client configures how cards are found and opened. The zero value is ready
+// to use, and is what the package level functions, such as Open and Cards,
+// use.
+//
+// Different Clients can be used within the same process, for example to open
+// cards with different settings for different components:
+//
+//	c := &piv.Client{
+//		ShareMode: piv.ShareShared,
+//		Timeout:   10 * time.Second,
+//		Tracer:    piv.SlogTracer(logger),
+//	}
+//	yk, err := c.Open(card)
+//
+// A Client must not be modified while in use, but is otherwise safe for
+// concurrent use. Changes don't affect YubiKeys already opened.
+type Client struct {
+	// Rand is a cryptographic source of randomness used for card challenges.
+	//
+	// If nil, defaults to crypto.Rand.
+	Rand io.Reader
+
+	// Backend selects the PC/SC implementation used to access cards. It
+	// doesn't apply to OpenTransport.
+	Backend Backend
+
+	// ShareMode controls whether cards are opened exclusively. See
+	// OpenShared.
+	ShareMode ShareMode
+
+	// Tracer, if set, receives every APDU exchanged with the card.
+	Tracer Tracer
+
+	// Recorder, if set, records every APDU exchanged with the card, so the
+	// session can later be played back using a Replayer.
+	Recorder *Recorder
+
+	// Timeout bounds operations whose context has no deadline, including
+	// methods that don't take a context. The time spent waiting for other
+	// operations on the same YubiKey counts towards the timeout. Operations
+	// that time out return an error wrapping ErrCancelled and
+	// context.DeadlineExceeded.
+	//
+	// If zero, operations don't time out.
+	Timeout time.Duration
+
+	// MaxWaiting bounds the number of operations waiting for the card. See
+	// YubiKey.SetMaxWaiting.
+	//
+	// If zero, any number of operations may wait.
+	MaxWaiting int
+
+	// PINCache is how long a PIN returned by KeyAuth.PINPrompt is remembered
+	// and used for later operations requiring a PIN, instead of prompting
+	// again. This mainly benefits shared connections and keys with
+	// PINPolicyAlways, which otherwise prompt for every operation. A cached
+	// PIN is forgotten as soon as the card rejects it. A negative value caches
+	// the PIN until the YubiKey is closed.
+	//
+	// If zero, PINs aren't cached.
+	PINCache time.Duration
+
+	// ManagementKeyAlgorithm overrides the algorithm of the management key
+	// used to authenticate. YubiKeys from 5.3.0 report the algorithm, and
+	// older ones only support 3DES. Set this for cards that use a different
+	// algorithm but can't report it.
+	//
+	// If zero, the algorithm is determined automatically.
+	ManagementKeyAlgorithm ManagementKeyAlgorithm
+}
+
+// Backend is a PC/SC implementation used to access cards.
+type Backend int
+
+const (
+	// BackendDefault uses the system's PC/SC implementation: winscard on
+	// Windows, the PCSC framework on macOS, and libpcsclite on other systems
+	// when built with cgo. Otherwise, BackendPCSCLite is used.
+	BackendDefault Backend = iota
+	// BackendPCSCLite talks to the pcsc-lite daemon directly using a pure Go
+	// client, without linking against libpcsclite. It's only available on
+	// Linux, FreeBSD and OpenBSD.
+	BackendPCSCLite
+)
+
+// String returns the name of the backend.
+func (b Backend) String() string {
+	switch b {
+	case BackendDefault:
+		return "default"
+	case BackendPCSCLite:
+		return "pcsc-lite"
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// scBackend is a context of a PC/SC implementation.
+type scBackend interface {
+	scWatcher
+	Close() error
+	connect(reader string, shareMode uint32) (Transport, error)
+}
+
+// defaultBackend adapts the system's PC/SC implementation to scBackend.
+type defaultBackend struct {
+	*scContext
+}
+
+func (b defaultBackend) connect(reader string, shareMode uint32) (Transport, error) {
+	h, err := b.Connect(reader, shareMode)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (c *Client) backend() (scBackend, error) {
+	switch c.Backend {
+	case BackendDefault:
+		ctx, err := newSCContext()
+		if err != nil {
+			return nil, err
+		}
+		return defaultBackend{ctx}, nil
+	case BackendPCSCLite:
+		return newLiteBackend()
+	}
+	return nil, fmt.Errorf("unknown backend: %v", c.Backend)
+}
+
+// ShareMode controls whether other processes can use a card while it's open.
+type ShareMode int
+
+const (
+	// ShareExclusive holds the card for the lifetime of the connection.
+	ShareExclusive ShareMode = iota
+	// ShareShared allows other processes to use the card between operations.
+	// See OpenShared.
+	ShareShared
+)
+
+// ManagementKeyAlgorithm is the algorithm of a management key.
+type ManagementKeyAlgorithm int
+
+// Management key algorithms supported by YubiKeys. AES management keys
+// require firmware 5.4.0 or later.
+const (
+	ManagementKeyAlgorithm3DES ManagementKeyAlgorithm = iota + 1
+	ManagementKeyAlgorithmAES128
+	ManagementKeyAlgorithmAES192
+	ManagementKeyAlgorithmAES256
+)
+
+var managementKeyAlgorithmMap = map[ManagementKeyAlgorithm]byte{
+	ManagementKeyAlgorithm3DES:   alg3DES,
+	ManagementKeyAlgorithmAES128: algAES128,
+	ManagementKeyAlgorithmAES192: algAES192,
+	ManagementKeyAlgorithmAES256: algAES256,
+}
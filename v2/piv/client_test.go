@@ -0,0 +1,125 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testOpenResps are the responses of a YubiKey 5.7.1 to the commands sent
+// when it's opened.
+var testOpenResps = [][]byte{
+	{0x90, 0x00},                   // SELECT
+	{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+	testSerialResp,
+}
+
+func TestClientTimeout(t *testing.T) {
+	ft := &fakeTransport{resps: append(testOpenResps, testSerialResp)}
+	c := Client{Timeout: 10 * time.Millisecond}
+	yk, err := c.OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+	bt := &blockingTransport{fakeTransport: ft, release: make(chan struct{})}
+	yk.h = bt
+	yk.tx.t = bt
+
+	_, err = yk.Serial()
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected operation to time out, got: %v", err)
+	}
+	close(bt.release)
+}
+
+func TestClientPINCache(t *testing.T) {
+	ok := []byte{0x90, 0x00}
+	ft := &fakeTransport{
+		resps: append(testOpenResps,
+			ok,                 // VERIFY
+			ok,                 // VERIFY with cached PIN
+			[]byte{0x63, 0xc2}, // VERIFY with cached PIN, rejected
+			ok,                 // VERIFY
+		),
+	}
+	c := Client{PINCache: time.Hour}
+	yk, err := c.OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	prompts := 0
+	auth := KeyAuth{PINPrompt: func() (string, error) {
+		prompts++
+		return DefaultPIN, nil
+	}}
+	login := func() error {
+		return yk.with("Test", func(tx *scTx) error {
+			return auth.authTx(yk, tx, PINPolicyAlways)
+		})
+	}
+	if err := login(); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	if err := login(); err != nil {
+		t.Fatalf("verifying cached pin: %v", err)
+	}
+	if prompts != 1 {
+		t.Errorf("got %d pin prompts, want 1", prompts)
+	}
+	if err := login(); !errors.As(err, new(AuthErr)) {
+		t.Fatalf("expected rejected pin, got: %v", err)
+	}
+	if err := login(); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	if prompts != 2 {
+		t.Errorf("got %d pin prompts, want 2", prompts)
+	}
+}
+
+func TestClientManagementKeyAlgorithm(t *testing.T) {
+	ft := &fakeTransport{
+		resps: append(testOpenResps,
+			[]byte{0x6a, 0x80}, // GENERAL AUTHENTICATE
+		),
+	}
+	c := Client{ManagementKeyAlgorithm: ManagementKeyAlgorithmAES128}
+	yk, err := c.OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	if err := yk.authManagementKey(make([]byte, 16)); err == nil {
+		t.Fatalf("expected authentication to fail")
+	}
+	// The algorithm isn't queried from the card's metadata.
+	want := []byte{0x00, insAuthenticate, algAES128, keyCardManagement}
+	if got := ft.cmds[len(ft.cmds)-1]; !bytes.HasPrefix(got, want) {
+		t.Errorf("got command %x, want prefix %x", got, want)
+	}
+
+	c = Client{ManagementKeyAlgorithm: 42}
+	if _, err := c.OpenTransport(&fakeTransport{}); err == nil {
+		t.Errorf("expected error opening with invalid management key algorithm")
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+)
+
+// This file implements the subset of CMS SignedData (RFC 5652) used for the
+// signatures of PIV data objects: a detached signature by a single signer,
+// identified by issuer and serial number, with signed attributes.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=48
+// https://www.rfc-editor.org/rfc/rfc5652
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidPIVSignerDN   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 6, 5}
+
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+)
+
+// cmsContentInfo wraps the SignedData structure. Content is explicitly tagged
+// [0], which is encoded by hand since encoding/asn1 doesn't add the explicit
+// tag to a RawValue.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+// cmsEncapContentInfo identifies the signed content, which is omitted since
+// it's stored alongside the signature.
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// cmsAlgorithms returns the digest and signature algorithms used with the
+// public key of a content signing certificate.
+func cmsAlgorithms(pub crypto.PublicKey) (hash crypto.Hash, digestAlg, sigAlg pkix.AlgorithmIdentifier, err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return crypto.SHA256,
+			pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue},
+			nil
+	case *ecdsa.PublicKey:
+		switch size := pub.Params().BitSize; size {
+		case 256:
+			return crypto.SHA256,
+				pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+				pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+				nil
+		case 384:
+			return crypto.SHA384,
+				pkix.AlgorithmIdentifier{Algorithm: oidSHA384},
+				pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384},
+				nil
+		default:
+			err = unsupportedCurveError{curve: size}
+		}
+	default:
+		err = fmt.Errorf("unsupported content signing key: %T", pub)
+	}
+	return 0, pkix.AlgorithmIdentifier{}, pkix.AlgorithmIdentifier{}, err
+}
+
+// marshalAttribute encodes an attribute with a single value.
+func marshalAttribute(typ asn1.ObjectIdentifier, value interface{}) ([]byte, error) {
+	v, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsAttribute{
+		Type:   typ,
+		Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: v},
+	})
+}
+
+// cmsSign returns a detached CMS signature over content, of the given content
+// type. The signer's certificate is included in the signature.
+func cmsSign(rand io.Reader, content []byte, contentType asn1.ObjectIdentifier, cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	hash, digestAlg, sigAlg, err := cmsAlgorithms(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(content)
+
+	var attrs [][]byte
+	for _, a := range []struct {
+		typ   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, contentType},
+		{oidMessageDigest, h.Sum(nil)},
+		{oidPIVSignerDN, asn1.RawValue{FullBytes: cert.RawSubject}},
+	} {
+		b, err := marshalAttribute(a.typ, a.value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding signed attribute: %v", err)
+		}
+		attrs = append(attrs, b)
+	}
+	// DER requires the elements of a SET OF to be sorted.
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	signedAttrs := bytes.Join(attrs, nil)
+
+	// The signature covers the DER encoding of the attributes as a SET, rather
+	// than their implicitly tagged encoding in SignerInfo.
+	toSign, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signedAttrs})
+	if err != nil {
+		return nil, fmt.Errorf("encoding signed attributes: %v", err)
+	}
+	h = hash.New()
+	h.Write(toSign)
+	sig, err := key.Sign(rand, h.Sum(nil), hash)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	sd := cmsSignedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		EncapContentInfo: cmsEncapContentInfo{EContentType: contentType},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []cmsSignerInfo{{
+			Version: 1,
+			SID: cmsIssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:    digestAlg,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          sig,
+		}},
+	}
+	b, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("encoding signed data: %v", err)
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b},
+	})
+}
+
+func parseCMSSignedData(sig []byte) (*cmsSignedData, error) {
+	var ci cmsContentInfo
+	if rest, err := asn1.Unmarshal(sig, &ci); err != nil {
+		return nil, fmt.Errorf("parsing content info: %v", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after content info")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unexpected content type: %v", ci.ContentType)
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("parsing signed data: %v", err)
+	}
+	return &sd, nil
+}
+
+// cmsCertificate returns the first certificate included in a CMS signature.
+func cmsCertificate(sig []byte) (*x509.Certificate, error) {
+	sd, err := parseCMSSignedData(sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, errors.New("signature doesn't include a certificate")
+	}
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.Certificates.Bytes, &raw); err != nil {
+		return nil, fmt.Errorf("parsing certificates: %v", err)
+	}
+	return x509.ParseCertificate(raw.FullBytes)
+}
+
+// cmsVerify checks a detached CMS signature over content of the given content
+// type, made by the key of cert.
+func cmsVerify(sig, content []byte, contentType asn1.ObjectIdentifier, cert *x509.Certificate) error {
+	sd, err := parseCMSSignedData(sig)
+	if err != nil {
+		return err
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(contentType) {
+		return fmt.Errorf("unexpected signed content type: %v", sd.EncapContentInfo.EContentType)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return fmt.Errorf("expected one signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	if !bytes.Equal(si.SID.Issuer.FullBytes, cert.RawIssuer) || si.SID.SerialNumber == nil ||
+		si.SID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return errors.New("signer doesn't match certificate")
+	}
+
+	var hash crypto.Hash
+	switch alg := si.DigestAlgorithm.Algorithm; {
+	case alg.Equal(oidSHA256):
+		hash = crypto.SHA256
+	case alg.Equal(oidSHA384):
+		hash = crypto.SHA384
+	default:
+		return fmt.Errorf("unsupported digest algorithm: %v", alg)
+	}
+	var sigAlg x509.SignatureAlgorithm
+	switch alg := si.SignatureAlgorithm.Algorithm; {
+	case alg.Equal(oidRSAEncryption) && hash == crypto.SHA256, alg.Equal(oidSHA256WithRSA):
+		sigAlg = x509.SHA256WithRSA
+	case alg.Equal(oidRSAEncryption) && hash == crypto.SHA384, alg.Equal(oidSHA384WithRSA):
+		sigAlg = x509.SHA384WithRSA
+	case alg.Equal(oidECDSAWithSHA256):
+		sigAlg = x509.ECDSAWithSHA256
+	case alg.Equal(oidECDSAWithSHA384):
+		sigAlg = x509.ECDSAWithSHA384
+	default:
+		return fmt.Errorf("unsupported signature algorithm: %v", alg)
+	}
+
+	if len(si.SignedAttrs.FullBytes) == 0 {
+		return errors.New("signature has no signed attributes")
+	}
+	var gotType, gotDigest bool
+	for b := si.SignedAttrs.Bytes; len(b) > 0; {
+		var a cmsAttribute
+		rest, err := asn1.Unmarshal(b, &a)
+		if err != nil {
+			return fmt.Errorf("parsing signed attribute: %v", err)
+		}
+		b = rest
+		switch {
+		case a.Type.Equal(oidContentType):
+			var typ asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &typ); err != nil {
+				return fmt.Errorf("parsing content type: %v", err)
+			}
+			if !typ.Equal(contentType) {
+				return fmt.Errorf("unexpected content type attribute: %v", typ)
+			}
+			gotType = true
+		case a.Type.Equal(oidMessageDigest):
+			var digest []byte
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &digest); err != nil {
+				return fmt.Errorf("parsing message digest: %v", err)
+			}
+			h := hash.New()
+			h.Write(content)
+			if !bytes.Equal(digest, h.Sum(nil)) {
+				return errors.New("message digest doesn't match content")
+			}
+			gotDigest = true
+		}
+	}
+	if !gotType || !gotDigest {
+		return errors.New("signature is missing content type or message digest")
+	}
+
+	// The attributes are signed as a SET, rather than implicitly tagged.
+	signed := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	if err := cert.CheckSignature(sigAlg, signed, si.Signature); err != nil {
+		return fmt.Errorf("verifying signature: %w", err)
+	}
+	return nil
+}
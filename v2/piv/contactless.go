@@ -0,0 +1,86 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// ErrContactlessRestricted is returned when a card refuses an operation over
+// the contactless interface. PIV cards only permit operations such as PIN
+// verification, key generation and signing with most slots over contactless
+// readers when using secure messaging, which this package doesn't implement.
+// Use a contact reader or the card's USB interface instead.
+//
+// YubiKeys permit all operations over NFC, so their errors never wrap
+// ErrContactlessRestricted.
+var ErrContactlessRestricted = errors.New("operation not permitted over the contactless interface")
+
+// contactlessAPDUDataSize is the size of command chaining chunks sent to
+// contactless cards, which keeps frames within the buffers of common NFC
+// readers.
+const contactlessAPDUDataSize = 0x80
+
+// contactlessRestricted reports if PIV restricts a command with the given key
+// reference over the contactless interface without secure messaging. Only the
+// card authentication key may be used.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=34
+func contactlessRestricted(ins, key byte) bool {
+	switch ins {
+	case insVerify, insChangeReference, insResetRetry, insGenerateAsymmetric,
+		insPutData, insSetMGMKey, insImportKey:
+		return true
+	case insAuthenticate:
+		return key != keyCardAuthentication
+	}
+	return false
+}
+
+// readerContactless guesses if a reader uses the contactless interface from
+// its name. It's only a fallback for readers that don't construct a
+// contactless ATR, which is what identifies contactless cards otherwise.
+//
+// Names are matched by whole words, such as "PICC" in "ACS ACR122U PICC
+// Interface" or "CL" in "OMNIKEY CardMan 5x21-CL", so model numbers that merely
+// contain these letters don't match.
+func readerContactless(name string) bool {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		switch w {
+		case "contactless", "picc", "nfc", "cl":
+			return true
+		}
+	}
+	return false
+}
+
+// Contactless reports if the card is accessed through a contactless (NFC)
+// reader, as indicated by the card's ATR. For cards opened by reader name, the
+// name is used as a fallback for readers that don't construct a contactless
+// ATR.
+//
+// Over the contactless interface, commands are sent in smaller chunks, and the
+// card may refuse operations that PIV restricts to the contact interface, in
+// which case errors wrap ErrContactlessRestricted. YubiKeys don't restrict
+// operations over NFC, and tapping the key on the reader satisfies the touch
+// policy of a key.
+func (yk *YubiKey) Contactless() bool {
+	return yk.contactless
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReaderContactless(t *testing.T) {
+	tests := []struct {
+		reader string
+		want   bool
+	}{
+		{"Yubico YubiKey OTP+FIDO+CCID 00 00", false},
+		{"ACS ACR122U PICC Interface 00 00", true},
+		{"OMNIKEY CardMan 5x21-CL 0", true},
+		{"Identiv uTrust 3700 F CL Reader 0", true},
+		{"SCM Microsystems Inc. SCR 3310 [CCID Interface] 00 00", false},
+		{"ACS ACR1252 Dual Reader [ACR1252 Dual Reader PICC] 00 00", true},
+		{"Identiv SCL3711-NFC&RW 00 00", true},
+		{"Example XX-CL3000 Contact Reader 00 00", false},
+		{"Example CLX Reader 00 00", false},
+		{"Example Reader CL2 0", false},
+		{"Gemalto PC Twin Reader (PICCOLO) 00 00", false},
+		{"Vendor NFCReader 0", false},
+	}
+	for _, test := range tests {
+		if got := readerContactless(test.reader); got != test.want {
+			t.Errorf("readerContactless(%q) = %t, want %t", test.reader, got, test.want)
+		}
+	}
+}
+
+func TestTransmitContactless(t *testing.T) {
+	data := make([]byte, 300)
+	ft := &fakeATRTransport{
+		fakeTransport: &fakeTransport{
+			resps: [][]byte{
+				{0x90, 0x00},                   // SELECT
+				{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+				testSerialResp,
+				{0x90, 0x00},
+				{0x90, 0x00},
+				{0x90, 0x00},
+				{0x69, 0x82},
+			},
+		},
+		atr: testYubiKeyNFCATR,
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	if !yk.Contactless() {
+		t.Fatalf("expected yubikey to be contactless")
+	}
+	if _, err := yk.Transmit(Command{Instruction: insPutData, Param1: 0x3f, Param2: 0xff, Data: data}); err != nil {
+		t.Fatalf("transmit: %v", err)
+	}
+	// The data is chained in small chunks, even though the card supports
+	// extended length commands.
+	for i, n := range []byte{0x80, 0x80, 0x2c} {
+		if got := ft.cmds[3+i][4]; got != n {
+			t.Errorf("command %d length got=0x%02x, want=0x%02x", i, got, n)
+		}
+	}
+
+	// YubiKeys don't restrict operations over NFC.
+	err = yk.VerifyPIN(DefaultPIN)
+	if errors.Is(err, ErrContactlessRestricted) || !errors.Is(err, ErrSecurityStatusNotSatisfied) {
+		t.Errorf("verify pin: got err=%v, want ErrSecurityStatusNotSatisfied", err)
+	}
+}
+
+func TestContactlessRestricted(t *testing.T) {
+	ft := &fakeATRTransport{
+		fakeTransport: &fakeTransport{
+			resps: [][]byte{
+				{0x90, 0x00},                   // SELECT
+				{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+				testSerialResp,
+				{0x69, 0x82},
+				{0x69, 0x82},
+			},
+		},
+		// A contactless card that isn't a YubiKey.
+		atr: []byte{0x3b, 0x85, 0x80, 0x01, 0x80, 0x73, 0xc0, 0x21, 0x80},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	err = yk.VerifyPIN(DefaultPIN)
+	if !errors.Is(err, ErrContactlessRestricted) || !errors.Is(err, ErrSecurityStatusNotSatisfied) {
+		t.Errorf("verify pin: got err=%v, want ErrContactlessRestricted", err)
+	}
+	// The card authentication key may be used over the contactless interface.
+	_, err = yk.Transmit(Command{Instruction: insAuthenticate, Param1: algECCP256, Param2: keyCardAuthentication})
+	if errors.Is(err, ErrContactlessRestricted) || !errors.Is(err, ErrSecurityStatusNotSatisfied) {
+		t.Errorf("card authentication: got err=%v, want ErrSecurityStatusNotSatisfied", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"encoding/asn1"
+	"fmt"
+)
+
+// Data objects defined by NIST 800-73-4, Part 1, section 3.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=30
+//
+// Certificates of the retired key management slots are stored in the objects
+// 0x5fc10d through 0x5fc120, see RetiredKeyManagementSlot.
+const (
+	ObjectCardCapabilityContainer      = 0x5fc107
+	ObjectCHUID                        = 0x5fc102
+	ObjectCertAuthentication           = 0x5fc105
+	ObjectFingerprints                 = 0x5fc103
+	ObjectSecurityObject               = 0x5fc106
+	ObjectFacialImage                  = 0x5fc108
+	ObjectPrintedInformation           = 0x5fc109
+	ObjectCertSignature                = 0x5fc10a
+	ObjectCertKeyManagement            = 0x5fc10b
+	ObjectCertCardAuthentication       = 0x5fc101
+	ObjectDiscovery                    = 0x7e
+	ObjectKeyHistory                   = 0x5fc10c
+	ObjectIrisImages                   = 0x5fc121
+	ObjectBiometricInformationTemplate = 0x7f61
+	ObjectSecureMessagingCertSigner    = 0x5fc122
+	ObjectPairingCodeReferenceData     = 0x5fc123
+
+	// Objects specific to YubiKeys, which use the range 0x5fff00 through
+	// 0x5fffff.
+	//
+	// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html
+	ObjectYubicoAdminData   = 0x5fff00
+	ObjectYubicoAttestation = 0x5fff01
+)
+
+// GetData reads a data object from the card, returning its value without the
+// enclosing 0x53 tag. The Discovery and Biometric Information Templates Group
+// Template objects are returned without their own tags, 0x7e and 0x7f61.
+//
+// Some objects, such as ObjectPrintedInformation, can only be read after
+// verifying the PIN. On exclusive connections, VerifyPIN can be called first.
+//
+// If the object doesn't exist, the returned error wraps ErrNotFound.
+func (yk *YubiKey) GetData(tag uint32) ([]byte, error) {
+	var value []byte
+	err := yk.with("GetData", func(tx *scTx) (err error) {
+		value, err = ykGetData(tx, tag)
+		return err
+	})
+	return value, err
+}
+
+// PutData writes a data object to the card, which requires authenticating with
+// the management key. The value is wrapped in the 0x53 tag, or the object's
+// own tag for the Discovery and Biometric Information Templates Group Template
+// objects. An empty value deletes the object.
+func (yk *YubiKey) PutData(key []byte, tag uint32, value []byte) error {
+	return yk.with("PutData", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykPutData(tx, tag, value)
+	})
+}
+
+// marshalObjectTag encodes the tag of a data object, which is one to three
+// bytes long.
+func marshalObjectTag(tag uint32) ([]byte, error) {
+	switch {
+	case tag == 0 || tag > 0xffffff:
+		return nil, fmt.Errorf("invalid data object tag: 0x%x", tag)
+	case tag > 0xffff:
+		return []byte{byte(tag >> 16), byte(tag >> 8), byte(tag)}, nil
+	case tag > 0xff:
+		return []byte{byte(tag >> 8), byte(tag)}, nil
+	}
+	return []byte{byte(tag)}, nil
+}
+
+// isTemplateObject reports whether an object is read and written under its
+// own tag, instead of 0x53.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=94
+func isTemplateObject(tag uint32) bool {
+	return tag == ObjectDiscovery || tag == ObjectBiometricInformationTemplate
+}
+
+// tagErrorDetectionCode is the last element of most data objects. It's always
+// empty.
+const tagErrorDetectionCode = 0xfe
+
+// objectElement is an element of a data object, such as the FASC-N of a CHUID.
+type objectElement struct {
+	tag   byte
+	value []byte
+	// offset is the position of the element within the data object.
+	offset int
+}
+
+// parseObjectElements splits a data object into its elements. The elements of
+// the data objects defined by NIST 800-73-4 all use single byte tags.
+func parseObjectElements(b []byte) ([]objectElement, error) {
+	var elems []objectElement
+	for data := b; len(data) > 0; {
+		var v asn1.RawValue
+		rest, err := asn1.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+		if v.FullBytes[0]&0x1f == 0x1f {
+			return nil, fmt.Errorf("unsupported multi-byte tag at offset %d", len(b)-len(data))
+		}
+		elems = append(elems, objectElement{
+			tag:    v.FullBytes[0],
+			value:  v.Bytes,
+			offset: len(b) - len(data),
+		})
+		data = rest
+	}
+	return elems, nil
+}
+
+func ykGetData(tx *scTx, tag uint32) ([]byte, error) {
+	t, err := marshalObjectTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	cmd := apdu{
+		instruction: insGetData,
+		param1:      0x3f,
+		param2:      0xff,
+		data:        append([]byte{0x5c, byte(len(t))}, t...), // Tag list
+	}
+	resp, err := tx.Transmit(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=85
+	class, respTag := 1, 0x13 // tag 0x53
+	switch tag {
+	case ObjectDiscovery:
+		respTag = 0x1e // tag 0x7e
+	case ObjectBiometricInformationTemplate:
+		respTag = 0x61 // tag 0x7f61
+	}
+	obj, _, err := unmarshalASN1(resp, class, respTag)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling response: %v", err)
+	}
+	return obj, nil
+}
+
+func ykPutData(tx *scTx, tag uint32, value []byte) error {
+	t, err := marshalObjectTag(tag)
+	if err != nil {
+		return err
+	}
+	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=94
+	var data []byte
+	if isTemplateObject(tag) {
+		data = append(t, marshalASN1Length(uint64(len(value)))...)
+		data = append(data, value...)
+	} else {
+		data = append([]byte{0x5c, byte(len(t))}, t...) // Tag list
+		data = append(data, marshalASN1(0x53, value)...)
+	}
+	cmd := apdu{
+		instruction: insPutData,
+		param1:      0x3f,
+		param2:      0xff,
+		data:        data,
+	}
+	if _, err := tx.Transmit(cmd); err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return nil
+}
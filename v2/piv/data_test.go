@@ -0,0 +1,91 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMarshalObjectTag(t *testing.T) {
+	tests := []struct {
+		tag     uint32
+		want    []byte
+		wantErr bool
+	}{
+		{tag: ObjectDiscovery, want: []byte{0x7e}},
+		{tag: ObjectBiometricInformationTemplate, want: []byte{0x7f, 0x61}},
+		{tag: ObjectCHUID, want: []byte{0x5f, 0xc1, 0x02}},
+		{tag: 0x5fff10, want: []byte{0x5f, 0xff, 0x10}},
+		{tag: 0, wantErr: true},
+		{tag: 0x01000000, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := marshalObjectTag(test.tag)
+		if (err != nil) != test.wantErr {
+			t.Errorf("marshalObjectTag(0x%x) returned error %v, want error %t", test.tag, err, test.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("marshalObjectTag(0x%x) got=%x, want=%x", test.tag, got, test.want)
+		}
+	}
+}
+
+func TestYubiKeyData(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+
+	for _, tag := range []uint32{ObjectCHUID, 0x5fff10} {
+		if _, err := yk.GetData(tag); !errors.Is(err, ErrNotFound) {
+			t.Errorf("getting empty object 0x%x returned %v, want ErrNotFound", tag, err)
+		}
+		value := bytes.Repeat([]byte{0x42}, 300)
+		if err := yk.PutData(DefaultManagementKey, tag, value); err != nil {
+			t.Fatalf("putting object 0x%x: %v", tag, err)
+		}
+		got, err := yk.GetData(tag)
+		if err != nil {
+			t.Fatalf("getting object 0x%x: %v", tag, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("object 0x%x got=%x, want=%x", tag, got, value)
+		}
+		if err := yk.PutData(DefaultManagementKey, tag, nil); err != nil {
+			t.Fatalf("deleting object 0x%x: %v", tag, err)
+		}
+		if _, err := yk.GetData(tag); !errors.Is(err, ErrNotFound) {
+			t.Errorf("getting deleted object 0x%x returned %v, want ErrNotFound", tag, err)
+		}
+	}
+
+	discovery, err := yk.GetData(ObjectDiscovery)
+	if err != nil {
+		t.Fatalf("getting discovery object: %v", err)
+	}
+	// Starts with the PIV application identifier.
+	if want := append([]byte{0x4f, 0x0b}, aidPIV[:]...); !bytes.HasPrefix(discovery, want) {
+		t.Errorf("discovery object got=%x, want prefix %x", discovery, want)
+	}
+
+	badKey := make([]byte, len(DefaultManagementKey))
+	if err := yk.PutData(badKey, ObjectCHUID, []byte{0x01}); err == nil {
+		t.Errorf("putting object with the wrong management key succeeded")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Discovery is the Discovery data object, which tells middleware which
+// application the card holds and which PINs it can use.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=46
+type Discovery struct {
+	// AID is the application identifier of the PIV Card Application,
+	// including its version. If empty, the PIV AID of NIST 800-73-4 is used.
+	AID []byte
+	// ApplicationPIN indicates the PIV Card Application PIN satisfies the
+	// access control rules of the PIV Card Application.
+	ApplicationPIN bool
+	// GlobalPIN indicates the Global PIN satisfies the access control rules
+	// of the PIV Card Application.
+	GlobalPIN bool
+	// OCC indicates the card supports on-card biometric comparison.
+	OCC bool
+	// GlobalPINPrimary indicates the Global PIN is the cardholder's primary
+	// PIN, rather than the PIV Card Application PIN. It's only meaningful for
+	// cards supporting both PINs.
+	GlobalPINPrimary bool
+
+	// otherPolicy holds the bits of the PIN usage policy not represented
+	// above, such as the virtual contact interface bits, so they're preserved
+	// when updating a parsed object.
+	otherPolicy byte
+}
+
+// aidPIVApplication is the full application identifier of the PIV Card
+// Application, including its version.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=25
+var aidPIVApplication = []byte{0xa0, 0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x10, 0x00, 0x01, 0x00}
+
+// PIN usage policy bits.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=46
+const (
+	pinPolicyApplicationPIN = 0x40
+	pinPolicyGlobalPIN      = 0x20
+	pinPolicyOCC            = 0x10
+
+	pinPreferenceApplicationPIN = 0x10
+	pinPreferenceGlobalPIN      = 0x20
+)
+
+// ParseDiscovery decodes a Discovery object, as stored in the ObjectDiscovery
+// data object, without its 0x7e tag.
+func ParseDiscovery(b []byte) (*Discovery, error) {
+	aid, rest, err := unmarshalASN1(b, 1, 0x0f) // tag 0x4f
+	if err != nil {
+		return nil, fmt.Errorf("parsing application identifier: %v", err)
+	}
+	policy, _, err := unmarshalASN1(rest, 1, 0x2f) // tag 0x5f2f
+	if err != nil {
+		return nil, fmt.Errorf("parsing pin usage policy: %v", err)
+	}
+	if len(policy) != 2 {
+		return nil, fmt.Errorf("invalid pin usage policy length: %d", len(policy))
+	}
+	return &Discovery{
+		AID:              aid,
+		ApplicationPIN:   policy[0]&pinPolicyApplicationPIN != 0,
+		GlobalPIN:        policy[0]&pinPolicyGlobalPIN != 0,
+		OCC:              policy[0]&pinPolicyOCC != 0,
+		GlobalPINPrimary: policy[1] == pinPreferenceGlobalPIN,
+		otherPolicy:      policy[0] &^ (pinPolicyApplicationPIN | pinPolicyGlobalPIN | pinPolicyOCC),
+	}, nil
+}
+
+// Marshal encodes the Discovery object, to be stored in the ObjectDiscovery
+// data object.
+func (d *Discovery) Marshal() ([]byte, error) {
+	if !d.ApplicationPIN && !d.GlobalPIN {
+		return nil, errors.New("discovery object must allow the application pin or global pin")
+	}
+	if d.GlobalPINPrimary && !d.GlobalPIN {
+		return nil, errors.New("global pin can't be primary without being allowed")
+	}
+	aid := d.AID
+	if len(aid) == 0 {
+		aid = aidPIVApplication
+	}
+
+	policy := []byte{d.otherPolicy, 0x00}
+	if d.ApplicationPIN {
+		policy[0] |= pinPolicyApplicationPIN
+	}
+	if d.GlobalPIN {
+		policy[0] |= pinPolicyGlobalPIN
+	}
+	if d.OCC {
+		policy[0] |= pinPolicyOCC
+	}
+	// The PIN preference is only set for cards supporting both PINs.
+	if d.ApplicationPIN && d.GlobalPIN {
+		policy[1] = pinPreferenceApplicationPIN
+		if d.GlobalPINPrimary {
+			policy[1] = pinPreferenceGlobalPIN
+		}
+	}
+
+	b := marshalASN1(0x4f, aid)
+	b = append(b, 0x5f, 0x2f)
+	b = append(b, marshalASN1Length(uint64(len(policy)))...)
+	return append(b, policy...), nil
+}
+
+// Discovery reads the Discovery object from the card.
+func (yk *YubiKey) Discovery() (*Discovery, error) {
+	var b []byte
+	err := yk.with("Discovery", func(tx *scTx) (err error) {
+		b, err = ykGetData(tx, ObjectDiscovery)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseDiscovery(b)
+}
+
+// SetDiscovery stores the Discovery object on the card, which requires
+// authenticating with the management key. Cards that generate the Discovery
+// object themselves may reject the update.
+func (yk *YubiKey) SetDiscovery(key []byte, d *Discovery) error {
+	b, err := d.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding discovery object: %w", err)
+	}
+	return yk.with("SetDiscovery", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykPutData(tx, ObjectDiscovery, b)
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoveryMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       Discovery
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "ApplicationPIN",
+			d:    Discovery{ApplicationPIN: true},
+			want: "4f0ba0000003080000100001005f2f024000",
+		},
+		{
+			name: "GlobalPINPrimary",
+			d:    Discovery{ApplicationPIN: true, GlobalPIN: true, GlobalPINPrimary: true},
+			want: "4f0ba0000003080000100001005f2f026020",
+		},
+		{
+			name: "OCC",
+			d:    Discovery{ApplicationPIN: true, GlobalPIN: true, OCC: true},
+			want: "4f0ba0000003080000100001005f2f027010",
+		},
+		{
+			name:    "NoPIN",
+			d:       Discovery{OCC: true},
+			wantErr: true,
+		},
+		{
+			name:    "PrimaryWithoutGlobalPIN",
+			d:       Discovery{ApplicationPIN: true, GlobalPINPrimary: true},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.d.Marshal()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("marshaling discovery object returned error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if got := hex.EncodeToString(b); got != test.want {
+				t.Errorf("marshaled discovery object got=%s, want=%s", got, test.want)
+			}
+			d, err := ParseDiscovery(b)
+			if err != nil {
+				t.Fatalf("parsing discovery object: %v", err)
+			}
+			if !bytes.Equal(d.AID, aidPIVApplication) {
+				t.Errorf("aid got=%x, want=%x", d.AID, aidPIVApplication)
+			}
+			d.AID = nil
+			if !reflect.DeepEqual(*d, test.d) {
+				t.Errorf("parsed discovery object got=%+v, want=%+v", *d, test.d)
+			}
+		})
+	}
+}
+
+func TestYubiKeyDiscovery(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+
+	d, err := yk.Discovery()
+	if err != nil {
+		t.Fatalf("getting discovery object: %v", err)
+	}
+	if !bytes.Equal(d.AID, aidPIVApplication) {
+		t.Errorf("aid got=%x, want=%x", d.AID, aidPIVApplication)
+	}
+	if !d.ApplicationPIN || d.GlobalPIN {
+		t.Errorf("expected only the application pin to be allowed, got %+v", d)
+	}
+}
+
+func TestEmulatorSetDiscovery(t *testing.T) {
+	// YubiKeys generate the discovery object, so writing it is only tested
+	// against the emulator.
+	yk, close := newTestEmulator(t)
+	defer close()
+
+	want := &Discovery{ApplicationPIN: true, GlobalPIN: true, GlobalPINPrimary: true}
+	if err := yk.SetDiscovery(DefaultManagementKey, want); err != nil {
+		t.Fatalf("setting discovery object: %v", err)
+	}
+	got, err := yk.Discovery()
+	if err != nil {
+		t.Fatalf("getting discovery object: %v", err)
+	}
+	got.AID = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discovery object got=%+v, want=%+v", *got, *want)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// CA is a certificate authority that signs the attestation certificates of
+// emulated cards, standing in for Yubico's PIV root CA.
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewCA generates a self-signed P-256 certificate authority. If rand is nil,
+// crypto/rand.Reader is used.
+func NewCA(rand io.Reader) (*CA, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), randOrDefault(rand))
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+	serial, err := randomSerial(rand)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "piv-go Emulator Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(randOrDefault(rand), tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	return &CA{Certificate: cert, Key: priv}, nil
+}
+
+// CertPool returns a pool containing the CA's certificate, suitable for the
+// Roots of a piv.Verifier.
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// Extensions included in attestation certificates.
+//
+// https://developers.yubico.com/PIV/Introduction/PIV_attestation.html
+var (
+	extIDFirmwareVersion = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}
+	extIDSerialNumber    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+	extIDKeyPolicy       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 8}
+	extIDFormFactor      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 9}
+)
+
+// initAttestation generates the card's attestation key, and its certificate
+// signed by the CA.
+func (c *Card) initAttestation() error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), c.rand)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	serial, err := randomSerial(c.rand)
+	if err != nil {
+		return err
+	}
+	ca := c.ca.Certificate
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Yubico PIV Attestation"},
+		NotBefore:             ca.NotBefore,
+		NotAfter:              ca.NotAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: extIDFirmwareVersion, Value: c.version[:]},
+		},
+	}
+	der, err := x509.CreateCertificate(c.rand, tmpl, ca, priv.Public(), c.ca.Key)
+	if err != nil {
+		return fmt.Errorf("creating certificate: %w", err)
+	}
+	c.attestKey = &key{
+		alg:         algECCP256,
+		pinPolicy:   pinPolicyNever,
+		touchPolicy: touchPolicyNever,
+		origin:      originGenerated,
+		priv:        priv,
+	}
+	c.attestCertDER = der
+	return nil
+}
+
+// attest returns an attestation certificate for the key in a slot, signed by
+// the attestation key.
+func (c *Card) attest(slot byte) ([]byte, uint16) {
+	k, ok := c.keys[slot]
+	if !ok || k.origin != originGenerated {
+		return nil, swIncorrectData
+	}
+	issuer, err := x509.ParseCertificate(c.attestCertDER)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	serial, err := randomSerial(c.rand)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	serialExt, err := asn1.Marshal(int64(c.serial))
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("YubiKey PIV Attestation %02x", slot)},
+		NotBefore:    issuer.NotBefore,
+		NotAfter:     issuer.NotAfter,
+		ExtraExtensions: []pkix.Extension{
+			{Id: extIDFirmwareVersion, Value: c.version[:]},
+			{Id: extIDSerialNumber, Value: serialExt},
+			{Id: extIDKeyPolicy, Value: []byte{k.pinPolicy, k.touchPolicy}},
+			{Id: extIDFormFactor, Value: []byte{c.formfactor}},
+		},
+	}
+	signer := c.attestKey.priv.(crypto.Signer)
+	der, err := x509.CreateCertificate(c.rand, tmpl, issuer, k.public(), signer)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	return der, swSuccess
+}
+
+// certObject encodes a certificate as stored in a data object: the
+// certificate, uncompressed, followed by an empty error detection code.
+func certObject(der []byte) []byte {
+	b := tlv(0x70, der)
+	b = append(b, 0x71, 0x01, 0x00)
+	return append(b, 0xfe, 0x00)
+}
+
+func randomSerial(rand io.Reader) (*big.Int, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(randOrDefault(rand), b); err != nil {
+		return nil, fmt.Errorf("generating serial: %w", err)
+	}
+	b[0] &= 0x7f
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,539 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package emulator implements a software PIV applet that behaves like a
+// YubiKey. A Card can be passed to piv.OpenTransport to exercise the piv
+// package without hardware:
+//
+//	card, err := emulator.New(emulator.Config{})
+//	if err != nil {
+//		// ...
+//	}
+//	yk, err := piv.OpenTransport(card)
+//
+// The emulator keeps real key material, PINs, retry counters and data objects
+// in memory, and signs attestation certificates with a configurable test CA.
+// It's intended for testing only: keys aren't protected, operations aren't
+// constant time, and touch policies are recorded but never enforced.
+package emulator
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ATR is the answer-to-reset reported by a Card, the same as a YubiKey 5 NFC
+// connected over USB. It advertises support for extended length APDUs.
+var ATR = []byte{
+	0x3b, 0xfd, 0x13, 0x00, 0x00, 0x81, 0x31, 0xfe, 0x15, 0x80,
+	0x73, 0xc0, 0x21, 0xc0, 0x57, 0x59, 0x75, 0x62, 0x69, 0x4b,
+	0x65, 0x79, 0x40,
+}
+
+// Config configures a Card.
+type Config struct {
+	// Version is the firmware version reported by the card, as major, minor
+	// and patch numbers. Features introduced in later firmware versions, such
+	// as AES management keys or Ed25519 keys, are rejected as they would be by
+	// a real YubiKey. If zero, version 5.7.1 is used.
+	Version [3]byte
+	// Serial is the serial number reported by the card. If zero, a random
+	// serial number is used.
+	Serial uint32
+	// Formfactor is the form factor reported by the management applet. If
+	// zero, 0x01 (USB-A keychain) is used.
+	Formfactor byte
+	// CA signs the card's attestation certificate. If nil, a new CA is
+	// generated and can be retrieved using the CA method.
+	CA *CA
+	// Rand is the source of randomness for keys, challenges and
+	// certificates. If nil, crypto/rand.Reader is used.
+	Rand io.Reader
+}
+
+// Credentials of a new or reset card, the same as a YubiKey's.
+const (
+	defaultPIN        = "123456"
+	defaultPUK        = "12345678"
+	defaultPINRetries = 3
+	defaultPUKRetries = 3
+)
+
+var defaultManagementKey = []byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+}
+
+// Card is an emulated YubiKey, implementing the piv.Transport interface.
+//
+// A Card is safe for concurrent use, though like a physical card, commands of
+// different connections aren't isolated from each other.
+type Card struct {
+	mu sync.Mutex
+
+	rand       io.Reader
+	version    [3]byte
+	serial     uint32
+	formfactor byte
+	ca         *CA
+
+	pin, puk      *credential
+	mgmtAlg       byte
+	mgmtKey       []byte
+	mgmtTouch     byte
+	keys          map[byte]*key
+	objects       map[uint32][]byte
+	attestKey     *key
+	attestCertDER []byte
+
+	// Volatile state, cleared when an applet is selected.
+	applet      applet
+	pinVerified bool
+	// pinJustVerified is set if the previous command verified the PIN, as
+	// required for keys with a PIN policy of "always".
+	pinJustVerified bool
+	mgmtAuthed      bool
+	// witness is the plaintext of the challenge sent to the host during
+	// management key authentication.
+	witness []byte
+	// chain holds the data of a chained command.
+	chain    []byte
+	chainIns byte
+	// pending holds response data not yet retrieved using GET RESPONSE.
+	pending []byte
+
+	closed bool
+}
+
+// credential is a PIN or PUK and its retry counter.
+type credential struct {
+	value     []byte
+	def       []byte
+	retries   int
+	remaining int
+}
+
+func newCredential(def string, retries int) *credential {
+	c := &credential{def: padPIN(def), retries: retries}
+	c.reset()
+	return c
+}
+
+func (c *credential) reset() {
+	c.value = c.def
+	c.remaining = c.retries
+}
+
+func (c *credential) blocked() bool {
+	return c.remaining == 0
+}
+
+func (c *credential) isDefault() bool {
+	return string(c.value) == string(c.def)
+}
+
+// check compares b with the credential, decrementing the retry counter on a
+// mismatch, and returns the status word to report.
+func (c *credential) check(b []byte) uint16 {
+	if c.blocked() {
+		return swAuthBlocked
+	}
+	if string(b) != string(c.value) {
+		c.remaining--
+		if c.blocked() {
+			return swAuthBlocked
+		}
+		return swVerifyFail | uint16(c.remaining)
+	}
+	c.remaining = c.retries
+	return swSuccess
+}
+
+// padPIN pads a PIN or PUK to 8 bytes with 0xff, as sent by the host.
+func padPIN(s string) []byte {
+	b := []byte(s)
+	for len(b) < 8 {
+		b = append(b, 0xff)
+	}
+	return b
+}
+
+type applet int
+
+const (
+	appletNone applet = iota
+	appletPIV
+	appletManagement
+	appletOTP
+)
+
+var (
+	aidManagement = []byte{0xa0, 0x00, 0x00, 0x05, 0x27, 0x47, 0x11, 0x17}
+	aidPIV        = []byte{0xa0, 0x00, 0x00, 0x03, 0x08}
+	aidPIVFull    = []byte{0xa0, 0x00, 0x00, 0x03, 0x08, 0x00, 0x00, 0x10, 0x00, 0x01, 0x00}
+	aidOTP        = []byte{0xa0, 0x00, 0x00, 0x05, 0x27, 0x20, 0x01, 0x01}
+)
+
+// Status words.
+const (
+	swSuccess           = 0x9000
+	swMoreData          = 0x6100
+	swVerifyFail        = 0x63c0
+	swWrongLength       = 0x6700
+	swSecurityStatus    = 0x6982
+	swAuthBlocked       = 0x6983
+	swConditionsNotMet  = 0x6985
+	swIncorrectData     = 0x6a80
+	swFuncNotSupported  = 0x6a81
+	swNotFound          = 0x6a82
+	swIncorrectParams   = 0x6a86
+	swInsNotSupported   = 0x6d00
+	swClassNotSupported = 0x6e00
+)
+
+// ErrClosed is returned by a Card's methods after it has been closed.
+var ErrClosed = errors.New("emulator: card closed")
+
+// New returns a new card with default credentials and no keys.
+func New(config Config) (*Card, error) {
+	c := &Card{
+		rand:       randOrDefault(config.Rand),
+		version:    config.Version,
+		serial:     config.Serial,
+		formfactor: config.Formfactor,
+		ca:         config.CA,
+	}
+	if c.version == [3]byte{} {
+		c.version = [3]byte{5, 7, 1}
+	}
+	if c.serial == 0 {
+		var b [4]byte
+		if _, err := io.ReadFull(c.rand, b[:]); err != nil {
+			return nil, fmt.Errorf("generating serial: %w", err)
+		}
+		// Keep the serial positive and non-zero, in the range of real cards.
+		c.serial = binary.BigEndian.Uint32(b[:])&0x0fffffff | 0x01000000
+	}
+	if c.formfactor == 0 {
+		c.formfactor = 0x01
+	}
+	if c.ca == nil {
+		ca, err := NewCA(c.rand)
+		if err != nil {
+			return nil, fmt.Errorf("generating ca: %w", err)
+		}
+		c.ca = ca
+	}
+	if err := c.initAttestation(); err != nil {
+		return nil, fmt.Errorf("initializing attestation: %w", err)
+	}
+	c.reset()
+	return c, nil
+}
+
+func randOrDefault(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
+// reset restores the PIV applet to its factory state. The attestation key and
+// certificate are preserved.
+func (c *Card) reset() {
+	c.pin = newCredential(defaultPIN, defaultPINRetries)
+	c.puk = newCredential(defaultPUK, defaultPUKRetries)
+	c.mgmtAlg = algAES192
+	if !c.atLeast(5, 7) {
+		c.mgmtAlg = alg3DES
+	}
+	c.mgmtKey = defaultManagementKey
+	c.mgmtTouch = touchPolicyNever
+	c.keys = make(map[byte]*key)
+	c.objects = make(map[uint32][]byte)
+	c.objects[objDiscovery] = discoveryObject
+	c.objects[objAttestation] = certObject(c.attestCertDER)
+	c.clearSecurityStatus()
+}
+
+func (c *Card) clearSecurityStatus() {
+	c.pinVerified = false
+	c.pinJustVerified = false
+	c.mgmtAuthed = false
+	c.witness = nil
+}
+
+// atLeast reports whether the card's firmware is at least major.minor.
+func (c *Card) atLeast(major, minor byte) bool {
+	return c.version[0] > major || (c.version[0] == major && c.version[1] >= minor)
+}
+
+// CA returns the certificate authority that signed the card's attestation
+// certificate. Its certificate can be used as a root to verify attestations.
+func (c *Card) CA() *CA {
+	return c.ca
+}
+
+// Serial returns the card's serial number.
+func (c *Card) Serial() uint32 {
+	return c.serial
+}
+
+// Reset simulates the card being reset or powered off, discarding the
+// selected applet, PIN and management key authentication, and partially
+// transmitted commands and responses. Keys, credentials and data objects are
+// kept.
+func (c *Card) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applet = appletNone
+	c.clearSecurityStatus()
+	c.chain = nil
+	c.pending = nil
+}
+
+// ATR returns the card's answer-to-reset.
+func (c *Card) ATR() ([]byte, error) {
+	return append([]byte(nil), ATR...), nil
+}
+
+// BeginTransaction is a no-op. Commands of a Card are always processed one
+// at a time.
+func (c *Card) BeginTransaction() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// EndTransaction is a no-op.
+func (c *Card) EndTransaction() error {
+	return nil
+}
+
+// Close closes the card. Subsequent calls to Transmit return ErrClosed.
+func (c *Card) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Transmit processes a command APDU and returns the response, including the
+// trailing status word.
+func (c *Card) Transmit(req []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	data, sw := c.process(req)
+	return append(data, byte(sw>>8), byte(sw)), nil
+}
+
+// command is a parsed command APDU.
+type command struct {
+	cla, ins, p1, p2 byte
+	data             []byte
+	// ne is the maximum number of response bytes returned at once. Longer
+	// responses are returned in chunks using GET RESPONSE.
+	ne int
+}
+
+// parseCommand decodes a short or extended length command APDU. Responses to
+// short commands are returned in chunks of up to 256 bytes, regardless of Le,
+// while extended commands receive up to their extended Le.
+func parseCommand(b []byte) (command, bool) {
+	if len(b) < 4 {
+		return command{}, false
+	}
+	cmd := command{cla: b[0], ins: b[1], p1: b[2], p2: b[3], ne: 256}
+	body := b[4:]
+	switch {
+	case len(body) <= 1:
+		// No data, with an optional short Le.
+	case body[0] != 0:
+		n := int(body[0])
+		if len(body) != 1+n && len(body) != 2+n {
+			return command{}, false
+		}
+		cmd.data = body[1 : 1+n]
+	case len(body) == 3:
+		// Extended Le, no data.
+		cmd.ne = extendedLe(body[1:])
+	default:
+		if len(body) < 3 {
+			return command{}, false
+		}
+		n := int(body[1])<<8 | int(body[2])
+		if len(body) != 3+n && len(body) != 5+n {
+			return command{}, false
+		}
+		cmd.data = body[3 : 3+n]
+		if len(body) == 5+n {
+			cmd.ne = extendedLe(body[3+n:])
+		}
+	}
+	return cmd, true
+}
+
+// extendedLe decodes a two byte Le field, where zero means 65536.
+func extendedLe(b []byte) int {
+	if n := int(b[0])<<8 | int(b[1]); n != 0 {
+		return n
+	}
+	return 65536
+}
+
+// process handles a single command APDU.
+func (c *Card) process(req []byte) ([]byte, uint16) {
+	cmd, ok := parseCommand(req)
+	if !ok {
+		return nil, swWrongLength
+	}
+	if cmd.cla&^0x10 != 0 {
+		return nil, swClassNotSupported
+	}
+
+	if cmd.ins == insGetResponse {
+		return c.nextChunk(cmd.ne)
+	}
+	c.pending = nil
+
+	if cmd.cla&0x10 != 0 {
+		if c.chain != nil && c.chainIns != cmd.ins {
+			c.chain = nil
+			return nil, swConditionsNotMet
+		}
+		c.chain = append(c.chain, cmd.data...)
+		c.chainIns = cmd.ins
+		return nil, swSuccess
+	}
+	if c.chain != nil {
+		if c.chainIns != cmd.ins {
+			c.chain = nil
+			return nil, swConditionsNotMet
+		}
+		cmd.data = append(c.chain, cmd.data...)
+		c.chain = nil
+	}
+
+	var (
+		resp []byte
+		sw   uint16
+	)
+	if cmd.ins == insSelect {
+		resp, sw = c.selectApplet(cmd)
+	} else {
+		switch c.applet {
+		case appletPIV:
+			resp, sw = c.handlePIV(cmd)
+		case appletManagement:
+			resp, sw = c.handleManagement(cmd)
+		case appletOTP:
+			resp, sw = c.handleOTP(cmd)
+		default:
+			sw = swInsNotSupported
+		}
+	}
+	if sw != swSuccess {
+		return nil, sw
+	}
+	c.pending = resp
+	return c.nextChunk(cmd.ne)
+}
+
+// nextChunk returns up to max bytes of pending response data. If data remains,
+// the status word indicates how much using 61xx.
+func (c *Card) nextChunk(max int) ([]byte, uint16) {
+	if len(c.pending) <= max {
+		resp := c.pending
+		c.pending = nil
+		return append([]byte(nil), resp...), swSuccess
+	}
+	resp := append([]byte(nil), c.pending[:max]...)
+	c.pending = c.pending[max:]
+	n := len(c.pending)
+	if n > 0xff {
+		n = 0
+	}
+	return resp, swMoreData | uint16(n)
+}
+
+func (c *Card) selectApplet(cmd command) ([]byte, uint16) {
+	if cmd.p1 != 0x04 {
+		return nil, swIncorrectParams
+	}
+	c.clearSecurityStatus()
+	switch {
+	case len(cmd.data) >= len(aidPIV) && hasPrefix(aidPIVFull, cmd.data):
+		c.applet = appletPIV
+		// Application property template, with the PIV application
+		// identifier and coexistent tag allocation authority.
+		return tlv(0x61, append(
+			tlv(0x4f, []byte{0x00, 0x00, 0x10, 0x00, 0x01, 0x00}),
+			tlv(0x79, tlv(0x4f, aidPIV))...,
+		)), swSuccess
+	case string(cmd.data) == string(aidManagement):
+		c.applet = appletManagement
+		return []byte(fmt.Sprintf("Virtual mgr - FW version %d.%d.%d",
+			c.version[0], c.version[1], c.version[2])), swSuccess
+	case string(cmd.data) == string(aidOTP):
+		c.applet = appletOTP
+		return c.version[:], swSuccess
+	}
+	c.applet = appletNone
+	return nil, swNotFound
+}
+
+// hasPrefix reports whether b is a prefix of aid, allowing truncated
+// application identifiers to be selected.
+func hasPrefix(aid, b []byte) bool {
+	return len(b) <= len(aid) && string(aid[:len(b)]) == string(b)
+}
+
+const (
+	// insReadConfig reads the device info of the management applet.
+	insReadConfig = 0x1d
+	// insOTPSerial reads the serial number using the OTP applet, as done
+	// for firmware before 5.0.
+	insOTPSerial = 0x01
+)
+
+func (c *Card) handleManagement(cmd command) ([]byte, uint16) {
+	if cmd.ins != insReadConfig {
+		return nil, swInsNotSupported
+	}
+	var info []byte
+	info = append(info, 0x02, 0x04)
+	info = append(info, c.serialBytes()...)
+	info = append(info, 0x04, 0x01, c.formfactor)
+	info = append(info, 0x05, 0x03)
+	info = append(info, c.version[:]...)
+	return append([]byte{byte(len(info))}, info...), swSuccess
+}
+
+func (c *Card) handleOTP(cmd command) ([]byte, uint16) {
+	if cmd.ins != insOTPSerial || cmd.p1 != 0x10 {
+		return nil, swInsNotSupported
+	}
+	return c.serialBytes(), swSuccess
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestCard(t *testing.T, config Config) *Card {
+	t.Helper()
+	c, err := New(config)
+	if err != nil {
+		t.Fatalf("creating card: %v", err)
+	}
+	transmit(t, c, []byte{0x00, insSelect, 0x04, 0x00, 0x05, 0xa0, 0x00, 0x00, 0x03, 0x08}, swSuccess)
+	return c
+}
+
+// transmit sends a command and checks its status word, returning the response
+// data.
+func transmit(t *testing.T, c *Card, req []byte, want uint16) []byte {
+	t.Helper()
+	resp, err := c.Transmit(req)
+	if err != nil {
+		t.Fatalf("transmit %x: %v", req, err)
+	}
+	n := len(resp) - 2
+	if got := uint16(resp[n])<<8 | uint16(resp[n+1]); got != want {
+		t.Fatalf("transmit %x: got status %04x, want %04x", req, got, want)
+	}
+	return resp[:n]
+}
+
+func verifyCommand(pin string) []byte {
+	return append([]byte{0x00, insVerify, 0x00, keyPIN, 0x08}, padPIN(pin)...)
+}
+
+func TestPINRetries(t *testing.T) {
+	c := newTestCard(t, Config{})
+	status := []byte{0x00, insVerify, 0x00, keyPIN}
+	transmit(t, c, status, swVerifyFail|3)
+	transmit(t, c, verifyCommand("000000"), swVerifyFail|2)
+	transmit(t, c, verifyCommand("000000"), swVerifyFail|1)
+	transmit(t, c, verifyCommand(defaultPIN), swSuccess)
+	transmit(t, c, status, swSuccess)
+
+	for i := 2; i >= 0; i-- {
+		want := uint16(swVerifyFail | i)
+		if i == 0 {
+			want = swAuthBlocked
+		}
+		transmit(t, c, verifyCommand("000000"), want)
+	}
+	transmit(t, c, verifyCommand(defaultPIN), swAuthBlocked)
+
+	// The applet can only be reset once both the PIN and PUK are blocked.
+	transmit(t, c, []byte{0x00, insReset, 0x00, 0x00}, swConditionsNotMet)
+	unblock := append([]byte{0x00, insResetRetry, 0x00, keyPIN, 0x10}, padPIN("00000000")...)
+	unblock = append(unblock, padPIN("654321")...)
+	for i := 2; i >= 0; i-- {
+		want := uint16(swVerifyFail | i)
+		if i == 0 {
+			want = swAuthBlocked
+		}
+		transmit(t, c, unblock, want)
+	}
+	transmit(t, c, []byte{0x00, insReset, 0x00, 0x00}, swSuccess)
+	transmit(t, c, verifyCommand(defaultPIN), swSuccess)
+}
+
+func TestResponseChaining(t *testing.T) {
+	c := newTestCard(t, Config{})
+	value := bytes.Repeat([]byte{0x42}, 600)
+	c.objects[0x5fc105] = value
+
+	resp := transmit(t, c, []byte{0x00, insGetData, 0x3f, 0xff, 0x05, 0x5c, 0x03, 0x5f, 0xc1, 0x05}, swMoreData|0x00)
+	resp = append(resp, transmit(t, c, []byte{0x00, insGetResponse, 0x00, 0x00, 0x00}, swMoreData|0x5c)...)
+	resp = append(resp, transmit(t, c, []byte{0x00, insGetResponse, 0x00, 0x00, 0x5c}, swSuccess)...)
+	if want := tlv(0x53, value); !bytes.Equal(resp, want) {
+		t.Errorf("response got=%x, want=%x", resp, want)
+	}
+}
+
+func TestCommandChaining(t *testing.T) {
+	c := newTestCard(t, Config{})
+	c.mgmtAuthed = true
+	value := bytes.Repeat([]byte{0x42}, 300)
+	data := append([]byte{0x5c, 0x03, 0x5f, 0xc1, 0x05}, tlv(0x53, value)...)
+
+	first := append([]byte{0x10, insPutData, 0x3f, 0xff, 0xff}, data[:0xff]...)
+	transmit(t, c, first, swSuccess)
+	last := append([]byte{0x00, insPutData, 0x3f, 0xff, byte(len(data) - 0xff)}, data[0xff:]...)
+	transmit(t, c, last, swSuccess)
+	if got := c.objects[0x5fc105]; !bytes.Equal(got, value) {
+		t.Errorf("stored object got=%x, want=%x", got, value)
+	}
+
+	// A chain must continue with the same instruction.
+	transmit(t, c, first, swSuccess)
+	transmit(t, c, []byte{0x00, insGetVersion, 0x00, 0x00}, swConditionsNotMet)
+}
+
+func TestPINPolicyAlways(t *testing.T) {
+	c := newTestCard(t, Config{})
+	c.mgmtAuthed = true
+	gen := []byte{0x00, insGenerateAsymmetric, 0x00, keySignature, 0x0b,
+		0xac, 0x09, 0x80, 0x01, algECCP256, 0xaa, 0x01, pinPolicyAlways, 0xab, 0x01, touchPolicyNever}
+	transmit(t, c, gen, swSuccess)
+
+	sign := append([]byte{0x00, insAuthenticate, algECCP256, keySignature, 0x26},
+		tlv(0x7c, append([]byte{0x82, 0x00}, tlv(0x81, make([]byte, 32))...))...)
+	transmit(t, c, sign, swSecurityStatus)
+	transmit(t, c, verifyCommand(defaultPIN), swSuccess)
+	transmit(t, c, sign, swSuccess)
+	// The PIN must be verified again before each use.
+	transmit(t, c, sign, swSecurityStatus)
+}
+
+func TestVersionFeatures(t *testing.T) {
+	c := newTestCard(t, Config{Version: [3]byte{4, 3, 5}, Serial: 1234})
+	transmit(t, c, []byte{0x00, insGetSerial, 0x00, 0x00}, swInsNotSupported)
+	transmit(t, c, []byte{0x00, insGetMetadata, 0x00, keyCardManagement}, swInsNotSupported)
+	transmit(t, c, []byte{0x00, insMoveKey, 0x82, keyKeyManagement}, swInsNotSupported)
+
+	transmit(t, c, append([]byte{0x00, insSelect, 0x04, 0x00, byte(len(aidOTP))}, aidOTP...), swSuccess)
+	serial := transmit(t, c, []byte{0x00, insOTPSerial, 0x10, 0x00}, swSuccess)
+	if want := []byte{0x00, 0x00, 0x04, 0xd2}; !bytes.Equal(serial, want) {
+		t.Errorf("serial got=%x, want=%x", serial, want)
+	}
+	if c.mgmtAlg != alg3DES {
+		t.Errorf("management key algorithm got=0x%02x, want 3DES", c.mgmtAlg)
+	}
+}
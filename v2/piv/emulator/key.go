@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// key is a private key held in a slot.
+type key struct {
+	alg         byte
+	pinPolicy   byte
+	touchPolicy byte
+	origin      byte
+	priv        crypto.PrivateKey
+}
+
+var errUnsupportedAlgorithm = errors.New("unsupported algorithm")
+
+// rsaBits returns the modulus size of an RSA algorithm, or zero if alg isn't
+// an RSA algorithm.
+func rsaBits(alg byte) int {
+	switch alg {
+	case algRSA1024:
+		return 1024
+	case algRSA2048:
+		return 2048
+	case algRSA3072:
+		return 3072
+	case algRSA4096:
+		return 4096
+	}
+	return 0
+}
+
+// ecCurve returns the curve of an EC algorithm, or nil if alg isn't an EC
+// algorithm.
+func ecCurve(alg byte) elliptic.Curve {
+	switch alg {
+	case algECCP256:
+		return elliptic.P256()
+	case algECCP384:
+		return elliptic.P384()
+	}
+	return nil
+}
+
+// supportsAlgorithm reports whether the card's firmware supports keys of the
+// given algorithm.
+func (c *Card) supportsAlgorithm(alg byte) bool {
+	switch alg {
+	case algRSA1024, algRSA2048, algECCP256:
+		return true
+	case algECCP384:
+		return c.atLeast(4, 0)
+	case algRSA3072, algRSA4096, algEd25519, algX25519:
+		return c.atLeast(5, 7)
+	}
+	return false
+}
+
+// generateKey generates a private key of the given algorithm.
+func generateKey(rand io.Reader, alg byte) (crypto.PrivateKey, error) {
+	if bits := rsaBits(alg); bits != 0 {
+		return rsa.GenerateKey(rand, bits)
+	}
+	if curve := ecCurve(alg); curve != nil {
+		return ecdsa.GenerateKey(curve, rand)
+	}
+	switch alg {
+	case algEd25519:
+		_, priv, err := ed25519.GenerateKey(rand)
+		return priv, err
+	case algX25519:
+		return ecdh.X25519().GenerateKey(rand)
+	}
+	return nil, errUnsupportedAlgorithm
+}
+
+// importKey constructs a private key from the parameters sent with IMPORT KEY.
+func importKey(alg byte, params map[uint32][]byte) (crypto.PrivateKey, error) {
+	if bits := rsaBits(alg); bits != 0 {
+		p, q := params[0x01], params[0x02]
+		if len(p) != bits/16 || len(q) != bits/16 {
+			return nil, errors.New("invalid rsa primes")
+		}
+		// The public exponent isn't sent, YubiKeys assume 65537.
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{E: 65537},
+			Primes:    []*big.Int{new(big.Int).SetBytes(p), new(big.Int).SetBytes(q)},
+		}
+		one := big.NewInt(1)
+		pm := new(big.Int).Sub(priv.Primes[0], one)
+		qm := new(big.Int).Sub(priv.Primes[1], one)
+		priv.N = new(big.Int).Mul(priv.Primes[0], priv.Primes[1])
+		priv.D = new(big.Int).ModInverse(big.NewInt(int64(priv.E)), new(big.Int).Mul(pm, qm))
+		if priv.D == nil {
+			return nil, errors.New("invalid rsa primes")
+		}
+		if err := priv.Validate(); err != nil {
+			return nil, err
+		}
+		priv.Precompute()
+		return priv, nil
+	}
+	if curve := ecCurve(alg); curve != nil {
+		d := params[0x06]
+		if len(d) != (curve.Params().BitSize+7)/8 {
+			return nil, errors.New("invalid ec private key")
+		}
+		priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+		priv.Curve = curve
+		if priv.D.Sign() == 0 || priv.D.Cmp(curve.Params().N) >= 0 {
+			return nil, errors.New("invalid ec private key")
+		}
+		priv.X, priv.Y = curve.ScalarBaseMult(d)
+		return priv, nil
+	}
+	switch alg {
+	case algEd25519:
+		seed := params[0x07]
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid ed25519 seed")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	case algX25519:
+		return ecdh.X25519().NewPrivateKey(params[0x08])
+	}
+	return nil, errUnsupportedAlgorithm
+}
+
+// public returns the public key of k.
+func (k *key) public() crypto.PublicKey {
+	return k.priv.(interface{ Public() crypto.PublicKey }).Public()
+}
+
+// encodePublic returns the public key TLVs used by GENERATE ASYMMETRIC and
+// GET METADATA.
+func (k *key) encodePublic() []byte {
+	switch priv := k.priv.(type) {
+	case *rsa.PrivateKey:
+		e := big.NewInt(int64(priv.E)).Bytes()
+		return append(tlv(0x81, priv.N.Bytes()), tlv(0x82, e)...)
+	case *ecdsa.PrivateKey:
+		pub, err := priv.PublicKey.ECDH()
+		if err != nil {
+			return nil
+		}
+		return tlv(0x86, pub.Bytes())
+	case ed25519.PrivateKey:
+		return tlv(0x86, priv.Public().(ed25519.PublicKey))
+	case *ecdh.PrivateKey:
+		return tlv(0x86, priv.PublicKey().Bytes())
+	}
+	return nil
+}
+
+// operate performs the private key operation requested by GENERAL
+// AUTHENTICATE. Tag 0x81 holds a challenge to sign or decrypt, and tag 0x85 the
+// peer's public key for key agreement.
+func (c *Card) operate(k *key, tag uint32, data []byte) ([]byte, uint16) {
+	switch priv := k.priv.(type) {
+	case *rsa.PrivateKey:
+		size := (priv.N.BitLen() + 7) / 8
+		if tag != 0x81 || len(data) != size {
+			return nil, swIncorrectData
+		}
+		// Signing and decryption are both the raw RSA operation, the host
+		// handles the padding.
+		m := new(big.Int).SetBytes(data)
+		if m.Cmp(priv.N) >= 0 {
+			return nil, swIncorrectData
+		}
+		return m.Exp(m, priv.D, priv.N).FillBytes(make([]byte, size)), swSuccess
+	case *ecdsa.PrivateKey:
+		switch tag {
+		case 0x81:
+			sig, err := ecdsa.SignASN1(c.rand, priv, data)
+			if err != nil {
+				return nil, swIncorrectData
+			}
+			return sig, swSuccess
+		case 0x85:
+			ours, err := priv.ECDH()
+			if err != nil {
+				return nil, swIncorrectData
+			}
+			return ecdhSecret(ours, data)
+		}
+	case ed25519.PrivateKey:
+		if tag == 0x81 {
+			return ed25519.Sign(priv, data), swSuccess
+		}
+	case *ecdh.PrivateKey:
+		if tag == 0x85 {
+			return ecdhSecret(priv, data)
+		}
+	}
+	return nil, swIncorrectData
+}
+
+func ecdhSecret(priv *ecdh.PrivateKey, peer []byte) ([]byte, uint16) {
+	pub, err := priv.Curve().NewPublicKey(peer)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	return secret, swSuccess
+}
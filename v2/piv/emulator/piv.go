@@ -0,0 +1,655 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"io"
+)
+
+const (
+	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-78-4.pdf#page=17
+	alg3DES    = 0x03
+	algAES128  = 0x08
+	algAES192  = 0x0a
+	algAES256  = 0x0c
+	algRSA1024 = 0x06
+	algRSA2048 = 0x07
+	algRSA3072 = 0x05
+	algRSA4096 = 0x16
+	algECCP256 = 0x11
+	algECCP384 = 0x14
+	algEd25519 = 0xe0
+	algX25519  = 0xe1
+
+	keyPIN                = 0x80
+	keyPUK                = 0x81
+	keyAuthentication     = 0x9a
+	keyCardManagement     = 0x9b
+	keySignature          = 0x9c
+	keyKeyManagement      = 0x9d
+	keyCardAuthentication = 0x9e
+	keyAttestation        = 0xf9
+
+	insVerify             = 0x20
+	insChangeReference    = 0x24
+	insResetRetry         = 0x2c
+	insGenerateAsymmetric = 0x47
+	insAuthenticate       = 0x87
+	insGetData            = 0xcb
+	insPutData            = 0xdb
+	insSelect             = 0xa4
+	insGetResponse        = 0xc0
+
+	// https://developers.yubico.com/PIV/Introduction/Yubico_extensions.html
+	insSetMGMKey     = 0xff
+	insImportKey     = 0xfe
+	insGetVersion    = 0xfd
+	insReset         = 0xfb
+	insSetPINRetries = 0xfa
+	insAttest        = 0xf9
+	insGetSerial     = 0xf8
+	insGetMetadata   = 0xf7
+	insMoveKey       = 0xf6
+
+	pinPolicyNever  = 0x01
+	pinPolicyOnce   = 0x02
+	pinPolicyAlways = 0x03
+
+	touchPolicyNever  = 0x01
+	touchPolicyAlways = 0x02
+	touchPolicyCached = 0x03
+
+	originGenerated = 0x01
+	originImported  = 0x02
+
+	tagPINPolicy   = 0xaa
+	tagTouchPolicy = 0xab
+)
+
+// Data objects with special handling.
+const (
+	objDiscovery   = 0x7e
+	objBiometric   = 0x7f61
+	objPrintedInfo = 0x5fc109
+	objAttestation = 0x5fff01
+)
+
+// discoveryObject is the content of the discovery object of a YubiKey: the
+// PIV application identifier, and a PIN usage policy allowing only the PIV
+// PIN.
+var discoveryObject = append(
+	tlv(0x4f, aidPIVFull),
+	0x5f, 0x2f, 0x02, 0x40, 0x00,
+)
+
+// managementKeyLengths maps management key algorithms to their key lengths.
+var managementKeyLengths = map[byte]int{
+	alg3DES:   24,
+	algAES128: 16,
+	algAES192: 24,
+	algAES256: 32,
+}
+
+// isKeySlot reports whether slot holds an asymmetric key.
+func isKeySlot(slot byte) bool {
+	switch slot {
+	case keyAuthentication, keySignature, keyKeyManagement, keyCardAuthentication:
+		return true
+	}
+	// Retired key management slots.
+	return slot >= 0x82 && slot <= 0x95
+}
+
+func (c *Card) handlePIV(cmd command) ([]byte, uint16) {
+	justVerified := c.pinJustVerified
+	c.pinJustVerified = false
+
+	switch cmd.ins {
+	case insVerify:
+		return c.verify(cmd)
+	case insChangeReference:
+		return c.changeReference(cmd)
+	case insResetRetry:
+		return c.resetRetry(cmd)
+	case insGenerateAsymmetric:
+		return c.generate(cmd)
+	case insAuthenticate:
+		return c.authenticate(cmd, justVerified)
+	case insGetData:
+		return c.getData(cmd)
+	case insPutData:
+		return c.putData(cmd)
+	case insSetMGMKey:
+		return c.setManagementKey(cmd)
+	case insImportKey:
+		return c.importKey(cmd)
+	case insGetVersion:
+		return append([]byte(nil), c.version[:]...), swSuccess
+	case insReset:
+		if !c.pin.blocked() || !c.puk.blocked() {
+			return nil, swConditionsNotMet
+		}
+		c.reset()
+		return nil, swSuccess
+	case insSetPINRetries:
+		return c.setPINRetries(cmd)
+	case insAttest:
+		if !c.atLeast(4, 3) {
+			return nil, swInsNotSupported
+		}
+		return c.attest(cmd.p1)
+	case insGetSerial:
+		if !c.atLeast(5, 0) {
+			return nil, swInsNotSupported
+		}
+		return c.serialBytes(), swSuccess
+	case insGetMetadata:
+		if !c.atLeast(5, 3) {
+			return nil, swInsNotSupported
+		}
+		return c.metadata(cmd.p2)
+	case insMoveKey:
+		if !c.atLeast(5, 7) {
+			return nil, swInsNotSupported
+		}
+		return c.moveKey(cmd)
+	}
+	return nil, swInsNotSupported
+}
+
+func (c *Card) verify(cmd command) ([]byte, uint16) {
+	if cmd.p2 != keyPIN {
+		return nil, swIncorrectParams
+	}
+	switch cmd.p1 {
+	case 0x00:
+	case 0xff:
+		// Reset the PIN verification status.
+		if len(cmd.data) != 0 {
+			return nil, swWrongLength
+		}
+		c.pinVerified = false
+		return nil, swSuccess
+	default:
+		return nil, swIncorrectParams
+	}
+
+	if len(cmd.data) == 0 {
+		// Query whether the PIN must be verified.
+		if c.pinVerified {
+			return nil, swSuccess
+		}
+		if c.pin.blocked() {
+			return nil, swAuthBlocked
+		}
+		return nil, swVerifyFail | uint16(c.pin.remaining)
+	}
+	if len(cmd.data) != 8 {
+		return nil, swWrongLength
+	}
+	c.pinVerified = false
+	if sw := c.pin.check(cmd.data); sw != swSuccess {
+		return nil, sw
+	}
+	c.pinVerified = true
+	c.pinJustVerified = true
+	return nil, swSuccess
+}
+
+func (c *Card) changeReference(cmd command) ([]byte, uint16) {
+	var cred *credential
+	switch cmd.p2 {
+	case keyPIN:
+		cred = c.pin
+	case keyPUK:
+		cred = c.puk
+	default:
+		return nil, swIncorrectParams
+	}
+	if len(cmd.data) != 16 {
+		return nil, swWrongLength
+	}
+	if sw := cred.check(cmd.data[:8]); sw != swSuccess {
+		return nil, sw
+	}
+	if !validPIN(cmd.data[8:]) {
+		return nil, swIncorrectData
+	}
+	cred.value = append([]byte(nil), cmd.data[8:]...)
+	return nil, swSuccess
+}
+
+func (c *Card) resetRetry(cmd command) ([]byte, uint16) {
+	if cmd.p2 != keyPIN {
+		return nil, swIncorrectParams
+	}
+	if len(cmd.data) != 16 {
+		return nil, swWrongLength
+	}
+	if sw := c.puk.check(cmd.data[:8]); sw != swSuccess {
+		return nil, sw
+	}
+	if !validPIN(cmd.data[8:]) {
+		return nil, swIncorrectData
+	}
+	c.pin.value = append([]byte(nil), cmd.data[8:]...)
+	c.pin.remaining = c.pin.retries
+	return nil, swSuccess
+}
+
+// validPIN reports whether a padded PIN or PUK is between 6 and 8 bytes long.
+func validPIN(b []byte) bool {
+	n := len(b)
+	for n > 0 && b[n-1] == 0xff {
+		n--
+	}
+	for _, c := range b[:n] {
+		if c == 0xff {
+			return false
+		}
+	}
+	return n >= 6
+}
+
+func (c *Card) setPINRetries(cmd command) ([]byte, uint16) {
+	if !c.mgmtAuthed || !c.pinVerified {
+		return nil, swSecurityStatus
+	}
+	if cmd.p1 == 0 || cmd.p2 == 0 {
+		return nil, swIncorrectParams
+	}
+	// Changing the retry counts also resets the PIN and PUK.
+	c.pin = newCredential(defaultPIN, int(cmd.p1))
+	c.puk = newCredential(defaultPUK, int(cmd.p2))
+	c.pinVerified = false
+	return nil, swSuccess
+}
+
+// parsePolicy reads the PIN and touch policies sent with GENERATE ASYMMETRIC
+// and IMPORT KEY, applying the defaults of the slot.
+func parsePolicy(slot byte, params map[uint32][]byte) (pp, tp byte, ok bool) {
+	switch slot {
+	case keySignature:
+		pp = pinPolicyAlways
+	case keyCardAuthentication:
+		pp = pinPolicyNever
+	default:
+		pp = pinPolicyOnce
+	}
+	tp = touchPolicyNever
+	if v, found := params[tagPINPolicy]; found {
+		if len(v) != 1 || v[0] > pinPolicyAlways {
+			return 0, 0, false
+		}
+		if v[0] != 0 {
+			pp = v[0]
+		}
+	}
+	if v, found := params[tagTouchPolicy]; found {
+		if len(v) != 1 || v[0] > touchPolicyCached {
+			return 0, 0, false
+		}
+		if v[0] != 0 {
+			tp = v[0]
+		}
+	}
+	return pp, tp, true
+}
+
+func (c *Card) generate(cmd command) ([]byte, uint16) {
+	if !c.mgmtAuthed {
+		return nil, swSecurityStatus
+	}
+	if cmd.p1 != 0x00 || !isKeySlot(cmd.p2) {
+		return nil, swIncorrectParams
+	}
+	tag, v, _, err := parseTLV(cmd.data)
+	if err != nil || tag != 0xac {
+		return nil, swIncorrectData
+	}
+	params, err := parseTLVs(v)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	alg := params[0x80]
+	if len(alg) != 1 || !c.supportsAlgorithm(alg[0]) {
+		return nil, swIncorrectData
+	}
+	pp, tp, ok := parsePolicy(cmd.p2, params)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	priv, err := generateKey(c.rand, alg[0])
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	k := &key{
+		alg:         alg[0],
+		pinPolicy:   pp,
+		touchPolicy: tp,
+		origin:      originGenerated,
+		priv:        priv,
+	}
+	c.keys[cmd.p2] = k
+	return tlv(0x7f49, k.encodePublic()), swSuccess
+}
+
+func (c *Card) importKey(cmd command) ([]byte, uint16) {
+	if !c.mgmtAuthed {
+		return nil, swSecurityStatus
+	}
+	if !isKeySlot(cmd.p2) {
+		return nil, swIncorrectParams
+	}
+	if !c.supportsAlgorithm(cmd.p1) {
+		return nil, swIncorrectData
+	}
+	params, err := parseTLVs(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	pp, tp, ok := parsePolicy(cmd.p2, params)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	priv, err := importKey(cmd.p1, params)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	c.keys[cmd.p2] = &key{
+		alg:         cmd.p1,
+		pinPolicy:   pp,
+		touchPolicy: tp,
+		origin:      originImported,
+		priv:        priv,
+	}
+	return nil, swSuccess
+}
+
+// moveKey moves the key in slot P2 to slot P1, or deletes it if P1 is 0xff.
+func (c *Card) moveKey(cmd command) ([]byte, uint16) {
+	if !c.mgmtAuthed {
+		return nil, swSecurityStatus
+	}
+	if !isKeySlot(cmd.p2) || (cmd.p1 != 0xff && !isKeySlot(cmd.p1)) || cmd.p1 == cmd.p2 {
+		return nil, swIncorrectParams
+	}
+	k, ok := c.keys[cmd.p2]
+	if !ok {
+		return nil, swNotFound
+	}
+	delete(c.keys, cmd.p2)
+	if cmd.p1 != 0xff {
+		c.keys[cmd.p1] = k
+	}
+	return nil, swSuccess
+}
+
+func (c *Card) authenticate(cmd command, justVerified bool) ([]byte, uint16) {
+	tag, v, _, err := parseTLV(cmd.data)
+	if err != nil || tag != 0x7c {
+		return nil, swIncorrectData
+	}
+	params, err := parseTLVs(v)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	if cmd.p2 == keyCardManagement {
+		return c.authenticateManagement(cmd.p1, params)
+	}
+
+	k, ok := c.keys[cmd.p2]
+	if !ok {
+		return nil, swNotFound
+	}
+	if k.alg != cmd.p1 {
+		return nil, swIncorrectParams
+	}
+	if _, ok := params[0x82]; !ok {
+		return nil, swIncorrectData
+	}
+	switch k.pinPolicy {
+	case pinPolicyOnce:
+		if !c.pinVerified {
+			return nil, swSecurityStatus
+		}
+	case pinPolicyAlways:
+		if !c.pinVerified || !justVerified {
+			return nil, swSecurityStatus
+		}
+	}
+
+	var (
+		result []byte
+		sw     uint16 = swIncorrectData
+	)
+	if data, ok := params[0x81]; ok {
+		result, sw = c.operate(k, 0x81, data)
+	} else if data, ok := params[0x85]; ok {
+		result, sw = c.operate(k, 0x85, data)
+	}
+	if sw != swSuccess {
+		return nil, sw
+	}
+	return tlv(0x7c, tlv(0x82, result)), swSuccess
+}
+
+// authenticateManagement performs mutual authentication with the management
+// key. The host first requests a witness, which the card returns encrypted,
+// then sends the decrypted witness along with a challenge for the card to
+// encrypt.
+func (c *Card) authenticateManagement(alg byte, params map[uint32][]byte) ([]byte, uint16) {
+	if alg != c.mgmtAlg {
+		return nil, swIncorrectParams
+	}
+	block, err := managementCipher(alg, c.mgmtKey)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	n := block.BlockSize()
+	witness, hasWitness := params[0x80]
+	challenge, hasChallenge := params[0x81]
+	switch {
+	case hasWitness && len(witness) == 0 && !hasChallenge:
+		c.mgmtAuthed = false
+		c.witness = make([]byte, n)
+		if _, err := io.ReadFull(c.rand, c.witness); err != nil {
+			c.witness = nil
+			return nil, swIncorrectData
+		}
+		enc := make([]byte, n)
+		block.Encrypt(enc, c.witness)
+		return tlv(0x7c, tlv(0x80, enc)), swSuccess
+	case hasWitness && hasChallenge:
+		want := c.witness
+		c.witness = nil
+		if want == nil || string(witness) != string(want) {
+			c.mgmtAuthed = false
+			return nil, swSecurityStatus
+		}
+		if len(challenge) != n {
+			return nil, swIncorrectData
+		}
+		resp := make([]byte, n)
+		block.Encrypt(resp, challenge)
+		c.mgmtAuthed = true
+		return tlv(0x7c, tlv(0x82, resp)), swSuccess
+	}
+	return nil, swIncorrectData
+}
+
+func managementCipher(alg byte, key []byte) (cipher.Block, error) {
+	if alg == alg3DES {
+		return des.NewTripleDESCipher(key)
+	}
+	return aes.NewCipher(key)
+}
+
+func (c *Card) setManagementKey(cmd command) ([]byte, uint16) {
+	if !c.mgmtAuthed {
+		return nil, swSecurityStatus
+	}
+	if cmd.p1 != 0xff || (cmd.p2 != 0xff && cmd.p2 != 0xfe) {
+		return nil, swIncorrectParams
+	}
+	d := cmd.data
+	if len(d) < 3 || d[1] != keyCardManagement || int(d[2]) != len(d)-3 {
+		return nil, swIncorrectData
+	}
+	alg, key := d[0], d[3:]
+	n, ok := managementKeyLengths[alg]
+	if !ok || (alg != alg3DES && !c.atLeast(5, 4)) {
+		return nil, swIncorrectData
+	}
+	if len(key) != n {
+		return nil, swIncorrectData
+	}
+	c.mgmtAlg = alg
+	c.mgmtKey = append([]byte(nil), key...)
+	c.mgmtTouch = touchPolicyNever
+	if cmd.p2 == 0xfe {
+		c.mgmtTouch = touchPolicyAlways
+	}
+	return nil, swSuccess
+}
+
+// parseObjectID decodes the tag of a data object, as sent in a tag list.
+func parseObjectID(b []byte) (uint32, bool) {
+	if len(b) == 0 || len(b) > 3 {
+		return 0, false
+	}
+	var obj uint32
+	for _, c := range b {
+		obj = obj<<8 | uint32(c)
+	}
+	return obj, true
+}
+
+func (c *Card) getData(cmd command) ([]byte, uint16) {
+	if cmd.p1 != 0x3f || cmd.p2 != 0xff {
+		return nil, swIncorrectParams
+	}
+	tag, v, _, err := parseTLV(cmd.data)
+	if err != nil || tag != 0x5c {
+		return nil, swIncorrectData
+	}
+	obj, ok := parseObjectID(v)
+	if !ok {
+		return nil, swIncorrectData
+	}
+	if obj == objPrintedInfo && !c.pinVerified {
+		return nil, swSecurityStatus
+	}
+	value, ok := c.objects[obj]
+	if !ok {
+		return nil, swNotFound
+	}
+	switch obj {
+	case objDiscovery, objBiometric:
+		// These objects are returned under their own tag.
+		return tlv(uint16(obj), value), swSuccess
+	}
+	return tlv(0x53, value), swSuccess
+}
+
+func (c *Card) putData(cmd command) ([]byte, uint16) {
+	if !c.mgmtAuthed {
+		return nil, swSecurityStatus
+	}
+	if cmd.p1 != 0x3f || cmd.p2 != 0xff {
+		return nil, swIncorrectParams
+	}
+	tag, v, rest, err := parseTLV(cmd.data)
+	if err != nil {
+		return nil, swIncorrectData
+	}
+	var (
+		obj   uint32
+		value []byte
+	)
+	switch tag {
+	case objDiscovery, objBiometric:
+		// These objects are written directly, without a tag list.
+		obj, value = tag, v
+	case 0x5c:
+		var ok bool
+		if obj, ok = parseObjectID(v); !ok {
+			return nil, swIncorrectData
+		}
+		tag, value, rest, err = parseTLV(rest)
+		if err != nil || tag != 0x53 {
+			return nil, swIncorrectData
+		}
+	default:
+		return nil, swIncorrectData
+	}
+	if len(rest) != 0 {
+		return nil, swIncorrectData
+	}
+	if len(value) == 0 {
+		delete(c.objects, obj)
+		return nil, swSuccess
+	}
+	c.objects[obj] = append([]byte(nil), value...)
+	return nil, swSuccess
+}
+
+func (c *Card) metadata(slot byte) ([]byte, uint16) {
+	var b []byte
+	switch slot {
+	case keyPIN, keyPUK:
+		cred := c.pin
+		if slot == keyPUK {
+			cred = c.puk
+		}
+		b = append(b, tlv(0x01, []byte{0xff})...)
+		b = append(b, tlv(0x05, []byte{boolByte(cred.isDefault())})...)
+		b = append(b, tlv(0x06, []byte{byte(cred.retries), byte(cred.remaining)})...)
+		return b, swSuccess
+	case keyCardManagement:
+		isDefault := string(c.mgmtKey) == string(defaultManagementKey)
+		b = append(b, tlv(0x01, []byte{c.mgmtAlg})...)
+		b = append(b, tlv(0x02, []byte{0x00, c.mgmtTouch})...)
+		b = append(b, tlv(0x05, []byte{boolByte(isDefault)})...)
+		return b, swSuccess
+	}
+
+	k, ok := c.keys[slot]
+	if slot == keyAttestation {
+		k, ok = c.attestKey, true
+	}
+	if !ok {
+		return nil, swNotFound
+	}
+	b = append(b, tlv(0x01, []byte{k.alg})...)
+	b = append(b, tlv(0x02, []byte{k.pinPolicy, k.touchPolicy})...)
+	b = append(b, tlv(0x03, []byte{k.origin})...)
+	b = append(b, tlv(0x04, k.encodePublic())...)
+	return b, swSuccess
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 0x01
+	}
+	return 0x00
+}
+
+func (c *Card) serialBytes() []byte {
+	return []byte{byte(c.serial >> 24), byte(c.serial >> 16), byte(c.serial >> 8), byte(c.serial)}
+}
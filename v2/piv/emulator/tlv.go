@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package emulator
+
+import "errors"
+
+var errInvalidTLV = errors.New("invalid tlv")
+
+// tlv encodes a BER-TLV with a one or two byte tag.
+func tlv(tag uint16, value []byte) []byte {
+	var b []byte
+	if tag > 0xff {
+		b = append(b, byte(tag>>8))
+	}
+	b = append(b, byte(tag))
+	n := len(value)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+// parseTLV decodes the first BER-TLV of b, returning its tag, value, and the
+// remaining bytes. Tags of up to three bytes are supported.
+func parseTLV(b []byte) (tag uint32, value, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errInvalidTLV
+	}
+	tag = uint32(b[0])
+	i := 1
+	if b[0]&0x1f == 0x1f {
+		// Subsequent tag bytes have their high bit set, except the last.
+		for {
+			if i >= len(b) || i > 2 {
+				return 0, nil, nil, errInvalidTLV
+			}
+			tag = tag<<8 | uint32(b[i])
+			i++
+			if b[i-1]&0x80 == 0 {
+				break
+			}
+		}
+	}
+	if i >= len(b) {
+		return 0, nil, nil, errInvalidTLV
+	}
+	n := int(b[i])
+	i++
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || i+size > len(b) {
+			return 0, nil, nil, errInvalidTLV
+		}
+		n = 0
+		for _, c := range b[i : i+size] {
+			n = n<<8 | int(c)
+		}
+		i += size
+	}
+	if i+n > len(b) {
+		return 0, nil, nil, errInvalidTLV
+	}
+	return tag, b[i : i+n], b[i+n:], nil
+}
+
+// parseTLVs decodes a sequence of BER-TLVs into a map from tag to value.
+func parseTLVs(b []byte) (map[uint32][]byte, error) {
+	m := make(map[uint32][]byte)
+	for len(b) > 0 {
+		tag, v, rest, err := parseTLV(b)
+		if err != nil {
+			return nil, err
+		}
+		m[tag] = v
+		b = rest
+	}
+	return m, nil
+}
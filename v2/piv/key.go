@@ -16,6 +16,7 @@ package piv
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdh"
 	"crypto/ecdsa"
@@ -32,6 +33,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	rsafork "github.com/go-piv/piv-go/v2/third_party/rsa"
 )
@@ -568,12 +570,23 @@ func (yk *YubiKey) AttestationCertificate() (*x509.Certificate, error) {
 //
 // If the slot doesn't have a key, the returned error wraps ErrNotFound.
 func (yk *YubiKey) Attest(slot Slot) (*x509.Certificate, error) {
-	cert, err := ykAttest(yk.tx, slot)
+	return yk.AttestContext(context.Background(), slot)
+}
+
+// AttestContext is like Attest, but stops waiting for the card when ctx is
+// done. The returned error then wraps ErrCancelled and ctx.Err(). The command
+// already sent to the card isn't aborted, see ErrCancelled.
+func (yk *YubiKey) AttestContext(ctx context.Context, slot Slot) (*x509.Certificate, error) {
+	var cert *x509.Certificate
+	err := yk.withContext(ctx, "Attest", func(tx *scTx) (err error) {
+		cert, err = ykAttest(tx, slot)
+		return err
+	})
 	if err == nil {
 		return cert, nil
 	}
-	var e *apduErr
-	if errors.As(err, &e) && e.sw1 == 0x6A && e.sw2 == 0x80 {
+	var e *APDUError
+	if errors.As(err, &e) && e.Status() == 0x6a80 {
 		return nil, ErrNotFound
 	}
 	return nil, err
@@ -677,7 +690,11 @@ func (yk *YubiKey) KeyInfo(slot Slot) (KeyInfo, error) {
 		param1:      0x00,
 		param2:      byte(slot.Key),
 	}
-	resp, err := yk.tx.Transmit(cmd)
+	var resp []byte
+	err := yk.with("KeyInfo", func(tx *scTx) (err error) {
+		resp, err = tx.Transmit(cmd)
+		return err
+	})
 	if err != nil {
 		return KeyInfo{}, fmt.Errorf("command failed: %w", err)
 	}
@@ -693,26 +710,13 @@ func (yk *YubiKey) KeyInfo(slot Slot) (KeyInfo, error) {
 // If a certificate hasn't been set in the provided slot, the returned error
 // wraps ErrNotFound.
 func (yk *YubiKey) Certificate(slot Slot) (*x509.Certificate, error) {
-	cmd := apdu{
-		instruction: insGetData,
-		param1:      0x3f,
-		param2:      0xff,
-		data: []byte{
-			0x5c, // Tag list
-			0x03, // Length of tag
-			byte(slot.Object >> 16),
-			byte(slot.Object >> 8),
-			byte(slot.Object),
-		},
-	}
-	resp, err := yk.tx.Transmit(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("command failed: %w", err)
-	}
-	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=85
-	obj, _, err := unmarshalASN1(resp, 1, 0x13) // tag 0x53
+	var obj []byte
+	err := yk.with("Certificate", func(tx *scTx) (err error) {
+		obj, err = ykGetData(tx, slot.Object)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unmarshaling response: %v", err)
+		return nil, err
 	}
 	certDER, _, err := unmarshalASN1(obj, 1, 0x10) // tag 0x70
 	if err != nil {
@@ -752,10 +756,12 @@ func marshalASN1(tag byte, data []byte) []byte {
 // certificate isn't required to use the associated key for signing or
 // decryption.
 func (yk *YubiKey) SetCertificate(key []byte, slot Slot, cert *x509.Certificate) error {
-	if err := ykAuthenticate(yk.tx, key, yk.rand, yk.version); err != nil {
-		return fmt.Errorf("authenticating with management key: %w", err)
-	}
-	return ykStoreCertificate(yk.tx, slot, cert)
+	return yk.with("SetCertificate", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykStoreCertificate(tx, slot, cert)
+	})
 }
 
 func ykStoreCertificate(tx *scTx, slot Slot, cert *x509.Certificate) error {
@@ -765,22 +771,21 @@ func ykStoreCertificate(tx *scTx, slot Slot, cert *x509.Certificate) error {
 	data = append(data, marshalASN1(0x71, []byte{0x00})...)
 	// Error Detection Code
 	data = append(data, marshalASN1(0xfe, nil)...)
-	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=94
-	data = append([]byte{
-		0x5c, // Tag list
-		0x03, // Length of tag
-		byte(slot.Object >> 16),
-		byte(slot.Object >> 8),
-		byte(slot.Object),
-	}, marshalASN1(0x53, data)...)
+	return ykPutData(tx, slot.Object, data)
+}
+
+// ykMoveKey moves the private key in one slot to another. It's only supported
+// by YubiKeys with a version >= 5.7.0.
+//
+// https://docs.yubico.com/yesdk/users-manual/application-piv/commands.html#move-key
+func ykMoveKey(tx *scTx, from, to Slot) error {
 	cmd := apdu{
-		instruction: insPutData,
-		param1:      0x3f,
-		param2:      0xff,
-		data:        data,
+		instruction: insMoveKey,
+		param1:      byte(to.Key),
+		param2:      byte(from.Key),
 	}
 	if _, err := tx.Transmit(cmd); err != nil {
-		return fmt.Errorf("command failed: %v", err)
+		return fmt.Errorf("command failed: %w", err)
 	}
 	return nil
 }
@@ -806,10 +811,24 @@ type Key struct {
 // GenerateKey generates an asymmetric key on the card, returning the key's
 // public key.
 func (yk *YubiKey) GenerateKey(key []byte, slot Slot, opts Key) (crypto.PublicKey, error) {
-	if err := ykAuthenticate(yk.tx, key, yk.rand, yk.version); err != nil {
-		return nil, fmt.Errorf("authenticating with management key: %w", err)
-	}
-	return ykGenerateKey(yk.tx, slot, opts)
+	return yk.GenerateKeyContext(context.Background(), key, slot, opts)
+}
+
+// GenerateKeyContext is like GenerateKey, but stops waiting for the card when
+// ctx is done. The returned error then wraps ErrCancelled and ctx.Err().
+//
+// Key generation already sent to the card isn't aborted, see ErrCancelled, so
+// a key may still be generated in the slot after GenerateKeyContext returns.
+func (yk *YubiKey) GenerateKeyContext(ctx context.Context, key []byte, slot Slot, opts Key) (crypto.PublicKey, error) {
+	var pub crypto.PublicKey
+	err := yk.withContext(ctx, "GenerateKey", func(tx *scTx) (err error) {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		pub, err = ykGenerateKey(tx, slot, opts)
+		return err
+	})
+	return pub, err
 }
 
 func ykGenerateKey(tx *scTx, slot Slot, o Key) (crypto.PublicKey, error) {
@@ -895,7 +914,15 @@ type KeyAuth struct {
 	// PINPrompt can be used to interactively request the PIN from the user. The
 	// method is only called when needed. For example, if a key specifies
 	// PINPolicyOnce, PINPrompt will only be called once per YubiKey struct.
+	// Connections opened with OpenShared call PINPrompt on every operation
+	// that requires a PIN, unless the YubiKey was opened by a Client with a
+	// PINCache.
 	PINPrompt func() (pin string, err error)
+	// PINPad, if set, asks the user to enter the PIN on the PIN pad of the
+	// reader when needed, so the PIN never reaches the host. PIN and PINPrompt
+	// are ignored. If the reader doesn't have a PIN pad, operations return an
+	// error wrapping ErrNoPINPad.
+	PINPad bool
 
 	// PINPolicy can be used to specify the PIN caching strategy for the slot. If
 	// not provided, this will be inferred from the attestation certificate.
@@ -905,7 +932,7 @@ type KeyAuth struct {
 	PINPolicy PINPolicy
 }
 
-func (k KeyAuth) authTx(yk *YubiKey, pp PINPolicy) error {
+func (k KeyAuth) authTx(yk *YubiKey, tx *scTx, pp PINPolicy) error {
 	// PINPolicyNever shouldn't require a PIN.
 	if pp == PINPolicyNever {
 		return nil
@@ -914,29 +941,85 @@ func (k KeyAuth) authTx(yk *YubiKey, pp PINPolicy) error {
 	// PINPolicyAlways should always prompt a PIN even if the key says that
 	// login isn't needed.
 	// https://github.com/go-piv/piv-go/issues/49
-	if pp != PINPolicyAlways && !ykLoginNeeded(yk.tx) {
+	if pp != PINPolicyAlways && !ykLoginNeeded(tx) {
 		return nil
 	}
 
+	if k.PINPad {
+		return ykLoginPINPad(tx)
+	}
 	pin := k.PIN
+	prompted := false
 	if pin == "" && k.PINPrompt != nil {
-		p, err := k.PINPrompt()
-		if err != nil {
-			return fmt.Errorf("pin prompt: %v", err)
+		if p, ok := yk.cachedPIN(); ok {
+			pin = p
+		} else {
+			p, err := k.PINPrompt()
+			if err != nil {
+				return fmt.Errorf("pin prompt: %v", err)
+			}
+			pin = p
+			prompted = true
 		}
-		pin = p
 	}
 	if pin == "" {
 		return fmt.Errorf("pin required but wasn't provided")
 	}
-	return ykLogin(yk.tx, pin)
+	if err := ykLogin(tx, pin); err != nil {
+		if errors.As(err, new(AuthErr)) {
+			yk.cachePIN("")
+		}
+		return err
+	}
+	if prompted {
+		yk.cachePIN(pin)
+	}
+	return nil
 }
 
-func (k KeyAuth) do(yk *YubiKey, pp PINPolicy, f func(tx *scTx) ([]byte, error)) ([]byte, error) {
-	if err := k.authTx(yk, pp); err != nil {
-		return nil, err
+// cachedPIN returns the PIN cached from an earlier prompt, if any. The caller
+// must hold yk.mu.
+func (yk *YubiKey) cachedPIN() (string, bool) {
+	if yk.pin == "" {
+		return "", false
+	}
+	if !yk.pinExpires.IsZero() && time.Now().After(yk.pinExpires) {
+		yk.pin = ""
+		return "", false
 	}
-	return f(yk.tx)
+	return yk.pin, true
+}
+
+// cachePIN remembers a prompted PIN according to the PIN cache policy, or
+// forgets the cached PIN if pin is empty. The caller must hold yk.mu.
+func (yk *YubiKey) cachePIN(pin string) {
+	if yk.pinCache == 0 || pin == "" {
+		yk.pin = ""
+		return
+	}
+	yk.pin = pin
+	yk.pinExpires = time.Time{}
+	if yk.pinCache > 0 {
+		yk.pinExpires = time.Now().Add(yk.pinCache)
+	}
+}
+
+func (k KeyAuth) do(ctx context.Context, name string, yk *YubiKey, pp PINPolicy, f func(tx *scTx) ([]byte, error)) ([]byte, error) {
+	var resp []byte
+	op := func(tx *scTx) (err error) {
+		if err := k.authTx(yk, tx, pp); err != nil {
+			return err
+		}
+		resp, err = f(tx)
+		return err
+	}
+	err := yk.withContext(ctx, name, op)
+	if errors.Is(err, ErrCardReset) {
+		// The connection was re-established, but the PIN must be verified
+		// again.
+		err = yk.withContext(ctx, name, op)
+	}
+	return resp, err
 }
 
 func pinPolicy(yk *YubiKey, slot Slot) (PINPolicy, error) {
@@ -949,8 +1032,7 @@ func pinPolicy(yk *YubiKey, slot Slot) (PINPolicy, error) {
 	}
 	cert, err := yk.Attest(slot)
 	if err != nil {
-		var e *apduErr
-		if errors.As(err, &e) && e.sw1 == 0x6d && e.sw2 == 0x00 {
+		if errors.Is(err, ErrInstructionNotSupported) {
 			// Attestation cert command not supported, probably an older YubiKey.
 			// Guess PINPolicyAlways.
 			//
@@ -971,7 +1053,12 @@ func pinPolicy(yk *YubiKey, slot Slot) (PINPolicy, error) {
 
 // PrivateKey is used to access signing and decryption options for the key
 // stored in the slot. The returned key implements crypto.Signer and/or
-// crypto.Decrypter depending on the key type.
+// crypto.Decrypter depending on the key type, as well as ContextSigner and
+// ContextDecrypter.
+//
+// The returned key is safe for concurrent use. Operations are queued behind
+// other operations on the YubiKey, and the PIN is verified within the same
+// transaction as the operation that requires it.
 //
 // If the public key hasn't been stored externally, it can be provided by
 // fetching the slot's attestation certificate:
@@ -987,7 +1074,7 @@ func (yk *YubiKey) PrivateKey(slot Slot, public crypto.PublicKey, auth KeyAuth)
 		// If the PIN policy is manually specified, trust that value instead of
 		// trying to use the attestation certificate.
 		pp = auth.PINPolicy
-	} else if auth.PIN != "" || auth.PINPrompt != nil {
+	} else if auth.PIN != "" || auth.PINPrompt != nil || auth.PINPad {
 		// Attempt to determine the key's PIN policy. This helps inform the
 		// strategy for when to prompt for a PIN.
 		policy, err := pinPolicy(yk, slot)
@@ -1115,11 +1202,12 @@ func (yk *YubiKey) SetPrivateKeyInsecure(key []byte, slot Slot, private crypto.P
 		tags = append(tags, param...)
 	}
 
-	if err := ykAuthenticate(yk.tx, key, yk.rand, yk.version); err != nil {
-		return fmt.Errorf("authenticating with management key: %w", err)
-	}
-
-	return ykImportKey(yk.tx, tags, slot, policy)
+	return yk.with("SetPrivateKeyInsecure", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykImportKey(tx, tags, slot, policy)
+	})
 }
 
 func ykImportKey(tx *scTx, tags []byte, slot Slot, o Key) error {
@@ -1155,6 +1243,36 @@ func ykImportKey(tx *scTx, tags []byte, slot Slot, o Key) error {
 	return nil
 }
 
+// ContextSigner is implemented by keys returned by YubiKey.PrivateKey that
+// sign, allowing callers to bound how long to wait for the card, for example
+// while the user is asked to touch the YubiKey.
+//
+// If ctx is done before the card responds, SignContext returns an error wrapping
+// ErrCancelled and ctx.Err(). A signature already requested from the card,
+// for example one waiting for touch, isn't aborted, see ErrCancelled.
+type ContextSigner interface {
+	crypto.Signer
+	SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// ContextDecrypter is implemented by keys returned by YubiKey.PrivateKey that
+// decrypt, allowing callers to bound how long to wait for the card.
+//
+// If ctx is done before the card responds, DecryptContext returns an error
+// wrapping ErrCancelled and ctx.Err(). A decryption already requested from the
+// card isn't aborted, see ErrCancelled.
+type ContextDecrypter interface {
+	crypto.Decrypter
+	DecryptContext(ctx context.Context, rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error)
+}
+
+var (
+	_ ContextSigner    = (*ECDSAPrivateKey)(nil)
+	_ ContextSigner    = (*keyEd25519)(nil)
+	_ ContextSigner    = (*keyRSA)(nil)
+	_ ContextDecrypter = (*keyRSA)(nil)
+)
+
 // ECDSAPrivateKey is a crypto.PrivateKey implementation for ECDSA
 // keys. It implements crypto.Signer and the method SharedKey performs
 // Diffie-Hellman key agreements.
@@ -1178,7 +1296,12 @@ var _ crypto.Signer = (*ECDSAPrivateKey)(nil)
 
 // Sign implements crypto.Signer.
 func (k *ECDSAPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.SignContext(context.Background(), rand, digest, opts)
+}
+
+// SignContext implements ContextSigner.
+func (k *ECDSAPrivateKey) SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.auth.do(ctx, "Sign", k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykSignECDSA(tx, k.slot, k.pub, digest)
 	})
 }
@@ -1210,6 +1333,13 @@ func (k *ECDSAPrivateKey) SharedKey(peer *ecdsa.PublicKey) ([]byte, error) {
 // used for the operation. Callers should use a cryptographic key
 // derivation function to extract the amount of bytes they need.
 func (k *ECDSAPrivateKey) ECDH(peer *ecdh.PublicKey) ([]byte, error) {
+	return k.ECDHContext(context.Background(), peer)
+}
+
+// ECDHContext is like ECDH, but stops waiting for the card when ctx is done.
+// The returned error then wraps ErrCancelled and ctx.Err(). The command
+// already sent to the card isn't aborted, see ErrCancelled.
+func (k *ECDSAPrivateKey) ECDHContext(ctx context.Context, peer *ecdh.PublicKey) ([]byte, error) {
 	ourECDH, err := k.pub.ECDH()
 	if err != nil {
 		return nil, unsupportedCurveError{curve: k.pub.Params().BitSize}
@@ -1218,7 +1348,7 @@ func (k *ECDSAPrivateKey) ECDH(peer *ecdh.PublicKey) ([]byte, error) {
 		return nil, errMismatchingAlgorithms
 	}
 	msg := peer.Bytes()
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.auth.do(ctx, "ECDH", k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		var alg byte
 		size := k.pub.Params().BitSize
 		switch size {
@@ -1278,7 +1408,14 @@ func (k *X25519PrivateKey) Public() crypto.PublicKey {
 // Peer's public key must use the same algorithm as the key in this slot, or an
 // error will be returned.
 func (k *X25519PrivateKey) ECDH(peer *ecdh.PublicKey) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.ECDHContext(context.Background(), peer)
+}
+
+// ECDHContext is like ECDH, but stops waiting for the card when ctx is done.
+// The returned error then wraps ErrCancelled and ctx.Err(). The command
+// already sent to the card isn't aborted, see ErrCancelled.
+func (k *X25519PrivateKey) ECDHContext(ctx context.Context, peer *ecdh.PublicKey) ([]byte, error) {
+	return k.auth.do(ctx, "ECDH", k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykECDHX25519(tx, k.slot, k.pub, peer)
 	})
 }
@@ -1296,7 +1433,11 @@ func (k *keyEd25519) Public() crypto.PublicKey {
 }
 
 func (k *keyEd25519) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.SignContext(context.Background(), rand, message, opts)
+}
+
+func (k *keyEd25519) SignContext(ctx context.Context, rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.auth.do(ctx, "Sign", k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykSignEd25519(tx, k.slot, k.pub, message, opts)
 	})
 }
@@ -1314,13 +1455,21 @@ func (k *keyRSA) Public() crypto.PublicKey {
 }
 
 func (k *keyRSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.SignContext(context.Background(), rand, digest, opts)
+}
+
+func (k *keyRSA) SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.auth.do(ctx, "Sign", k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykSignRSA(tx, rand, k.slot, k.pub, digest, opts)
 	})
 }
 
 func (k *keyRSA) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
-	return k.auth.do(k.yk, k.pp, func(tx *scTx) ([]byte, error) {
+	return k.DecryptContext(context.Background(), rand, msg, opts)
+}
+
+func (k *keyRSA) DecryptContext(ctx context.Context, rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.auth.do(ctx, "Decrypt", k.yk, k.pp, func(tx *scTx) ([]byte, error) {
 		return ykDecryptRSA(tx, k.slot, k.pub, msg)
 	})
 }
@@ -790,7 +790,8 @@ func TestYubiKeyAttestation(t *testing.T) {
 	if err != nil {
 		t.Fatalf("attesting key: %v", err)
 	}
-	a, err := Verify(cert, c)
+	v := Verifier{Roots: testAttestationRoots(yk)}
+	a, err := v.Verify(cert, c)
 	if err != nil {
 		t.Fatalf("failed to verify attestation: %v", err)
 	}
@@ -0,0 +1,238 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeyHistory is the Key History data object, which records how many retired
+// key management keys a card holds, so relying parties can find the keys to
+// decrypt data encrypted to previous certificates.
+//
+// Retired keys occupy the retired key management slots in order, starting at
+// slot 0x82: first the keys whose certificates are stored on the card, then
+// the keys whose certificates are only available at OffCardCertURL.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=47
+type KeyHistory struct {
+	// KeysWithOnCardCerts is the number of retired keys whose certificates
+	// are stored on the card.
+	KeysWithOnCardCerts int
+	// KeysWithOffCardCerts is the number of retired keys whose certificates
+	// aren't stored on the card.
+	KeysWithOffCardCerts int
+	// OffCardCertURL is the URL of the certificates not stored on the card,
+	// required if KeysWithOffCardCerts isn't zero.
+	OffCardCertURL string
+}
+
+// Key History tags.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=47
+const (
+	tagKeyHistoryOnCardCerts    = 0xc1
+	tagKeyHistoryOffCardCerts   = 0xc2
+	tagKeyHistoryOffCardCertURL = 0xf3
+)
+
+// ParseKeyHistory decodes a Key History object, as stored in the
+// ObjectKeyHistory data object.
+func ParseKeyHistory(b []byte) (*KeyHistory, error) {
+	elems, err := parseObjectElements(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key history: %v", err)
+	}
+	h := &KeyHistory{}
+	for _, e := range elems {
+		switch e.tag {
+		case tagKeyHistoryOnCardCerts, tagKeyHistoryOffCardCerts:
+			if len(e.value) != 1 {
+				return nil, fmt.Errorf("invalid length of key history element 0x%x: %d", e.tag, len(e.value))
+			}
+			if e.tag == tagKeyHistoryOnCardCerts {
+				h.KeysWithOnCardCerts = int(e.value[0])
+			} else {
+				h.KeysWithOffCardCerts = int(e.value[0])
+			}
+		case tagKeyHistoryOffCardCertURL:
+			h.OffCardCertURL = string(e.value)
+		}
+	}
+	return h, nil
+}
+
+// Marshal encodes the Key History object, to be stored in the ObjectKeyHistory
+// data object.
+func (h *KeyHistory) Marshal() ([]byte, error) {
+	if h.KeysWithOnCardCerts < 0 || h.KeysWithOffCardCerts < 0 ||
+		h.KeysWithOnCardCerts+h.KeysWithOffCardCerts > len(retiredKeyManagementSlots) {
+		return nil, fmt.Errorf("invalid number of retired keys: %d with on-card certificates, %d with off-card certificates",
+			h.KeysWithOnCardCerts, h.KeysWithOffCardCerts)
+	}
+	if h.KeysWithOffCardCerts > 0 && h.OffCardCertURL == "" {
+		return nil, errors.New("off-card certificate url required for keys with off-card certificates")
+	}
+	b := marshalASN1(tagKeyHistoryOnCardCerts, []byte{byte(h.KeysWithOnCardCerts)})
+	b = append(b, marshalASN1(tagKeyHistoryOffCardCerts, []byte{byte(h.KeysWithOffCardCerts)})...)
+	if h.OffCardCertURL != "" {
+		b = append(b, marshalASN1(tagKeyHistoryOffCardCertURL, []byte(h.OffCardCertURL))...)
+	}
+	return append(b, marshalASN1(tagErrorDetectionCode, nil)...), nil
+}
+
+// RetiredSlots returns the retired key management slots holding the keys
+// recorded in the history, starting with the keys with on-card certificates.
+func (h *KeyHistory) RetiredSlots() []Slot {
+	var slots []Slot
+	for i := 0; i < h.KeysWithOnCardCerts+h.KeysWithOffCardCerts; i++ {
+		slot, ok := RetiredKeyManagementSlot(0x82 + uint32(i))
+		if !ok {
+			break
+		}
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+// KeyHistory reads the Key History object from the card.
+//
+// If the card has no Key History object, the returned error wraps
+// ErrNotFound.
+func (yk *YubiKey) KeyHistory() (*KeyHistory, error) {
+	var h *KeyHistory
+	err := yk.with("KeyHistory", func(tx *scTx) (err error) {
+		h, err = ykKeyHistory(tx)
+		return err
+	})
+	return h, err
+}
+
+// SetKeyHistory stores the Key History object on the card, which requires
+// authenticating with the management key.
+func (yk *YubiKey) SetKeyHistory(key []byte, h *KeyHistory) error {
+	b, err := h.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding key history: %w", err)
+	}
+	return yk.with("SetKeyHistory", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykPutData(tx, ObjectKeyHistory, b)
+	})
+}
+
+// RetireKeyManagementKey archives the key and certificate in SlotKeyManagement
+// to the next free retired key management slot, and records it in the Key
+// History object. The retired key can still decrypt data encrypted to the old
+// certificate, such as S/MIME mail, after a new key is generated in
+// SlotKeyManagement. It returns the slot now holding the retired key.
+//
+// Moving keys between slots is only supported by YubiKeys with a version >=
+// 5.7.0. The certificate of SlotKeyManagement is deleted once archived.
+func (yk *YubiKey) RetireKeyManagementKey(key []byte) (Slot, error) {
+	if !supportsVersion(yk.version, 5, 7, 0) {
+		return Slot{}, fmt.Errorf("moving keys requires yubikey version 5.7.0 or later, got %d.%d.%d",
+			yk.version.major, yk.version.minor, yk.version.patch)
+	}
+	var slot Slot
+	err := yk.with("RetireKeyManagementKey", func(tx *scTx) (err error) {
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		slot, err = ykRetireKeyManagementKey(tx)
+		return err
+	})
+	return slot, err
+}
+
+func ykKeyHistory(tx *scTx) (*KeyHistory, error) {
+	b, err := ykGetData(tx, ObjectKeyHistory)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyHistory(b)
+}
+
+// ykRetireKeyManagementKey writes the retired certificate and the key history
+// before moving the key, so a failure part way leaves the key in
+// SlotKeyManagement and the earlier writes are rolled back. The certificate of
+// SlotKeyManagement is only deleted once the key has moved.
+func ykRetireKeyManagementKey(tx *scTx) (Slot, error) {
+	oldHistory, err := ykGetData(tx, ObjectKeyHistory)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Slot{}, fmt.Errorf("reading key history: %w", err)
+	}
+	h := &KeyHistory{}
+	if oldHistory != nil {
+		if h, err = ParseKeyHistory(oldHistory); err != nil {
+			return Slot{}, fmt.Errorf("reading key history: %w", err)
+		}
+	}
+	// Keys with on-card certificates must precede keys with off-card
+	// certificates, leaving no room for another key once the latter are used.
+	if h.KeysWithOffCardCerts > 0 {
+		return Slot{}, errors.New("can't retire key after keys with off-card certificates")
+	}
+	slot, ok := RetiredKeyManagementSlot(0x82 + uint32(h.KeysWithOnCardCerts))
+	if !ok {
+		return Slot{}, errors.New("no free retired key management slot")
+	}
+
+	cert, err := ykGetData(tx, SlotKeyManagement.Object)
+	if err != nil {
+		return Slot{}, fmt.Errorf("reading key management certificate: %w", err)
+	}
+	// Don't overwrite keys not recorded in the key history.
+	_, err = tx.Transmit(apdu{instruction: insGetMetadata, param2: byte(slot.Key)})
+	if err == nil {
+		return Slot{}, fmt.Errorf("retired slot %s already holds a key", slot)
+	} else if !errors.Is(err, ErrNotFound) {
+		return Slot{}, fmt.Errorf("reading metadata of slot %s: %w", slot, err)
+	}
+
+	h.KeysWithOnCardCerts++
+	b, err := h.Marshal()
+	if err != nil {
+		return Slot{}, fmt.Errorf("encoding key history: %w", err)
+	}
+	if err := ykPutData(tx, slot.Object, cert); err != nil {
+		return Slot{}, fmt.Errorf("storing certificate in slot %s: %w", slot, err)
+	}
+	if err := ykPutData(tx, ObjectKeyHistory, b); err != nil {
+		err = fmt.Errorf("storing key history: %w", err)
+		if rerr := ykPutData(tx, slot.Object, nil); rerr != nil {
+			return Slot{}, fmt.Errorf("%w; deleting certificate in slot %s: %w", err, slot, rerr)
+		}
+		return Slot{}, err
+	}
+	if err := ykMoveKey(tx, SlotKeyManagement, slot); err != nil {
+		err = fmt.Errorf("moving key to slot %s: %w", slot, err)
+		// Writing nil deletes the key history if there was none.
+		if rerr := ykPutData(tx, ObjectKeyHistory, oldHistory); rerr != nil {
+			return Slot{}, fmt.Errorf("%w; restoring key history: %w", err, rerr)
+		}
+		if rerr := ykPutData(tx, slot.Object, nil); rerr != nil {
+			return Slot{}, fmt.Errorf("%w; deleting certificate in slot %s: %w", err, slot, rerr)
+		}
+		return Slot{}, err
+	}
+	if err := ykPutData(tx, SlotKeyManagement.Object, nil); err != nil {
+		return Slot{}, fmt.Errorf("deleting key management certificate: %w", err)
+	}
+	return slot, nil
+}
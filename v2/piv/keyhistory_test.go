@@ -0,0 +1,240 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv/emulator"
+)
+
+func TestKeyHistoryMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       KeyHistory
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "OnCard",
+			h:    KeyHistory{KeysWithOnCardCerts: 2},
+			want: "c10102c20100fe00",
+		},
+		{
+			name: "OffCard",
+			h:    KeyHistory{KeysWithOnCardCerts: 1, KeysWithOffCardCerts: 1, OffCardCertURL: "http://example.com/certs"},
+			want: "c10101c20101f318687474703a2f2f6578616d706c652e636f6d2f6365727473fe00",
+		},
+		{
+			name:    "MissingURL",
+			h:       KeyHistory{KeysWithOffCardCerts: 1},
+			wantErr: true,
+		},
+		{
+			name:    "TooManyKeys",
+			h:       KeyHistory{KeysWithOnCardCerts: 15, KeysWithOffCardCerts: 6, OffCardCertURL: "http://example.com"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.h.Marshal()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("marshaling key history returned error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if got := hex.EncodeToString(b); got != test.want {
+				t.Errorf("marshaled key history got=%s, want=%s", got, test.want)
+			}
+			h, err := ParseKeyHistory(b)
+			if err != nil {
+				t.Fatalf("parsing key history: %v", err)
+			}
+			if *h != test.h {
+				t.Errorf("parsed key history got=%+v, want=%+v", *h, test.h)
+			}
+			if got, want := len(h.RetiredSlots()), h.KeysWithOnCardCerts+h.KeysWithOffCardCerts; got != want {
+				t.Errorf("got %d retired slots, want %d", got, want)
+			}
+		})
+	}
+}
+
+// testGenerateKeyManagementKey generates a key in SlotKeyManagement, and stores
+// a certificate for it.
+func testGenerateKeyManagementKey(t *testing.T, yk *YubiKey, ca crypto.Signer) (crypto.PublicKey, *x509.Certificate) {
+	t.Helper()
+	pub, err := yk.GenerateKey(DefaultManagementKey, SlotKeyManagement, Key{
+		Algorithm:   AlgorithmEC256,
+		PINPolicy:   PINPolicyNever,
+		TouchPolicy: TouchPolicyNever,
+	})
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "key management"},
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyAgreement,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, ca)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	if err := yk.SetCertificate(DefaultManagementKey, SlotKeyManagement, cert); err != nil {
+		t.Fatalf("storing certificate: %v", err)
+	}
+	return pub, cert
+}
+
+func TestYubiKeyRetireKeyManagementKey(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	testRequiresVersion(t, yk, version57)
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ca key: %v", err)
+	}
+
+	if _, err := yk.KeyHistory(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting key history after reset returned %v, want ErrNotFound", err)
+	}
+	if _, err := yk.RetireKeyManagementKey(DefaultManagementKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("retiring missing key returned %v, want ErrNotFound", err)
+	}
+
+	for i, wantSlot := range []uint32{0x82, 0x83} {
+		pub, cert := testGenerateKeyManagementKey(t, yk, ca)
+		slot, err := yk.RetireKeyManagementKey(DefaultManagementKey)
+		if err != nil {
+			t.Fatalf("retiring key: %v", err)
+		}
+		if slot.Key != wantSlot {
+			t.Errorf("retired key to slot %s, want %x", slot, wantSlot)
+		}
+
+		h, err := yk.KeyHistory()
+		if err != nil {
+			t.Fatalf("getting key history: %v", err)
+		}
+		if want := (KeyHistory{KeysWithOnCardCerts: i + 1}); *h != want {
+			t.Errorf("key history got=%+v, want=%+v", *h, want)
+		}
+		got, err := yk.Certificate(slot)
+		if err != nil {
+			t.Fatalf("getting retired certificate: %v", err)
+		}
+		if !got.Equal(cert) {
+			t.Errorf("retired certificate doesn't match key management certificate")
+		}
+		if _, err := yk.Certificate(SlotKeyManagement); !errors.Is(err, ErrNotFound) {
+			t.Errorf("getting key management certificate returned %v, want ErrNotFound", err)
+		}
+
+		priv, err := yk.PrivateKey(slot, pub, KeyAuth{})
+		if err != nil {
+			t.Fatalf("getting retired private key: %v", err)
+		}
+		digest := sha256.Sum256([]byte("hello"))
+		sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("signing with retired key: %v", err)
+		}
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+			t.Errorf("signature of retired key didn't verify")
+		}
+	}
+}
+
+// failingTransport is an emulated card that fails commands with the given
+// instruction.
+type failingTransport struct {
+	*emulator.Card
+	ins byte
+}
+
+func (f *failingTransport) Transmit(cmd []byte) ([]byte, error) {
+	if len(cmd) > 1 && cmd[1] == f.ins {
+		return []byte{0x6f, 0x00}, nil // No precise diagnosis
+	}
+	return f.Card.Transmit(cmd)
+}
+
+func TestRetireKeyManagementKeyRollback(t *testing.T) {
+	card, err := emulator.New(emulator.Config{})
+	if err != nil {
+		t.Fatalf("creating emulator: %v", err)
+	}
+	ft := &failingTransport{Card: card}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening emulator: %v", err)
+	}
+	defer yk.Close()
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ca key: %v", err)
+	}
+	_, cert := testGenerateKeyManagementKey(t, yk, ca)
+
+	ft.ins = insMoveKey
+	if _, err := yk.RetireKeyManagementKey(DefaultManagementKey); err == nil {
+		t.Fatalf("expected retiring key to fail")
+	}
+	// The card is left as it was before.
+	if _, err := yk.KeyHistory(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting key history returned %v, want ErrNotFound", err)
+	}
+	slot, _ := RetiredKeyManagementSlot(0x82)
+	if _, err := yk.Certificate(slot); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting retired certificate returned %v, want ErrNotFound", err)
+	}
+	if got, err := yk.Certificate(SlotKeyManagement); err != nil {
+		t.Errorf("getting key management certificate: %v", err)
+	} else if !got.Equal(cert) {
+		t.Errorf("key management certificate changed")
+	}
+
+	ft.ins = 0
+	got, err := yk.RetireKeyManagementKey(DefaultManagementKey)
+	if err != nil {
+		t.Fatalf("retiring key after failure: %v", err)
+	}
+	if got != slot {
+		t.Errorf("retired key to slot %s, want %s", got, slot)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrBusy is returned when an operation can't wait for the card because the
+// maximum number of waiting operations set with SetMaxWaiting was reached.
+var ErrBusy = errors.New("too many operations waiting for the card")
+
+// queueLock is a mutual exclusion lock granted in the order it was requested,
+// so that no caller waits indefinitely while others repeatedly acquire it.
+type queueLock struct {
+	mu   sync.Mutex
+	held bool
+	// waiters holds a channel for each blocked caller, closed to hand the
+	// lock over.
+	waiters []chan struct{}
+	// max bounds the number of waiters, if positive.
+	max int
+}
+
+// lock acquires the lock, waiting behind earlier callers. It returns ErrBusy
+// if too many callers are waiting, or ctx.Err() if ctx is done first.
+func (l *queueLock) lock(ctx context.Context) error {
+	return l.acquire(ctx, true)
+}
+
+// lockUnbounded acquires the lock like lock, but ignores the maximum number
+// of waiters, so it can't fail. It's used to update the connection's state or
+// close it, which must not be refused because the card is busy.
+func (l *queueLock) lockUnbounded() {
+	l.acquire(context.Background(), false)
+}
+
+// acquire implements lock and lockUnbounded.
+func (l *queueLock) acquire(ctx context.Context, bounded bool) error {
+	l.mu.Lock()
+	if !l.held {
+		l.held = true
+		l.mu.Unlock()
+		return nil
+	}
+	if bounded && l.max > 0 && len(l.waiters) >= l.max {
+		l.mu.Unlock()
+		return ErrBusy
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	for i, w := range l.waiters {
+		if w == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.mu.Unlock()
+	// The lock was handed over while ctx was cancelled, pass it on.
+	l.unlock()
+	return ctx.Err()
+}
+
+// unlock releases the lock to the longest waiting caller.
+func (l *queueLock) unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.held = false
+		return
+	}
+	ch := l.waiters[0]
+	l.waiters = l.waiters[1:]
+	close(ch)
+}
+
+// setMax sets the maximum number of waiters, where zero means no limit.
+func (l *queueLock) setMax(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = n
+}
+
+// SetMaxWaiting bounds the number of operations that may wait for the card
+// while another operation is in progress. Further operations fail immediately
+// with an error wrapping ErrBusy. Zero, the default, means no limit.
+//
+// This allows servers sharing one YubiKey between many requests, such as TLS
+// handshakes, to shed load instead of queueing indefinitely.
+func (yk *YubiKey) SetMaxWaiting(n int) {
+	yk.mu.setMax(n)
+}
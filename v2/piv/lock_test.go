@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueLockOrder(t *testing.T) {
+	var l queueLock
+	if err := l.lock(context.Background()); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	const n = 10
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := l.lock(context.Background()); err != nil {
+				t.Errorf("lock: %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			l.unlock()
+		}(i)
+		// Wait for the goroutine to queue before starting the next one.
+		for {
+			l.mu.Lock()
+			queued := len(l.waiters) == i+1
+			l.mu.Unlock()
+			if queued {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.unlock()
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("lock acquired out of order: %v", order)
+		}
+	}
+}
+
+func TestQueueLockMax(t *testing.T) {
+	l := queueLock{max: 1}
+	if err := l.lock(context.Background()); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- l.lock(ctx) }()
+	for {
+		l.mu.Lock()
+		queued := len(l.waiters) == 1
+		l.mu.Unlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := l.lock(context.Background()); !errors.Is(err, ErrBusy) {
+		t.Errorf("lock with full queue: got err=%v, want ErrBusy", err)
+	}
+	// lockUnbounded waits in the queue, even when it's full.
+	locked := make(chan struct{})
+	go func() {
+		l.lockUnbounded()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("lockUnbounded acquired a held lock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled lock: got err=%v, want context.Canceled", err)
+	}
+
+	l.unlock()
+	<-locked
+	l.unlock()
+	if err := l.lock(context.Background()); err != nil {
+		t.Fatalf("lock after cancellation: %v", err)
+	}
+	l.unlock()
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	const n = 8
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+		},
+	}
+	for i := 0; i < 3*n; i++ {
+		ft.resps = append(ft.resps, []byte{0x90, 0x00})
+	}
+	c := Client{ShareMode: ShareShared}
+	yk, err := c.OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Large enough to require command chaining.
+			cmd := Command{Instruction: insPutData, Param1: byte(i), Data: make([]byte, 300)}
+			if _, err := yk.Transmit(cmd); err != nil {
+				t.Errorf("transmit: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Each operation selects the applet, then sends both chunks of its
+	// command without interruption.
+	cmds := ft.cmds[3:]
+	if len(cmds) != 3*n {
+		t.Fatalf("got %d commands, want %d", len(cmds), 3*n)
+	}
+	for i := 0; i < len(cmds); i += 3 {
+		if cmds[i][1] != insSelectApplication {
+			t.Errorf("command %d got=%x, want SELECT", i, cmds[i])
+		}
+		if cmds[i+1][0] != 0x10 || cmds[i+2][0] != 0x00 || cmds[i+1][2] != cmds[i+2][2] {
+			t.Errorf("commands interleaved: %x, %x", cmds[i+1][:5], cmds[i+2][:5])
+		}
+	}
+}
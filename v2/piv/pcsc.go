@@ -15,8 +15,10 @@
 package piv
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 )
 
 type scErr struct {
@@ -24,6 +26,21 @@ type scErr struct {
 	rc int64
 }
 
+// Unwrap retrieves an accessible error type, if able.
+func (e *scErr) Unwrap() error {
+	switch e.rc {
+	case rcCancelled:
+		return ErrCancelled
+	case rcNoSmartCard:
+		return ErrNoSmartCard
+	case rcSharingViolation:
+		return ErrSharingViolation
+	case rcRemovedCard:
+		return ErrCardRemoved
+	}
+	return nil
+}
+
 func (e *scErr) Error() string {
 	if msg, ok := pcscErrMsgs[e.rc]; ok {
 		return msg
@@ -50,33 +67,85 @@ func (v AuthErr) Error() string {
 // ErrNotFound is returned when the requested object on the smart card is not found.
 var ErrNotFound = errors.New("data object or application not found")
 
-// apduErr is an error interacting with the PIV application on the smart card.
-// This error may wrap more accessible errors, like ErrNotFound or an instance
-// of AuthErr, so callers are encouraged to use errors.Is and errors.As for
-// these common cases.
-type apduErr struct {
+// ErrCancelled is returned when an operation is abandoned because its context
+// is done, for example because a signing operation timed out waiting for the
+// user to touch the YubiKey. Errors wrapping ErrCancelled also wrap the
+// context's error, such as context.DeadlineExceeded, unless the PC/SC call was
+// cancelled by another process.
+//
+// Cancelling only stops the caller from waiting. PC/SC can't abort a command
+// once it was sent to the card: pcsc-lite and WinSCard only cancel
+// SCardGetStatusChange, not SCardTransmit. Until the card responds, for
+// example because the YubiKey was touched or its touch timeout expired, the
+// card stays in use and later operations on the same YubiKey wait for it.
+var ErrCancelled = errors.New("operation cancelled")
+
+// ErrCardReset is returned when the connection to the card was lost, for
+// example because another process reset the card or it was briefly
+// disconnected, and has since been re-established. Any PIN or management key
+// authentication was lost, and the operation may be retried after
+// authenticating again.
+var ErrCardReset = errors.New("card was reset, pin and management key authentication lost")
+
+// Errors reported by the card or the PC/SC implementation. Returned errors wrap
+// these sentinels, and callers should check for them using errors.Is.
+var (
+	// ErrSecurityStatusNotSatisfied is returned when the card refuses a
+	// command because the PIN or management key must be verified first, or
+	// the key requires a touch that didn't happen.
+	ErrSecurityStatusNotSatisfied = errors.New("security status not satisfied")
+	// ErrPINBlocked is returned when the PIN is blocked after too many
+	// incorrect attempts. Use the PUK to unblock it.
+	ErrPINBlocked = errors.New("pin blocked")
+	// ErrPUKBlocked is returned when the PUK is blocked after too many
+	// incorrect attempts. The PIV applet can only be reset at that point.
+	ErrPUKBlocked = errors.New("puk blocked")
+	// ErrInstructionNotSupported is returned when the card doesn't support a
+	// command, for example because the YubiKey's firmware is too old.
+	ErrInstructionNotSupported = errors.New("instruction not supported")
+	// ErrNoSmartCard is returned when a reader holds no card.
+	ErrNoSmartCard = errors.New("no smart card present")
+	// ErrSharingViolation is returned when a card can't be accessed because
+	// another process holds a connection to it, such as an exclusive
+	// connection opened by Open.
+	ErrSharingViolation = errors.New("smart card in use by another connection")
+	// ErrCardRemoved is returned when the card was removed from the reader.
+	ErrCardRemoved = errors.New("smart card removed")
+)
+
+// APDUError is an error returned by the PIV application on the smart card, in
+// the form of a status word other than success. It wraps more accessible
+// errors where possible, like ErrNotFound, ErrPINBlocked or an instance of
+// AuthErr, so callers are encouraged to use errors.Is and errors.As for these
+// common cases.
+type APDUError struct {
 	sw1 byte
 	sw2 byte
+	// ins and p2 identify the command that failed, to tell which credential
+	// a status refers to.
+	ins byte
+	p2  byte
 }
 
 // Status returns the Status Word returned by the card command.
-func (a *apduErr) Status() uint16 {
+func (a *APDUError) Status() uint16 {
 	return uint16(a.sw1)<<8 | uint16(a.sw2)
 }
 
-func (a *apduErr) Error() string {
+func (a *APDUError) Error() string {
 	var msg string
-	if u := a.Unwrap(); u != nil {
-		msg = u.Error()
+	if u := a.Unwrap(); len(u) > 0 {
+		msg = u[0].Error()
 	}
 
 	switch a.Status() {
 	// 0x6300 is "verification failed", represented as AuthErr{0}
 	// 0x63Cn is "verification failed" with retry, represented as AuthErr{n}
+	// 0x6d00 is "instruction not supported" aka ErrInstructionNotSupported
 	case 0x6882:
 		msg = "secure messaging not supported"
-	case 0x6982:
-		msg = "security status not satisfied"
+	// 0x6982 is "security status not satisfied" aka
+	// ErrSecurityStatusNotSatisfied
 	case 0x6983:
 		// This will also be AuthErr{0} but we override the message here
 		// so that it's clear that the reason is a block rather than a simple
@@ -105,49 +174,396 @@ func (a *apduErr) Error() string {
 	return fmt.Sprintf("smart card error %04x%s", a.Status(), msg)
 }
 
-// Unwrap retrieves an accessible error type, if able.
-func (a *apduErr) Unwrap() error {
+// Unwrap retrieves accessible error types, if able.
+func (a *APDUError) Unwrap() []error {
 	st := a.Status()
 	switch {
 	case st == 0x6a82:
-		return ErrNotFound
+		return []error{ErrNotFound}
+	case st == 0x6982:
+		return []error{ErrSecurityStatusNotSatisfied}
+	case st == 0x6d00:
+		return []error{ErrInstructionNotSupported}
 	case st == 0x6300:
-		return AuthErr{0}
+		return []error{AuthErr{0}}
 	case st == 0x6983:
-		return AuthErr{0}
+		if err := a.blocked(); err != nil {
+			return []error{AuthErr{0}, err}
+		}
+		return []error{AuthErr{0}}
 	case st&0xfff0 == 0x63c0:
-		return AuthErr{int(st & 0xf)}
+		return []error{AuthErr{int(st & 0xf)}}
 	case st&0xfff0 == 0x6300:
 		// Older YubiKeys sometimes return sw1=0x63 and sw2=0x0N to indicate the
 		// number of retries. This isn't spec compliant, but support it anyway.
 		//
 		// https://github.com/go-piv/piv-go/issues/60
-		return AuthErr{int(st & 0xf)}
+		return []error{AuthErr{int(st & 0xf)}}
+	}
+	return nil
+}
+
+// blocked returns the credential the failed command found to be blocked.
+func (a *APDUError) blocked() error {
+	switch a.ins {
+	case insVerify, insChangeReference:
+		switch a.p2 {
+		case 0x80:
+			return ErrPINBlocked
+		case 0x81:
+			return ErrPUKBlocked
+		}
+	case insResetRetry:
+		// Unblocking the PIN is authenticated by the PUK.
+		return ErrPUKBlocked
+	}
+	return nil
+}
+
+// PC/SC constants that are identical across platforms.
+const (
+	scScopeSystem = 0x0002
+
+	scShareExclusive = 0x0001
+	scShareShared    = 0x0002
+
+	scProtocolT0  = 0x0001
+	scProtocolT1  = 0x0002
+	scProtocolAny = scProtocolT0 | scProtocolT1
+
+	scLeaveCard = 0x0000
+
+	// https://learn.microsoft.com/en-us/windows/win32/api/winscard/ns-winscard-scard_readerstatea
+	scStateUnaware     = 0x0000
+	scStateIgnore      = 0x0001
+	scStateChanged     = 0x0002
+	scStateUnknown     = 0x0004
+	scStateUnavailable = 0x0008
+	scStateEmpty       = 0x0010
+	scStatePresent     = 0x0020
+	scStateExclusive   = 0x0080
+	scStateInUse       = 0x0100
+
+	scMaxBufferSizeExtended = 4 + 3 + (1 << 16) + 3 + 2
+)
+
+// PC/SC return codes that are identical across platforms.
+const (
+	rcCancelled         = 0x80100002
+	rcInvalidHandle     = 0x80100003
+	rcInsufficient      = 0x80100008
+	rcUnknownReader     = 0x80100009
+	rcTimeout           = 0x8010000A
+	rcSharingViolation  = 0x8010000B
+	rcNoSmartCard       = 0x8010000C
+	rcCommError         = 0x80100013
+	rcReaderUnavailable = 0x80100017
+	rcNoService         = 0x8010001D
+	rcNoReaders         = 0x8010002E
+	rcUnpoweredCard     = 0x80100067
+	rcResetCard         = 0x80100068
+	rcRemovedCard       = 0x80100069
+)
+
+// scCardLost reports if an error indicates the connection to the card was lost,
+// because the card was reset, powered down, or removed.
+func scCardLost(err error) bool {
+	var e *scErr
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.rc {
+	case rcInvalidHandle, rcNoSmartCard, rcReaderUnavailable, rcUnpoweredCard, rcResetCard, rcRemovedCard:
+		return true
+	}
+	return false
+}
+
+// scPnPNotification is a pseudo reader that reports a state change whenever a
+// reader is added or removed.
+const scPnPNotification = `\\?PnP?\Notification`
+
+// scReaderState mirrors SCARD_READERSTATE, which is used to query and wait for
+// changes in the state of readers.
+type scReaderState struct {
+	reader       string
+	currentState uint32
+	eventState   uint32
+	atr          []byte
+}
+
+// Transport is a connection to a smart card that can exchange raw APDUs.
+//
+// By default, YubiKeys are accessed through the system's PC/SC implementation.
+// Alternative transports, such as a connection to a remote reader or a software
+// card, can be used by passing them to OpenTransport.
+type Transport interface {
+	// Transmit sends a command APDU to the card and returns the response APDU,
+	// including the trailing status word.
+	Transmit(cmd []byte) ([]byte, error)
+	// BeginTransaction requests exclusive access to the card until
+	// EndTransaction is called.
+	BeginTransaction() error
+	// EndTransaction releases exclusive access to the card.
+	EndTransaction() error
+	// Close releases the connection to the card.
+	Close() error
+}
+
+// ATRTransport is an optional interface implemented by transports that can
+// report the card's Answer To Reset. The ATR is used to detect capabilities of
+// the card, such as support for extended length APDUs.
+type ATRTransport interface {
+	Transport
+	// ATR returns the Answer To Reset of the connected card.
+	ATR() ([]byte, error)
+}
+
+// ReconnectTransport is an optional interface implemented by transports that
+// can re-establish their connection after the card was reset or lost power.
+// YubiKeys using such transports recover from these events automatically.
+type ReconnectTransport interface {
+	Transport
+	// Reconnect re-establishes the connection to the card, leaving the card's
+	// state as is.
+	Reconnect() error
+}
+
+// protocolTransport is implemented by the PC/SC handles of this package, which
+// report the transmission protocol negotiated with the card.
+type protocolTransport interface {
+	activeProtocol() uint32
+}
+
+// contactlessTransport is implemented by transports that know the card is
+// accessed through a contactless reader, even though its ATR may not say so.
+type contactlessTransport interface {
+	contactless() bool
+}
+
+// maxInputTransport is implemented by the PC/SC handles of this package, which
+// report the size of the largest command APDU the reader accepts, as read from
+// the reader's SCARD_ATTR_MAXINPUT attribute.
+type maxInputTransport interface {
+	maxInput() (int, error)
+}
+
+// scAttrMaxInput is the SCARD_ATTR_MAXINPUT reader attribute, defined as
+// SCARD_ATTR_VALUE(SCARD_CLASS_VENDOR_DEFINED, 0xA007).
+const scAttrMaxInput = 0x0007a007
+
+// parseAttrInt decodes an integer reader attribute, which PC/SC returns in the
+// host's byte order.
+func parseAttrInt(b []byte) (int, error) {
+	switch len(b) {
+	case 4:
+		return int(binary.NativeEndian.Uint32(b)), nil
+	case 8:
+		return int(binary.NativeEndian.Uint64(b)), nil
+	}
+	return 0, fmt.Errorf("unexpected attribute length: %d", len(b))
+}
+
+// maxShortAPDUSize is the size of the largest short command APDU, with 255
+// bytes of data and an Le field. Readers that don't accept larger commands
+// don't support extended length APDUs.
+const maxShortAPDUSize = 5 + 0xff + 1
+
+// scTx is an active transaction with the card. It implements APDU command
+// chaining and response handling on top of a Transport.
+type scTx struct {
+	t Transport
+
+	// extended indicates that the card and reader accept extended length
+	// APDUs, which allows sending large commands without command chaining and
+	// receiving large responses without GET RESPONSE.
+	extended bool
+	// maxInput, if positive, is the size of the largest command APDU the
+	// reader accepts. Larger extended length commands are chained instead.
+	maxInput int
+	// lost is set if the transport reported that the connection to the card
+	// was lost during the transaction.
+	lost bool
+	// contactless is set if the card is accessed through a contactless
+	// reader, which limits the size of commands and the operations allowed.
+	contactless bool
+	// contactlessRules is set if the card's ATR identifies a card other than
+	// a YubiKey, which is assumed to enforce PIV's access rules for the
+	// contactless interface. YubiKeys permit all operations over NFC, so a
+	// refused command means the PIN wasn't verified or the key wasn't
+	// touched, not that the interface is restricted.
+	contactlessRules bool
+
+	// op is the name of the operation using the transaction, and tracer and
+	// recorder, if set, receive every APDU exchanged with the card.
+	op       string
+	tracer   Tracer
+	recorder *Recorder
+	// redact describes the secrets in the command being transmitted, and sent
+	// counts the command data already sent in earlier chunks.
+	redact redaction
+	sent   int
+
+	// managementKeyAlg, if non-zero, is the algorithm of the management key,
+	// overriding the one reported by the card.
+	managementKeyAlg byte
+}
+
+func beginTx(t Transport) (*scTx, error) {
+	if err := t.BeginTransaction(); err != nil {
+		return nil, err
+	}
+	return &scTx{t: t}, nil
+}
+
+func (h *scHandle) Begin() (*scTx, error) {
+	return beginTx(h)
+}
+
+func (t *scTx) Close() error {
+	return t.t.EndTransaction()
+}
+
+// transmit sends a single command APDU. If the card indicates more response
+// data is available, more is set and le holds the length to request with GET
+// RESPONSE.
+func (t *scTx) transmit(req []byte) (more bool, le byte, b []byte, err error) {
+	start := time.Now()
+	resp, err := t.t.Transmit(req)
+	if t.tracer != nil || t.recorder != nil {
+		redacted := t.redacted(req)
+		if t.tracer != nil {
+			t.trace(req, resp, redacted, start, err)
+		}
+		if t.recorder != nil {
+			t.recorder.record(t.op, req, resp, redacted, t.redact.response, err)
+		}
+	}
+	if err != nil {
+		if scCardLost(err) {
+			t.lost = true
+		}
+		return false, 0, nil, fmt.Errorf("transmitting request: %w", err)
+	}
+	respN := len(resp)
+	if respN < 2 {
+		return false, 0, nil, fmt.Errorf("scard response too short: %d", respN)
+	}
+	sw1 := resp[respN-2]
+	sw2 := resp[respN-1]
+	if sw1 == 0x90 && sw2 == 0x00 {
+		return false, 0, resp[:respN-2], nil
+	}
+	if sw1 == 0x61 {
+		return true, sw2, resp[:respN-2], nil
+	}
+	if sw1 == 0x6c {
+		// ISO/IEC 7816-3 12.2.2: the expected length was wrong, and sw2
+		// holds the exact length. T=0 cards report this for commands sent
+		// without an Le matching the response.
+		if retry := withLe(req, sw2); retry != nil {
+			return t.transmit(retry)
+		}
+	}
+	apduErr := &APDUError{sw1: sw1, sw2: sw2, ins: req[1], p2: req[3]}
+	if t.contactless && t.contactlessRules && apduErr.Status() == 0x6982 && contactlessRestricted(req[1], req[3]) {
+		return false, 0, nil, fmt.Errorf("%w: %w", ErrContactlessRestricted, apduErr)
+	}
+	return false, 0, nil, apduErr
+}
+
+// withLe returns a copy of a short command APDU with its Le field set, or nil
+// if the command already has that Le or can't be modified.
+func withLe(req []byte, le byte) []byte {
+	switch {
+	case len(req) == 5:
+		// Le is encoded in the fifth byte of commands without data.
+		if req[4] == le {
+			return nil
+		}
+		b := append([]byte(nil), req...)
+		b[4] = le
+		return b
+	case len(req) == 5+int(req[4]) && req[4] != 0:
+		return append(append([]byte(nil), req...), le)
+	case len(req) == 6+int(req[4]) && req[4] != 0:
+		if req[len(req)-1] == le {
+			return nil
+		}
+		b := append([]byte(nil), req...)
+		b[len(b)-1] = le
+		return b
 	}
 	return nil
 }
 
 type apdu struct {
+	class       byte
 	instruction byte
 	param1      byte
 	param2      byte
 	data        []byte
 }
 
+// longResponse reports whether the card may respond to the command with more
+// than 256 bytes.
+func (d apdu) longResponse() bool {
+	switch d.instruction {
+	case insGetData, insAttest, insGenerateAsymmetric:
+		return true
+	case insAuthenticate:
+		// RSA operations return as many bytes as they're passed.
+		return len(d.data) > 0xff
+	}
+	return false
+}
+
 func (t *scTx) Transmit(d apdu) ([]byte, error) {
+	if t.tracer != nil || t.recorder != nil {
+		t.redact = redactAPDU(d)
+		t.sent = 0
+	}
 	data := d.data
 	var resp []byte
-	const maxAPDUDataSize = 0xff
-	for len(data) > maxAPDUDataSize {
-		req := make([]byte, 5+maxAPDUDataSize)
-		req[0] = 0x10 // ISO/IEC 7816-4 5.1.1
+	const (
+		maxAPDUDataSize         = 0xff
+		maxExtendedAPDUDataSize = 0xffff
+	)
+	// Extended length APDUs are only used where they avoid chaining or GET
+	// RESPONSE. Some readers and cards advertise support but handle them
+	// poorly, so everything else is sent as a short APDU.
+	long := d.longResponse()
+	if t.extended && (len(data) > maxAPDUDataSize || long) &&
+		len(data) <= maxExtendedAPDUDataSize && (t.maxInput <= 0 || 9+len(data) <= t.maxInput) {
+		// ISO/IEC 7816-4 5.1: extended length commands start Lc, or Le if
+		// there's no data, with a zero byte, and encode Lc and Le in two bytes
+		// each. An Le of zero requests up to 65536 bytes, so the card returns
+		// the full response at once.
+		req := make([]byte, 0, 9+len(data))
+		req = append(req, d.class, d.instruction, d.param1, d.param2, 0x00)
+		if len(data) > 0 {
+			req = append(req, byte(len(data)>>8), byte(len(data)))
+			req = append(req, data...)
+		}
+		if long {
+			req = append(req, 0x00, 0x00)
+		}
+		return t.transmitAll(req)
+	}
+	chunk := maxAPDUDataSize
+	if t.contactless {
+		chunk = contactlessAPDUDataSize
+	}
+	for len(data) > chunk {
+		req := make([]byte, 5+chunk)
+		req[0] = d.class | 0x10 // ISO/IEC 7816-4 5.1.1
 		req[1] = d.instruction
 		req[2] = d.param1
 		req[3] = d.param2
-		req[4] = 0xff
-		copy(req[5:], data[:maxAPDUDataSize])
-		data = data[maxAPDUDataSize:]
-		_, r, err := t.transmit(req)
+		req[4] = byte(chunk)
+		copy(req[5:], data[:chunk])
+		data = data[chunk:]
+		_, _, r, err := t.transmit(req)
 		if err != nil {
 			return nil, fmt.Errorf("transmitting initial chunk %w", err)
 		}
@@ -155,22 +571,33 @@ func (t *scTx) Transmit(d apdu) ([]byte, error) {
 	}
 
 	req := make([]byte, 5+len(data))
+	req[0] = d.class
 	req[1] = d.instruction
 	req[2] = d.param1
 	req[3] = d.param2
 	req[4] = byte(len(data))
 	copy(req[5:], data)
-	hasMore, r, err := t.transmit(req)
+	r, err := t.transmitAll(req)
+	if err != nil {
+		return nil, err
+	}
+	return append(resp, r...), nil
+}
+
+// transmitAll sends a single command APDU and reads the full response,
+// issuing GET RESPONSE commands while the card indicates more data.
+func (t *scTx) transmitAll(req []byte) ([]byte, error) {
+	hasMore, le, resp, err := t.transmit(req)
 	if err != nil {
 		return nil, err
 	}
-	resp = append(resp, r...)
 
 	for hasMore {
-		req := make([]byte, 5)
-		req[1] = insGetResponseAPDU
+		// Request the number of bytes indicated by the card, where zero
+		// means 256 or more bytes.
+		req := []byte{0x00, insGetResponseAPDU, 0x00, 0x00, le}
 		var r []byte
-		hasMore, r, err = t.transmit(req)
+		hasMore, le, r, err = t.transmit(req)
 		if err != nil {
 			return nil, fmt.Errorf("reading further response: %w", err)
 		}
@@ -12,6 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build cgo && !pcscgo
+// +build cgo,!pcscgo
+
 package piv
 
 import "C"
@@ -0,0 +1,750 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || freebsd || openbsd
+// +build linux freebsd openbsd
+
+package piv
+
+// A pure Go client for the pcsc-lite daemon. Instead of linking against
+// libpcsclite, this speaks the daemon's wire protocol over its Unix socket.
+//
+// https://github.com/LudovicRousseau/PCSC/blob/1.9.9/src/winscard_msg.h
+// https://github.com/LudovicRousseau/PCSC/blob/1.9.9/src/winscard_clnt.c
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	liteProtocolVersionMajor = 4
+	liteProtocolVersionMinor = 4
+
+	liteCmdEstablishContext             = 0x01
+	liteCmdReleaseContext               = 0x02
+	liteCmdConnect                      = 0x04
+	liteCmdReconnect                    = 0x05
+	liteCmdCancel                       = 0x0D
+	liteCmdDisconnect                   = 0x06
+	liteCmdBeginTransaction             = 0x07
+	liteCmdEndTransaction               = 0x08
+	liteCmdTransmit                     = 0x09
+	liteCmdControl                      = 0x0A
+	liteCmdGetAttrib                    = 0x0F
+	liteCmdVersion                      = 0x11
+	liteCmdGetReadersState              = 0x12
+	liteCmdWaitReaderStateChange        = 0x13
+	liteCmdStopWaitingReaderStateChange = 0x14
+
+	// Sizes of fixed buffers in the wire protocol.
+	liteMaxReaderName      = 128
+	liteMaxATRSize         = 33
+	liteMaxReadersContexts = 16
+	liteMaxBufferSize      = 264
+
+	// Values of the readerState field of a reader's published state.
+	liteReaderStatePresent = 0x0004
+
+	// Values of the readerSharing field of a reader's published state.
+	liteSharingExclusive = -1
+	liteSharingNone      = 0
+)
+
+// liteByteOrder is the byte order used by the daemon, which always matches the
+// host.
+var liteByteOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		liteByteOrder = binary.BigEndian
+	}
+}
+
+// litePCILength is sizeof(SCARD_IO_REQUEST), two unsigned longs.
+const litePCILength = 2 * strconv.IntSize / 8
+
+// liteSocketPath returns the path of the daemon's socket. Like libpcsclite,
+// the location can be overridden with the PCSCLITE_CSOCK_NAME environment
+// variable.
+func liteSocketPath() string {
+	if p := os.Getenv("PCSCLITE_CSOCK_NAME"); p != "" {
+		return p
+	}
+	if runtime.GOOS == "linux" {
+		return "/run/pcscd/pcscd.comm"
+	}
+	return "/var/run/pcscd/pcscd.comm"
+}
+
+type liteHeader struct {
+	Size    uint32
+	Command uint32
+}
+
+type liteVersion struct {
+	Major int32
+	Minor int32
+	RV    uint32
+}
+
+type liteEstablish struct {
+	Scope   uint32
+	Context uint32
+	RV      uint32
+}
+
+type liteRelease struct {
+	Context uint32
+	RV      uint32
+}
+
+type liteCancel struct {
+	Context uint32
+	RV      uint32
+}
+
+type liteConnect struct {
+	Context            uint32
+	Reader             [liteMaxReaderName]byte
+	ShareMode          uint32
+	PreferredProtocols uint32
+	Card               int32
+	ActiveProtocol     uint32
+	RV                 uint32
+}
+
+type liteReconnect struct {
+	Card               int32
+	ShareMode          uint32
+	PreferredProtocols uint32
+	Initialization     uint32
+	ActiveProtocol     uint32
+	RV                 uint32
+}
+
+type liteDisconnect struct {
+	Card        int32
+	Disposition uint32
+	RV          uint32
+}
+
+type liteBegin struct {
+	Card int32
+	RV   uint32
+}
+
+type liteEnd struct {
+	Card        int32
+	Disposition uint32
+	RV          uint32
+}
+
+type liteTransmit struct {
+	Card            int32
+	SendPCIProtocol uint32
+	SendPCILength   uint32
+	SendLength      uint32
+	RecvPCIProtocol uint32
+	RecvPCILength   uint32
+	RecvLength      uint32
+	RV              uint32
+}
+
+type liteControl struct {
+	Card          int32
+	ControlCode   uint32
+	SendLength    uint32
+	RecvLength    uint32
+	BytesReturned uint32
+	RV            uint32
+}
+
+type liteGetAttrib struct {
+	Card    int32
+	AttrID  uint32
+	Attr    [liteMaxBufferSize]byte
+	AttrLen uint32
+	RV      uint32
+}
+
+type liteWaitReaderStateChange struct {
+	Timeout uint32
+	RV      uint32
+}
+
+// liteReaderState is the state of a reader published by the daemon.
+type liteReaderState struct {
+	ReaderName    [liteMaxReaderName]byte
+	EventCounter  uint32
+	ReaderState   uint32
+	ReaderSharing int32
+	CardATR       [liteMaxATRSize]byte
+	_             [3]byte
+	CardATRLength uint32
+	CardProtocol  uint32
+}
+
+func (s *liteReaderState) name() string {
+	n := bytes.IndexByte(s.ReaderName[:], 0)
+	if n < 0 {
+		n = len(s.ReaderName)
+	}
+	return string(s.ReaderName[:n])
+}
+
+func (s *liteReaderState) atr() []byte {
+	n := int(s.CardATRLength)
+	if n > len(s.CardATR) {
+		n = len(s.CardATR)
+	}
+	return append([]byte(nil), s.CardATR[:n]...)
+}
+
+// liteConn is a connection to the daemon. Requests and responses are fixed
+// size structs, prefixed by a header for requests.
+type liteConn struct {
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func dialLite() (*liteConn, error) {
+	c, err := net.Dial("unix", liteSocketPath())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", &scErr{rcNoService}, err)
+	}
+	return &liteConn{c: c}, nil
+}
+
+func (c *liteConn) send(cmd uint32, req interface{}) error {
+	var buf bytes.Buffer
+	size := 0
+	if req != nil {
+		size = binary.Size(req)
+	}
+	h := liteHeader{Size: uint32(size), Command: cmd}
+	if err := binary.Write(&buf, liteByteOrder, h); err != nil {
+		return err
+	}
+	if req != nil {
+		if err := binary.Write(&buf, liteByteOrder, req); err != nil {
+			return err
+		}
+	}
+	return c.write(buf.Bytes())
+}
+
+func (c *liteConn) write(b []byte) error {
+	if _, err := c.c.Write(b); err != nil {
+		return fmt.Errorf("%w: %w", &scErr{rcCommError}, err)
+	}
+	return nil
+}
+
+func (c *liteConn) recv(resp interface{}) error {
+	if err := binary.Read(c.c, liteByteOrder, resp); err != nil {
+		return fmt.Errorf("%w: %w", &scErr{rcCommError}, err)
+	}
+	return nil
+}
+
+func (c *liteConn) read(b []byte) error {
+	if _, err := io.ReadFull(c.c, b); err != nil {
+		return fmt.Errorf("%w: %w", &scErr{rcCommError}, err)
+	}
+	return nil
+}
+
+// call sends a request and reads the response into the same struct.
+func (c *liteConn) call(cmd uint32, v interface{}) error {
+	if err := c.send(cmd, v); err != nil {
+		return err
+	}
+	return c.recv(v)
+}
+
+func (c *liteConn) Close() error {
+	return c.c.Close()
+}
+
+func liteCheck(rv uint32) error {
+	if rv == 0 {
+		return nil
+	}
+	return &scErr{int64(rv)}
+}
+
+type liteContext struct {
+	conn *liteConn
+	ctx  uint32
+}
+
+func newLiteContext() (*liteContext, error) {
+	conn, err := dialLite()
+	if err != nil {
+		return nil, err
+	}
+	v := liteVersion{Major: liteProtocolVersionMajor, Minor: liteProtocolVersionMinor}
+	if err := conn.call(liteCmdVersion, &v); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := liteCheck(v.RV); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported pcscd protocol version %d.%d: %w", v.Major, v.Minor, err)
+	}
+	e := liteEstablish{Scope: scScopeSystem}
+	if err := conn.call(liteCmdEstablishContext, &e); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := liteCheck(e.RV); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &liteContext{conn: conn, ctx: e.Context}, nil
+}
+
+func (c *liteContext) Close() error {
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+	r := liteRelease{Context: c.ctx}
+	err := c.conn.call(liteCmdReleaseContext, &r)
+	if err == nil {
+		err = liteCheck(r.RV)
+	}
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readerStates returns the state of all readers known to the daemon. The
+// caller must hold the connection's lock.
+func (c *liteConn) readerStates() ([]liteReaderState, error) {
+	if err := c.send(liteCmdGetReadersState, nil); err != nil {
+		return nil, err
+	}
+	return c.recvReaderStates()
+}
+
+func (c *liteConn) recvReaderStates() ([]liteReaderState, error) {
+	var states [liteMaxReadersContexts]liteReaderState
+	if err := c.recv(&states); err != nil {
+		return nil, err
+	}
+	var present []liteReaderState
+	for _, s := range states {
+		if s.ReaderName[0] != 0 {
+			present = append(present, s)
+		}
+	}
+	return present, nil
+}
+
+func (c *liteContext) ListReaders() ([]string, error) {
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+	states, err := c.conn.readerStates()
+	if err != nil {
+		return nil, err
+	}
+	var readers []string
+	for _, s := range states {
+		readers = append(readers, s.name())
+	}
+	return readers, nil
+}
+
+// GetStatusChange blocks until the state of one of the readers differs from
+// the provided current state, or the timeout expires. A negative timeout
+// waits indefinitely.
+func (c *liteContext) GetStatusChange(readers []scReaderState, timeout time.Duration) error {
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		// Request reader states and register for events in one step, so no
+		// event can be missed between the two.
+		if err := c.conn.send(liteCmdWaitReaderStateChange, nil); err != nil {
+			return err
+		}
+		states, err := c.conn.recvReaderStates()
+		if err != nil {
+			return err
+		}
+		if liteUpdateReaderStates(readers, states) {
+			return c.stopWaiting()
+		}
+
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				if err := c.stopWaiting(); err != nil {
+					return err
+				}
+				return &scErr{rcTimeout}
+			}
+			c.conn.c.SetReadDeadline(deadline)
+		}
+		var w liteWaitReaderStateChange
+		err = c.conn.recv(&w)
+		c.conn.c.SetReadDeadline(time.Time{})
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if err := c.stopWaiting(); err != nil {
+					return err
+				}
+				return &scErr{rcTimeout}
+			}
+			return err
+		}
+		if err := liteCheck(w.RV); err != nil {
+			return err
+		}
+	}
+}
+
+// Cancel aborts a GetStatusChange call blocked on another goroutine. Like
+// libpcsclite, the request is sent over a separate connection since the
+// context's connection is busy waiting for events.
+func (c *liteContext) Cancel() error {
+	conn, err := dialLite()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := liteCancel{Context: c.ctx}
+	if err := conn.call(liteCmdCancel, &r); err != nil {
+		return err
+	}
+	return liteCheck(r.RV)
+}
+
+// stopWaiting unregisters the context from reader events.
+func (c *liteContext) stopWaiting() error {
+	if err := c.conn.send(liteCmdStopWaitingReaderStateChange, nil); err != nil {
+		return err
+	}
+	var w liteWaitReaderStateChange
+	if err := c.conn.recv(&w); err != nil {
+		return err
+	}
+	switch w.RV {
+	case 0, rcTimeout, rcNoReaders:
+		return nil
+	}
+	return liteCheck(w.RV)
+}
+
+// liteUpdateReaderStates computes the event state of each reader from the
+// states published by the daemon, reporting if any reader changed.
+//
+// Like libpcsclite, the upper 16 bits of the state hold the reader's event
+// counter, or the number of readers for the PnP notification pseudo reader.
+func liteUpdateReaderStates(readers []scReaderState, states []liteReaderState) bool {
+	changed := false
+	for i := range readers {
+		r := &readers[i]
+		if r.currentState&scStateIgnore != 0 {
+			r.eventState = scStateIgnore
+			continue
+		}
+		var event uint32
+		if r.reader == scPnPNotification {
+			event = uint32(len(states)) << 16
+			if event != r.currentState&0xffff0000 {
+				event |= scStateChanged
+				changed = true
+			}
+			r.eventState = event
+			continue
+		}
+
+		var s *liteReaderState
+		for j := range states {
+			if states[j].name() == r.reader {
+				s = &states[j]
+				break
+			}
+		}
+		if s == nil {
+			event = scStateUnknown | scStateUnavailable
+		} else {
+			event = s.EventCounter << 16
+			if s.ReaderState&liteReaderStatePresent != 0 {
+				event |= scStatePresent
+				r.atr = s.atr()
+			} else {
+				event |= scStateEmpty
+				r.atr = nil
+			}
+			switch s.ReaderSharing {
+			case liteSharingExclusive:
+				event |= scStateExclusive | scStateInUse
+			case liteSharingNone:
+			default:
+				event |= scStateInUse
+			}
+		}
+		// A change in the event counter indicates the card was swapped
+		// between calls, even if the reader's state is the same.
+		if event != r.currentState&^scStateChanged {
+			event |= scStateChanged
+			changed = true
+		}
+		r.eventState = event
+	}
+	return changed
+}
+
+func (c *liteContext) Connect(reader string, shareMode uint32) (*liteHandle, error) {
+	if len(reader) >= liteMaxReaderName {
+		return nil, fmt.Errorf("reader name too long: %q", reader)
+	}
+	req := liteConnect{
+		Context:            c.ctx,
+		ShareMode:          shareMode,
+		PreferredProtocols: scProtocolAny,
+	}
+	copy(req.Reader[:], reader)
+
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+	if err := c.conn.call(liteCmdConnect, &req); err != nil {
+		return nil, err
+	}
+	if err := liteCheck(req.RV); err != nil {
+		return nil, err
+	}
+	return &liteHandle{
+		conn:      c.conn,
+		reader:    reader,
+		card:      req.Card,
+		shareMode: shareMode,
+		protocol:  req.ActiveProtocol,
+	}, nil
+}
+
+// liteBackend adapts the pure Go pcsc-lite client to scBackend.
+type liteBackend struct {
+	*liteContext
+}
+
+func newLiteBackend() (scBackend, error) {
+	ctx, err := newLiteContext()
+	if err != nil {
+		return nil, err
+	}
+	return liteBackend{ctx}, nil
+}
+
+func (b liteBackend) connect(reader string, shareMode uint32) (Transport, error) {
+	h, err := b.Connect(reader, shareMode)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+type liteHandle struct {
+	conn      *liteConn
+	reader    string
+	card      int32
+	shareMode uint32
+	protocol  uint32
+}
+
+// activeProtocol returns the transmission protocol negotiated with the card.
+func (h *liteHandle) activeProtocol() uint32 {
+	return h.protocol
+}
+
+// Reconnect re-establishes the connection to the card after it was reset by
+// another process or lost power.
+func (h *liteHandle) Reconnect() error {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	r := liteReconnect{
+		Card:               h.card,
+		ShareMode:          h.shareMode,
+		PreferredProtocols: scProtocolAny,
+		Initialization:     scLeaveCard,
+	}
+	if err := h.conn.call(liteCmdReconnect, &r); err != nil {
+		return err
+	}
+	if err := liteCheck(r.RV); err != nil {
+		return err
+	}
+	h.protocol = r.ActiveProtocol
+	return nil
+}
+
+// ATR returns the ATR of the card in the handle's reader. Like libpcsclite,
+// this is read from the reader states published by the daemon.
+func (h *liteHandle) ATR() ([]byte, error) {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	states, err := h.conn.readerStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.name() != h.reader {
+			continue
+		}
+		if s.ReaderState&liteReaderStatePresent == 0 {
+			return nil, &scErr{rcNoSmartCard}
+		}
+		return s.atr(), nil
+	}
+	return nil, &scErr{rcReaderUnavailable}
+}
+
+func (h *liteHandle) Close() error {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	r := liteDisconnect{Card: h.card, Disposition: scLeaveCard}
+	if err := h.conn.call(liteCmdDisconnect, &r); err != nil {
+		return err
+	}
+	return liteCheck(r.RV)
+}
+
+func (h *liteHandle) BeginTransaction() error {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	r := liteBegin{Card: h.card}
+	if err := h.conn.call(liteCmdBeginTransaction, &r); err != nil {
+		return err
+	}
+	return liteCheck(r.RV)
+}
+
+func (h *liteHandle) EndTransaction() error {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	r := liteEnd{Card: h.card, Disposition: scLeaveCard}
+	if err := h.conn.call(liteCmdEndTransaction, &r); err != nil {
+		return err
+	}
+	return liteCheck(r.RV)
+}
+
+func (h *liteHandle) Transmit(req []byte) ([]byte, error) {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	t := liteTransmit{
+		Card:            h.card,
+		SendPCIProtocol: h.protocol,
+		SendPCILength:   litePCILength,
+		SendLength:      uint32(len(req)),
+		RecvPCIProtocol: h.protocol,
+		RecvPCILength:   litePCILength,
+		RecvLength:      scMaxBufferSizeExtended,
+	}
+	if err := h.conn.send(liteCmdTransmit, &t); err != nil {
+		return nil, err
+	}
+	if err := h.conn.write(req); err != nil {
+		return nil, err
+	}
+	if err := h.conn.recv(&t); err != nil {
+		return nil, err
+	}
+	if err := liteCheck(t.RV); err != nil {
+		return nil, err
+	}
+	if t.RecvLength > scMaxBufferSizeExtended {
+		return nil, &scErr{rcInsufficient}
+	}
+	resp := make([]byte, t.RecvLength)
+	if err := h.conn.read(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// maxInput returns the size of the largest command APDU the reader accepts.
+func (h *liteHandle) maxInput() (int, error) {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	a := liteGetAttrib{
+		Card:    h.card,
+		AttrID:  scAttrMaxInput,
+		AttrLen: liteMaxBufferSize,
+	}
+	if err := h.conn.call(liteCmdGetAttrib, &a); err != nil {
+		return 0, err
+	}
+	if err := liteCheck(a.RV); err != nil {
+		return 0, err
+	}
+	if a.AttrLen > liteMaxBufferSize {
+		return 0, &scErr{rcInsufficient}
+	}
+	return parseAttrInt(a.Attr[:a.AttrLen])
+}
+
+// Control sends a command directly to the reader, such as a request to verify
+// a PIN using the reader's PIN pad.
+func (h *liteHandle) Control(code uint32, req []byte) ([]byte, error) {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	c := liteControl{
+		Card:        h.card,
+		ControlCode: code,
+		SendLength:  uint32(len(req)),
+		RecvLength:  scMaxBufferSizeExtended,
+	}
+	if err := h.conn.send(liteCmdControl, &c); err != nil {
+		return nil, err
+	}
+	if len(req) > 0 {
+		if err := h.conn.write(req); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.conn.recv(&c); err != nil {
+		return nil, err
+	}
+	if err := liteCheck(c.RV); err != nil {
+		return nil, err
+	}
+	if c.BytesReturned > scMaxBufferSizeExtended {
+		return nil, &scErr{rcInsufficient}
+	}
+	resp := make([]byte, c.BytesReturned)
+	if err := h.conn.read(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
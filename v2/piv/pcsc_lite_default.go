@@ -0,0 +1,30 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build (linux || freebsd || openbsd) && (pcscgo || !cgo)
+// +build linux freebsd openbsd
+// +build pcscgo !cgo
+
+package piv
+
+// When cgo is disabled, or the "pcscgo" build tag is provided, talk to the
+// pcsc-lite daemon directly instead of linking against libpcsclite.
+
+type scContext = liteContext
+
+type scHandle = liteHandle
+
+func newSCContext() (*scContext, error) {
+	return newLiteContext()
+}
@@ -0,0 +1,467 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || freebsd || openbsd
+// +build linux freebsd openbsd
+
+package piv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePCSCD implements the pcsc-lite daemon's side of the wire protocol.
+type fakePCSCD struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	readers  []*fakeReader
+	waiting  map[net.Conn]bool
+	contexts map[uint32]net.Conn
+}
+
+type fakeReader struct {
+	name    string
+	atr     []byte
+	counter uint32
+	// transmit responds to command APDUs.
+	transmit func(cmd []byte) []byte
+	// maxInput is reported as the SCARD_ATTR_MAXINPUT attribute, if non-zero.
+	maxInput uint32
+}
+
+// newFakePCSCD starts a fake daemon and points the client at it.
+func newFakePCSCD(t *testing.T, readers ...*fakeReader) *fakePCSCD {
+	path := filepath.Join(t.TempDir(), "pcscd.comm")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening on unix socket: %v", err)
+	}
+	t.Setenv("PCSCLITE_CSOCK_NAME", path)
+	d := &fakePCSCD{
+		l:        l,
+		readers:  readers,
+		waiting:  map[net.Conn]bool{},
+		contexts: map[uint32]net.Conn{},
+	}
+	go d.serve()
+	t.Cleanup(func() { l.Close() })
+	return d
+}
+
+func (d *fakePCSCD) serve() {
+	for {
+		c, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			for {
+				if err := d.handle(c); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// insert changes the card present in a reader and notifies waiting clients.
+// A nil ATR removes the card.
+func (d *fakePCSCD) insert(i int, atr []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readers[i].atr = atr
+	d.readers[i].counter++
+	d.notify()
+}
+
+// addReader connects a new reader and notifies waiting clients.
+func (d *fakePCSCD) addReader(r *fakeReader) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readers = append(d.readers, r)
+	d.notify()
+}
+
+func (d *fakePCSCD) notify() {
+	for c := range d.waiting {
+		binary.Write(c, liteByteOrder, liteWaitReaderStateChange{})
+	}
+	d.waiting = map[net.Conn]bool{}
+}
+
+func (d *fakePCSCD) states() [liteMaxReadersContexts]liteReaderState {
+	var states [liteMaxReadersContexts]liteReaderState
+	for i, r := range d.readers {
+		s := &states[i]
+		copy(s.ReaderName[:], r.name)
+		s.EventCounter = r.counter
+		s.ReaderState = 0x0002 // SCARD_ABSENT
+		if r.atr != nil {
+			s.ReaderState = liteReaderStatePresent
+			s.CardATRLength = uint32(copy(s.CardATR[:], r.atr))
+		}
+	}
+	return states
+}
+
+func (d *fakePCSCD) handle(c net.Conn) error {
+	var h liteHeader
+	if err := binary.Read(c, liteByteOrder, &h); err != nil {
+		return err
+	}
+	// Reply holds the daemon's lock while writing, so responses aren't
+	// interleaved with event notifications.
+	reply := func(v ...interface{}) error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, v := range v {
+			if err := binary.Write(c, liteByteOrder, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch h.Command {
+	case liteCmdVersion:
+		var v liteVersion
+		if err := binary.Read(c, liteByteOrder, &v); err != nil {
+			return err
+		}
+		return reply(v)
+	case liteCmdEstablishContext:
+		var e liteEstablish
+		if err := binary.Read(c, liteByteOrder, &e); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		e.Context = uint32(len(d.contexts) + 1)
+		d.contexts[e.Context] = c
+		d.mu.Unlock()
+		return reply(e)
+	case liteCmdReleaseContext:
+		var r liteRelease
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		return reply(r)
+	case liteCmdGetReadersState:
+		d.mu.Lock()
+		states := d.states()
+		d.mu.Unlock()
+		return reply(states)
+	case liteCmdWaitReaderStateChange:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.waiting[c] = true
+		return binary.Write(c, liteByteOrder, d.states())
+	case liteCmdStopWaitingReaderStateChange:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if !d.waiting[c] {
+			return nil
+		}
+		delete(d.waiting, c)
+		return binary.Write(c, liteByteOrder, liteWaitReaderStateChange{RV: rcTimeout})
+	case liteCmdCancel:
+		var r liteCancel
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if w, ok := d.contexts[r.Context]; ok && d.waiting[w] {
+			delete(d.waiting, w)
+			binary.Write(w, liteByteOrder, liteWaitReaderStateChange{RV: rcCancelled})
+		}
+		return binary.Write(c, liteByteOrder, r)
+	case liteCmdConnect:
+		var r liteConnect
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		r.RV = 0x80100009 // SCARD_E_UNKNOWN_READER
+		name := string(bytes.TrimRight(r.Reader[:], "\x00"))
+		for i, reader := range d.readers {
+			if reader.name == name {
+				r.RV = 0
+				r.Card = int32(i + 1)
+				r.ActiveProtocol = scProtocolT1
+			}
+		}
+		return reply(r)
+	case liteCmdDisconnect:
+		var r liteDisconnect
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		return reply(r)
+	case liteCmdBeginTransaction:
+		var r liteBegin
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		return reply(r)
+	case liteCmdEndTransaction:
+		var r liteEnd
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		return reply(r)
+	case liteCmdTransmit:
+		var r liteTransmit
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		cmd := make([]byte, r.SendLength)
+		if _, err := io.ReadFull(c, cmd); err != nil {
+			return err
+		}
+		resp := d.readers[r.Card-1].transmit(cmd)
+		r.RecvLength = uint32(len(resp))
+		return reply(r, resp)
+	case liteCmdGetAttrib:
+		var r liteGetAttrib
+		if err := binary.Read(c, liteByteOrder, &r); err != nil {
+			return err
+		}
+		r.RV = 0x80100022 // SCARD_E_UNSUPPORTED_FEATURE
+		if n := d.readers[r.Card-1].maxInput; r.AttrID == scAttrMaxInput && n != 0 {
+			r.RV = 0
+			r.AttrLen = 4
+			liteByteOrder.PutUint32(r.Attr[:], n)
+		}
+		return reply(r)
+	}
+	return errors.New("unknown command")
+}
+
+func TestLiteListReaders(t *testing.T) {
+	newFakePCSCD(t, &fakeReader{name: "Yubico YubiKey OTP+FIDO+CCID 00 00"}, &fakeReader{name: "Other Reader 01 00"})
+	c, err := newLiteContext()
+	if err != nil {
+		t.Fatalf("creating context: %v", err)
+	}
+	defer c.Close()
+
+	got, err := c.ListReaders()
+	if err != nil {
+		t.Fatalf("listing readers: %v", err)
+	}
+	want := []string{"Yubico YubiKey OTP+FIDO+CCID 00 00", "Other Reader 01 00"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListReaders() got=%q, want=%q", got, want)
+	}
+}
+
+func TestLiteNoService(t *testing.T) {
+	t.Setenv("PCSCLITE_CSOCK_NAME", filepath.Join(t.TempDir(), "missing"))
+	_, err := newLiteContext()
+	var e *scErr
+	if !errors.As(err, &e) || e.rc != rcNoService {
+		t.Errorf("expected SCARD_E_NO_SERVICE, got: %v", err)
+	}
+}
+
+func TestLiteTransmit(t *testing.T) {
+	const reader = "Yubico YubiKey OTP+FIDO+CCID 00 00"
+	newFakePCSCD(t, &fakeReader{
+		name: reader,
+		atr:  []byte{0x3b, 0x00},
+		transmit: func(cmd []byte) []byte {
+			switch cmd[1] {
+			case insSelectApplication:
+				return []byte{0x90, 0x00}
+			case insGetVersion:
+				return []byte{0x05, 0x04, 0x03, 0x90, 0x00}
+			}
+			return []byte{0x6d, 0x00}
+		},
+	})
+	c, err := newLiteContext()
+	if err != nil {
+		t.Fatalf("creating context: %v", err)
+	}
+	defer c.Close()
+	h, err := c.Connect(reader, scShareExclusive)
+	if err != nil {
+		t.Fatalf("connecting to reader: %v", err)
+	}
+	yk, err := OpenTransport(h)
+	if err != nil {
+		h.Close()
+		t.Fatalf("opening card: %v", err)
+	}
+	defer func() {
+		if err := yk.Close(); err != nil {
+			t.Errorf("closing card: %v", err)
+		}
+	}()
+	if got, want := yk.Version(), (Version{5, 4, 3}); got != want {
+		t.Errorf("version got=%v, want=%v", got, want)
+	}
+	if _, err := yk.Serial(); err == nil {
+		t.Errorf("expected error from unsupported instruction")
+	}
+}
+
+func TestLiteMaxInput(t *testing.T) {
+	newFakePCSCD(t,
+		&fakeReader{name: "Yubico YubiKey OTP+FIDO+CCID 00 00", maxInput: 3062},
+		&fakeReader{name: "Other Reader 01 00"},
+	)
+	c, err := newLiteContext()
+	if err != nil {
+		t.Fatalf("creating context: %v", err)
+	}
+	defer c.Close()
+
+	h, err := c.Connect("Yubico YubiKey OTP+FIDO+CCID 00 00", scShareShared)
+	if err != nil {
+		t.Fatalf("connecting to reader: %v", err)
+	}
+	defer h.Close()
+	if n, err := h.maxInput(); err != nil || n != 3062 {
+		t.Errorf("maxInput() got=%d, %v, want=3062", n, err)
+	}
+
+	h2, err := c.Connect("Other Reader 01 00", scShareShared)
+	if err != nil {
+		t.Fatalf("connecting to reader: %v", err)
+	}
+	defer h2.Close()
+	if _, err := h2.maxInput(); err == nil {
+		t.Errorf("expected error from reader without the attribute")
+	}
+}
+
+func TestLiteGetStatusChange(t *testing.T) {
+	d := newFakePCSCD(t, &fakeReader{name: "Reader 00 00"})
+	c, err := newLiteContext()
+	if err != nil {
+		t.Fatalf("creating context: %v", err)
+	}
+	defer c.Close()
+
+	states := []scReaderState{
+		{reader: "Reader 00 00", currentState: scStateUnaware},
+		{reader: scPnPNotification, currentState: scStateUnaware},
+	}
+	if err := c.GetStatusChange(states, 0); err != nil {
+		t.Fatalf("getting initial state: %v", err)
+	}
+	if states[0].eventState&scStateEmpty == 0 {
+		t.Errorf("expected reader to be empty, got state 0x%x", states[0].eventState)
+	}
+	if n := states[1].eventState >> 16; n != 1 {
+		t.Errorf("expected pnp notification to report 1 reader, got %d", n)
+	}
+	for i := range states {
+		states[i].currentState = states[i].eventState
+	}
+
+	err = c.GetStatusChange(states, 10*time.Millisecond)
+	var e *scErr
+	if !errors.As(err, &e) || e.rc != rcTimeout {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+
+	atr := []byte{0x3b, 0x8c, 0x80, 0x01}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.insert(0, atr)
+	}()
+	if err := c.GetStatusChange(states, -1); err != nil {
+		t.Fatalf("waiting for card: %v", err)
+	}
+	if states[0].eventState&(scStateChanged|scStatePresent) != scStateChanged|scStatePresent {
+		t.Errorf("expected card to be present, got state 0x%x", states[0].eventState)
+	}
+	if !bytes.Equal(states[0].atr, atr) {
+		t.Errorf("atr got=%x, want=%x", states[0].atr, atr)
+	}
+	if states[1].eventState&scStateChanged != 0 {
+		t.Errorf("pnp notification reported change without readers changing")
+	}
+}
+
+func TestLiteWatch(t *testing.T) {
+	atr := []byte{0x3b, 0x8c, 0x80, 0x01}
+	d := newFakePCSCD(t, &fakeReader{name: "Reader 00 00", atr: atr})
+	c, err := newLiteContext()
+	if err != nil {
+		t.Fatalf("creating context: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan Event)
+	errCh := make(chan error, 1)
+	go func() { errCh <- watch(ctx, c, events) }()
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case err := <-errCh:
+			t.Fatalf("watch returned: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event")
+		}
+		return Event{}
+	}
+	want := func(typ EventType, reader string, atr []byte) {
+		t.Helper()
+		e := next()
+		if e.Type != typ || e.Reader != reader || !bytes.Equal(e.ATR, atr) {
+			t.Errorf("got event %v %q %x, want %v %q %x", e.Type, e.Reader, e.ATR, typ, reader, atr)
+		}
+	}
+
+	want(ReaderAdded, "Reader 00 00", nil)
+	want(CardInserted, "Reader 00 00", atr)
+
+	d.insert(0, nil)
+	want(CardRemoved, "Reader 00 00", nil)
+
+	d.addReader(&fakeReader{name: "Reader 01 00"})
+	want(ReaderAdded, "Reader 01 00", nil)
+
+	atr2 := []byte{0x3b, 0x00}
+	d.insert(1, atr2)
+	want(CardInserted, "Reader 01 00", atr2)
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context cancelled, got: %v", err)
+		}
+	case <-time.After(watchPollInterval / 2):
+		t.Errorf("watch didn't return promptly after cancellation")
+	}
+}
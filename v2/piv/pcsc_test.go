@@ -15,7 +15,9 @@
 package piv
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -63,7 +65,7 @@ func runHandleTest(t *testing.T, f func(t *testing.T, h *scHandle)) {
 		if reader == "" {
 			t.Skip("could not find yubikey, skipping testing")
 		}
-		h, err := c.Connect(reader)
+		h, err := c.Connect(reader, scShareExclusive)
 		if err != nil {
 			t.Fatalf("connecting to %s: %v", reader, err)
 		}
@@ -112,7 +114,7 @@ func TestErrors(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		err := &apduErr{tc.sw1, tc.sw2}
+		err := &APDUError{sw1: tc.sw1, sw2: tc.sw2}
 		if errors.Is(err, ErrNotFound) != tc.isErrNotFound {
 			var s string
 			if !tc.isErrNotFound {
@@ -137,3 +139,421 @@ func TestErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorSentinels(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"security status", &APDUError{sw1: 0x69, sw2: 0x82}, ErrSecurityStatusNotSatisfied},
+		{"instruction", &APDUError{sw1: 0x6d, sw2: 0x00}, ErrInstructionNotSupported},
+		{"pin blocked", &APDUError{sw1: 0x69, sw2: 0x83, ins: insVerify, p2: 0x80}, ErrPINBlocked},
+		{"puk blocked", &APDUError{sw1: 0x69, sw2: 0x83, ins: insChangeReference, p2: 0x81}, ErrPUKBlocked},
+		{"unblock", &APDUError{sw1: 0x69, sw2: 0x83, ins: insResetRetry, p2: 0x80}, ErrPUKBlocked},
+		{"no smart card", &scErr{rcNoSmartCard}, ErrNoSmartCard},
+		{"sharing violation", &scErr{rcSharingViolation}, ErrSharingViolation},
+		{"removed", &scErr{rcRemovedCard}, ErrCardRemoved},
+		{"cancelled", &scErr{rcCancelled}, ErrCancelled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fmt.Errorf("wrapped: %w", test.err)
+			if !errors.Is(err, test.want) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", err, test.want)
+			}
+		})
+	}
+
+	// Blocked credentials are still reported as authentication errors.
+	err := &APDUError{sw1: 0x69, sw2: 0x83, ins: insVerify, p2: 0x80}
+	var authErr AuthErr
+	if !errors.As(err, &authErr) {
+		t.Errorf("%v should be AuthErr", err)
+	}
+	if errors.Is(err, ErrPUKBlocked) {
+		t.Errorf("%v should not be ErrPUKBlocked", err)
+	}
+	var apduErr *APDUError
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &apduErr) || apduErr.Status() != 0x6983 {
+		t.Errorf("errors.As(%v) should return APDUError with status 6983", err)
+	}
+}
+
+// fakeTransport is a Transport that replays scripted responses and records the
+// commands it receives. A nil response simulates the card being reset, after
+// which commands fail until the transport reconnects.
+type fakeTransport struct {
+	cmds  [][]byte
+	resps [][]byte
+	inTx  bool
+	reset bool
+	// txs counts the transactions begun on the transport.
+	txs int
+	// reconnects counts the calls to Reconnect.
+	reconnects int
+}
+
+func (f *fakeTransport) Transmit(cmd []byte) ([]byte, error) {
+	if !f.inTx {
+		return nil, fmt.Errorf("transmit outside of transaction")
+	}
+	if f.reset {
+		return nil, &scErr{rcResetCard}
+	}
+	f.cmds = append(f.cmds, append([]byte(nil), cmd...))
+	if len(f.resps) == 0 {
+		return nil, fmt.Errorf("unexpected command: %x", cmd)
+	}
+	resp := f.resps[0]
+	f.resps = f.resps[1:]
+	if resp == nil {
+		f.reset = true
+		return nil, &scErr{rcResetCard}
+	}
+	return resp, nil
+}
+
+func (f *fakeTransport) Reconnect() error {
+	f.reset = false
+	f.reconnects++
+	return nil
+}
+
+func (f *fakeTransport) BeginTransaction() error {
+	if f.inTx {
+		return fmt.Errorf("transaction already in progress")
+	}
+	f.inTx = true
+	f.txs++
+	return nil
+}
+
+func (f *fakeTransport) EndTransaction() error {
+	f.inTx = false
+	return nil
+}
+
+func (f *fakeTransport) Close() error { return nil }
+
+func TestTransmitChaining(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},
+			{0x01, 0x02, 0x61, 0x02},
+			{0x03, 0x04, 0x90, 0x00},
+		},
+	}
+	tx, err := beginTx(ft)
+	if err != nil {
+		t.Fatalf("beginning transaction: %v", err)
+	}
+	defer tx.Close()
+
+	got, err := tx.Transmit(apdu{instruction: insPutData, param1: 0x3f, param2: 0xff, data: data})
+	if err != nil {
+		t.Fatalf("transmit: %v", err)
+	}
+	if want := []byte{0x01, 0x02, 0x03, 0x04}; !bytes.Equal(got, want) {
+		t.Errorf("response got=%x, want=%x", got, want)
+	}
+
+	want := [][]byte{
+		append([]byte{0x10, insPutData, 0x3f, 0xff, 0xff}, data[:0xff]...),
+		append([]byte{0x00, insPutData, 0x3f, 0xff, byte(len(data) - 0xff)}, data[0xff:]...),
+		{0x00, insGetResponseAPDU, 0x00, 0x00, 0x02},
+	}
+	if len(ft.cmds) != len(want) {
+		t.Fatalf("got %d commands, want %d", len(ft.cmds), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(ft.cmds[i], want[i]) {
+			t.Errorf("command %d got=%x, want=%x", i, ft.cmds[i], want[i])
+		}
+	}
+}
+
+func TestTransmitWrongLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmd   apdu
+		resps [][]byte
+		want  [][]byte
+	}{
+		{
+			name:  "no data",
+			cmd:   apdu{instruction: insGetVersion},
+			resps: [][]byte{{0x6c, 0x03}, {0x05, 0x07, 0x01, 0x90, 0x00}},
+			want: [][]byte{
+				{0x00, insGetVersion, 0x00, 0x00, 0x00},
+				{0x00, insGetVersion, 0x00, 0x00, 0x03},
+			},
+		},
+		{
+			name:  "data",
+			cmd:   apdu{instruction: insGetData, param1: 0x3f, param2: 0xff, data: []byte{0x5c, 0x01, 0x7e}},
+			resps: [][]byte{{0x6c, 0x03}, {0x05, 0x07, 0x01, 0x90, 0x00}},
+			want: [][]byte{
+				{0x00, insGetData, 0x3f, 0xff, 0x03, 0x5c, 0x01, 0x7e},
+				{0x00, insGetData, 0x3f, 0xff, 0x03, 0x5c, 0x01, 0x7e, 0x03},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ft := &fakeTransport{resps: test.resps}
+			tx, err := beginTx(ft)
+			if err != nil {
+				t.Fatalf("beginning transaction: %v", err)
+			}
+			defer tx.Close()
+
+			got, err := tx.Transmit(test.cmd)
+			if err != nil {
+				t.Fatalf("transmit: %v", err)
+			}
+			if want := []byte{0x05, 0x07, 0x01}; !bytes.Equal(got, want) {
+				t.Errorf("response got=%x, want=%x", got, want)
+			}
+			if len(ft.cmds) != len(test.want) {
+				t.Fatalf("got %d commands, want %d", len(ft.cmds), len(test.want))
+			}
+			for i := range test.want {
+				if !bytes.Equal(ft.cmds[i], test.want[i]) {
+					t.Errorf("command %d got=%x, want=%x", i, ft.cmds[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOpenTransport(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+		},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	if got, want := yk.Version(), (Version{5, 7, 1}); got != want {
+		t.Errorf("version got=%v, want=%v", got, want)
+	}
+	if !bytes.Equal(ft.cmds[0][5:], aidPIV[:]) {
+		t.Errorf("expected piv applet to be selected, got command %x", ft.cmds[0])
+	}
+}
+
+// fakeATRTransport is a fakeTransport that also reports an ATR.
+type fakeATRTransport struct {
+	*fakeTransport
+	atr []byte
+}
+
+func (f *fakeATRTransport) ATR() ([]byte, error) {
+	return f.atr, nil
+}
+
+func TestTransmitExtended(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ft := &fakeATRTransport{
+		fakeTransport: &fakeTransport{
+			resps: [][]byte{
+				{0x90, 0x00},                         // SELECT
+				{0x05, 0x07, 0x01, 0x90, 0x00},       // GET VERSION
+				{0x00, 0x01, 0xe2, 0x40, 0x90, 0x00}, // GET SERIAL
+				{0x01, 0x02, 0x90, 0x00},
+			},
+		},
+		atr: testYubiKeyATR,
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	got, err := yk.tx.Transmit(apdu{instruction: insPutData, param1: 0x3f, param2: 0xff, data: data})
+	if err != nil {
+		t.Fatalf("transmit: %v", err)
+	}
+	if want := []byte{0x01, 0x02}; !bytes.Equal(got, want) {
+		t.Errorf("response got=%x, want=%x", got, want)
+	}
+	want := append([]byte{0x00, insPutData, 0x3f, 0xff, 0x00, 0x01, 0x2c}, data...)
+	if len(ft.cmds) != 4 {
+		t.Fatalf("got %d commands, want 4", len(ft.cmds))
+	}
+	if !bytes.Equal(ft.cmds[3], want) {
+		t.Errorf("command got=%x, want=%x", ft.cmds[3], want)
+	}
+}
+
+func TestTransmitExtendedShortCommands(t *testing.T) {
+	ft := &fakeATRTransport{
+		fakeTransport: &fakeTransport{
+			resps: append(testOpenResps,
+				[]byte{0x90, 0x00},
+				[]byte{0x53, 0x00, 0x90, 0x00},
+			),
+		},
+		atr: testYubiKeyATR,
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+	if !yk.extended {
+		t.Fatalf("expected extended length apdus to be enabled")
+	}
+
+	// Commands that fit in a short APDU are sent as one, even though the card
+	// supports extended length.
+	if want := []byte{0x00, insGetVersion, 0x00, 0x00, 0x00}; !bytes.Equal(ft.cmds[1], want) {
+		t.Errorf("get version got=%x, want=%x", ft.cmds[1], want)
+	}
+	n := len(ft.cmds)
+	pin := []byte("123456\xff\xff")
+	if _, err := yk.tx.Transmit(apdu{instruction: insVerify, param2: 0x80, data: pin}); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	want := append([]byte{0x00, insVerify, 0x00, 0x80, byte(len(pin))}, pin...)
+	if !bytes.Equal(ft.cmds[n], want) {
+		t.Errorf("verify got=%x, want=%x", ft.cmds[n], want)
+	}
+
+	// Commands with long responses request them at once with an extended Le.
+	tag := []byte{0x5c, 0x03, 0x5f, 0xc1, 0x05}
+	if _, err := yk.tx.Transmit(apdu{instruction: insGetData, param1: 0x3f, param2: 0xff, data: tag}); err != nil {
+		t.Fatalf("get data: %v", err)
+	}
+	want = append([]byte{0x00, insGetData, 0x3f, 0xff, 0x00, 0x00, byte(len(tag))}, tag...)
+	want = append(want, 0x00, 0x00)
+	if !bytes.Equal(ft.cmds[n+1], want) {
+		t.Errorf("get data got=%x, want=%x", ft.cmds[n+1], want)
+	}
+}
+
+// fakeMaxInputTransport is a fakeATRTransport connected through a reader that
+// reports the size of the largest command it accepts.
+type fakeMaxInputTransport struct {
+	*fakeATRTransport
+	max int
+	err error
+}
+
+func (f *fakeMaxInputTransport) maxInput() (int, error) {
+	return f.max, f.err
+}
+
+func TestTransmitExtendedMaxInput(t *testing.T) {
+	tests := []struct {
+		name         string
+		max          int
+		err          error
+		wantExtended bool
+		wantCmds     int
+	}{
+		{"Extended", 0x10000 + 9, nil, true, 1},
+		{"Limited", 300, nil, true, 2},
+		{"Short", maxShortAPDUSize, nil, false, 2},
+		{"Unknown", 0, errors.New("unsupported attribute"), false, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ft := &fakeMaxInputTransport{
+				fakeATRTransport: &fakeATRTransport{
+					fakeTransport: &fakeTransport{
+						resps: append(testOpenResps, []byte{0x90, 0x00}, []byte{0x90, 0x00}),
+					},
+					atr: testYubiKeyATR,
+				},
+				max: test.max,
+				err: test.err,
+			}
+			yk, err := OpenTransport(ft)
+			if err != nil {
+				t.Fatalf("opening transport: %v", err)
+			}
+			defer yk.Close()
+			if yk.extended != test.wantExtended {
+				t.Errorf("extended got=%t, want=%t", yk.extended, test.wantExtended)
+			}
+			// Too large for a reader accepting 300 bytes, so it's chained.
+			n := len(ft.cmds)
+			if _, err := yk.tx.Transmit(apdu{instruction: insPutData, param1: 0x3f, param2: 0xff, data: make([]byte, 400)}); err != nil {
+				t.Fatalf("transmit: %v", err)
+			}
+			if got := len(ft.cmds) - n; got != test.wantCmds {
+				t.Errorf("got %d commands, want %d", got, test.wantCmds)
+			}
+		})
+	}
+}
+
+func TestTransmitExtendedResponse(t *testing.T) {
+	yk, close := newTestEmulator(t)
+	defer close()
+
+	data := make([]byte, 2000)
+	if err := yk.PutData(DefaultManagementKey, ObjectFacialImage, data); err != nil {
+		t.Fatalf("storing data: %v", err)
+	}
+	var cmds []byte
+	yk.SetTracer(func(tr *APDUTrace) {
+		cmds = append(cmds, tr.Command[1])
+	})
+	got, err := yk.GetData(ObjectFacialImage)
+	if err != nil {
+		t.Fatalf("reading data: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d", len(got), len(data))
+	}
+	// The response is returned at once, without GET RESPONSE.
+	if want := []byte{insGetData}; !bytes.Equal(cmds, want) {
+		t.Errorf("got commands %x, want %x", cmds, want)
+	}
+}
+
+// fakeT0Transport is a fakeATRTransport that negotiated T=0 with the card.
+type fakeT0Transport struct {
+	*fakeATRTransport
+}
+
+func (f *fakeT0Transport) activeProtocol() uint32 {
+	return scProtocolT0
+}
+
+func TestOpenTransportT0(t *testing.T) {
+	ft := &fakeT0Transport{&fakeATRTransport{
+		fakeTransport: &fakeTransport{
+			resps: [][]byte{
+				{0x90, 0x00},                   // SELECT
+				{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+				testSerialResp,
+			},
+		},
+		atr: testYubiKeyATR,
+	}}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+	if yk.extended {
+		t.Errorf("expected extended length apdus to be disabled for T=0")
+	}
+}
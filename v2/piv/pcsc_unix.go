@@ -12,8 +12,10 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build darwin || linux || freebsd || openbsd
+//go:build (darwin || linux || freebsd || openbsd) && cgo && (darwin || !pcscgo)
 // +build darwin linux freebsd openbsd
+// +build cgo
+// +build darwin !pcscgo
 
 package piv
 
@@ -29,13 +31,14 @@ package piv
 // #cgo openbsd CFLAGS: -I/usr/local/include/PCSC
 // #cgo openbsd LDFLAGS: -L/usr/local/lib/
 // #cgo openbsd LDFLAGS: -lpcsclite
+// #include <stdlib.h>
 // #include <PCSC/winscard.h>
 // #include <PCSC/wintypes.h>
 import "C"
 
 import (
 	"bytes"
-	"fmt"
+	"time"
 	"unsafe"
 )
 
@@ -88,65 +91,156 @@ func (c *scContext) ListReaders() ([]string, error) {
 	return readers, nil
 }
 
+// GetStatusChange blocks until the state of one of the readers differs from
+// the provided current state, or the timeout expires. A negative timeout
+// waits indefinitely.
+func (c *scContext) GetStatusChange(readers []scReaderState, timeout time.Duration) error {
+	if len(readers) == 0 {
+		return nil
+	}
+	states := make([]C.SCARD_READERSTATE, len(readers))
+	for i, r := range readers {
+		name := C.CString(r.reader)
+		defer C.free(unsafe.Pointer(name))
+		states[i].szReader = name
+		states[i].dwCurrentState = C.DWORD(r.currentState)
+	}
+	t := C.DWORD(C.INFINITE)
+	if timeout >= 0 {
+		t = C.DWORD(timeout / time.Millisecond)
+	}
+	rc := C.SCardGetStatusChange(c.ctx, t, &states[0], C.DWORD(len(states)))
+	if err := scCheck(rc); err != nil {
+		return err
+	}
+	for i := range readers {
+		s := &states[i]
+		readers[i].eventState = uint32(s.dwEventState)
+		readers[i].atr = C.GoBytes(unsafe.Pointer(&s.rgbAtr[0]), C.int(s.cbAtr))
+	}
+	return nil
+}
+
+// Cancel aborts a GetStatusChange call blocked on another goroutine.
+func (c *scContext) Cancel() error {
+	return scCheck(C.SCardCancel(c.ctx))
+}
+
 type scHandle struct {
-	h C.SCARDHANDLE
+	h         C.SCARDHANDLE
+	shareMode uint32
+	protocol  uint32
 }
 
-func (c *scContext) Connect(reader string) (*scHandle, error) {
+func (c *scContext) Connect(reader string, shareMode uint32) (*scHandle, error) {
 	var (
 		handle         C.SCARDHANDLE
 		activeProtocol C.DWORD
 	)
 	rc := C.SCardConnect(c.ctx, C.CString(reader),
-		C.SCARD_SHARE_EXCLUSIVE, C.SCARD_PROTOCOL_T1,
+		C.DWORD(shareMode), C.SCARD_PROTOCOL_T0|C.SCARD_PROTOCOL_T1,
 		&handle, &activeProtocol)
 	if err := scCheck(rc); err != nil {
 		return nil, err
 	}
-	return &scHandle{handle}, nil
+	return &scHandle{handle, shareMode, uint32(activeProtocol)}, nil
 }
 
 func (h *scHandle) Close() error {
 	return scCheck(C.SCardDisconnect(h.h, C.SCARD_LEAVE_CARD))
 }
 
-type scTx struct {
-	h C.SCARDHANDLE
+// Reconnect re-establishes the connection to the card after it was reset by
+// another process or lost power.
+func (h *scHandle) Reconnect() error {
+	var activeProtocol C.DWORD
+	rc := C.SCardReconnect(h.h, C.DWORD(h.shareMode), C.SCARD_PROTOCOL_T0|C.SCARD_PROTOCOL_T1,
+		C.SCARD_LEAVE_CARD, &activeProtocol)
+	if err := scCheck(rc); err != nil {
+		return err
+	}
+	h.protocol = uint32(activeProtocol)
+	return nil
+}
+
+// activeProtocol returns the transmission protocol negotiated with the card.
+func (h *scHandle) activeProtocol() uint32 {
+	return h.protocol
 }
 
-func (h *scHandle) Begin() (*scTx, error) {
-	if err := scCheck(C.SCardBeginTransaction(h.h)); err != nil {
+func (h *scHandle) ATR() ([]byte, error) {
+	var (
+		atr      [C.MAX_ATR_SIZE]byte
+		atrN     = C.DWORD(len(atr))
+		state    C.DWORD
+		protocol C.DWORD
+	)
+	rc := C.SCardStatus(h.h, nil, nil, &state, &protocol, (*C.BYTE)(&atr[0]), &atrN)
+	if err := scCheck(rc); err != nil {
 		return nil, err
 	}
-	return &scTx{h.h}, nil
+	return append([]byte(nil), atr[:atrN]...), nil
+}
+
+func (h *scHandle) BeginTransaction() error {
+	return scCheck(C.SCardBeginTransaction(h.h))
 }
 
-func (t *scTx) Close() error {
-	return scCheck(C.SCardEndTransaction(t.h, C.SCARD_LEAVE_CARD))
+func (h *scHandle) EndTransaction() error {
+	return scCheck(C.SCardEndTransaction(h.h, C.SCARD_LEAVE_CARD))
 }
 
-func (t *scTx) transmit(req []byte) (more bool, b []byte, err error) {
+func (h *scHandle) Transmit(req []byte) ([]byte, error) {
 	var resp [C.MAX_BUFFER_SIZE_EXTENDED]byte
 	reqN := C.DWORD(len(req))
 	respN := C.DWORD(len(resp))
+	pci := C.SCARD_PCI_T1
+	if h.protocol == scProtocolT0 {
+		pci = C.SCARD_PCI_T0
+	}
 	rc := C.SCardTransmit(
-		t.h,
-		C.SCARD_PCI_T1,
+		h.h,
+		pci,
 		(*C.BYTE)(&req[0]), reqN, nil,
 		(*C.BYTE)(&resp[0]), &respN)
 	if err := scCheck(rc); err != nil {
-		return false, nil, fmt.Errorf("transmitting request: %w", err)
+		return nil, err
 	}
-	if respN < 2 {
-		return false, nil, fmt.Errorf("scard response too short: %d", respN)
+	return append([]byte(nil), resp[:respN]...), nil
+}
+
+// maxInput returns the size of the largest command APDU the reader accepts.
+func (h *scHandle) maxInput() (int, error) {
+	var (
+		attr  [8]byte
+		attrN = C.DWORD(len(attr))
+	)
+	rc := C.SCardGetAttrib(h.h, C.DWORD(scAttrMaxInput), (*C.BYTE)(&attr[0]), &attrN)
+	if err := scCheck(rc); err != nil {
+		return 0, err
 	}
-	sw1 := resp[respN-2]
-	sw2 := resp[respN-1]
-	if sw1 == 0x90 && sw2 == 0x00 {
-		return false, resp[:respN-2], nil
+	return parseAttrInt(attr[:attrN])
+}
+
+// Control sends a command directly to the reader, such as a request to verify
+// a PIN using the reader's PIN pad.
+func (h *scHandle) Control(code uint32, req []byte) ([]byte, error) {
+	var (
+		resp      [C.MAX_BUFFER_SIZE_EXTENDED]byte
+		reqPtr    unsafe.Pointer
+		respN     C.DWORD
+		reqLength = C.DWORD(len(req))
+	)
+	if len(req) > 0 {
+		reqPtr = unsafe.Pointer(&req[0])
 	}
-	if sw1 == 0x61 {
-		return true, resp[:respN-2], nil
+	rc := C.SCardControl(
+		h.h,
+		C.DWORD(code),
+		C.LPCVOID(reqPtr), reqLength,
+		C.LPVOID(unsafe.Pointer(&resp[0])), C.DWORD(len(resp)), &respN)
+	if err := scCheck(rc); err != nil {
+		return nil, err
 	}
-	return false, nil, &apduErr{sw1, sw2}
+	return append([]byte(nil), resp[:respN]...), nil
 }
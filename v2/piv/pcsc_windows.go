@@ -17,6 +17,7 @@ package piv
 import (
 	"fmt"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -26,19 +27,26 @@ var (
 	procSCardListReadersW     = winscard.NewProc("SCardListReadersW")
 	procSCardReleaseContext   = winscard.NewProc("SCardReleaseContext")
 	procSCardConnectW         = winscard.NewProc("SCardConnectW")
+	procSCardReconnect        = winscard.NewProc("SCardReconnect")
 	procSCardDisconnect       = winscard.NewProc("SCardDisconnect")
 	procSCardBeginTransaction = winscard.NewProc("SCardBeginTransaction")
 	procSCardEndTransaction   = winscard.NewProc("SCardEndTransaction")
 	procSCardTransmit         = winscard.NewProc("SCardTransmit")
+	procSCardControl          = winscard.NewProc("SCardControl")
+	procSCardGetAttrib        = winscard.NewProc("SCardGetAttrib")
+	procSCardStatusW          = winscard.NewProc("SCardStatusW")
+	procSCardGetStatusChangeW = winscard.NewProc("SCardGetStatusChangeW")
+	procSCardCancel           = winscard.NewProc("SCardCancel")
 )
 
 const (
 	scardScopeSystem      = 2
-	scardShareExclusive   = 1
 	scardLeaveCard        = 0
+	scardProtocolT0       = 1
 	scardProtocolT1       = 2
-	scardPCIT1            = 0
 	maxBufferSizeExtended = (4 + 3 + (1 << 16) + 3 + 2)
+	maxATRSize            = 36
+	infinite              = 0xffffffff
 	rcSuccess             = 0
 )
 
@@ -122,10 +130,65 @@ func (c *scContext) ListReaders() ([]string, error) {
 	return readers, nil
 }
 
-func (c *scContext) Connect(reader string) (*scHandle, error) {
+// scardReaderStateW mirrors SCARD_READERSTATEW.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/winscard/ns-winscard-scard_readerstatew
+type scardReaderStateW struct {
+	reader       *uint16
+	userData     uintptr
+	currentState uint32
+	eventState   uint32
+	atrLen       uint32
+	atr          [maxATRSize]byte
+}
+
+// GetStatusChange blocks until the state of one of the readers differs from
+// the provided current state, or the timeout expires. A negative timeout
+// waits indefinitely.
+func (c *scContext) GetStatusChange(readers []scReaderState, timeout time.Duration) error {
+	if len(readers) == 0 {
+		return nil
+	}
+	states := make([]scardReaderStateW, len(readers))
+	for i, r := range readers {
+		name, err := syscall.UTF16PtrFromString(r.reader)
+		if err != nil {
+			return fmt.Errorf("invalid reader string: %v", err)
+		}
+		states[i].reader = name
+		states[i].currentState = r.currentState
+	}
+	t := uintptr(infinite)
+	if timeout >= 0 {
+		t = uintptr(timeout / time.Millisecond)
+	}
+	r0, _, _ := procSCardGetStatusChangeW.Call(
+		uintptr(c.ctx),
+		t,
+		uintptr(unsafe.Pointer(&states[0])),
+		uintptr(len(states)),
+	)
+	if err := scCheck(r0); err != nil {
+		return err
+	}
+	for i := range readers {
+		s := &states[i]
+		readers[i].eventState = s.eventState
+		readers[i].atr = append([]byte(nil), s.atr[:s.atrLen]...)
+	}
+	return nil
+}
+
+// Cancel aborts a GetStatusChange call blocked on another goroutine.
+func (c *scContext) Cancel() error {
+	r0, _, _ := procSCardCancel.Call(uintptr(c.ctx))
+	return scCheck(r0)
+}
+
+func (c *scContext) Connect(reader string, shareMode uint32) (*scHandle, error) {
 	var (
 		handle         syscall.Handle
-		activeProtocol uint16
+		activeProtocol uint32
 	)
 	readerPtr, err := syscall.UTF16PtrFromString(reader)
 	if err != nil {
@@ -134,19 +197,30 @@ func (c *scContext) Connect(reader string) (*scHandle, error) {
 	r0, _, _ := procSCardConnectW.Call(
 		uintptr(c.ctx),
 		uintptr(unsafe.Pointer(readerPtr)),
-		scardShareExclusive,
-		scardProtocolT1,
+		uintptr(shareMode),
+		scardProtocolT0|scardProtocolT1,
 		uintptr(unsafe.Pointer(&handle)),
-		uintptr(activeProtocol),
+		uintptr(unsafe.Pointer(&activeProtocol)),
 	)
 	if err := scCheck(r0); err != nil {
 		return nil, err
 	}
-	return &scHandle{handle}, nil
+	return &scHandle{handle, shareMode, activeProtocol}, nil
 }
 
 type scHandle struct {
-	handle syscall.Handle
+	handle    syscall.Handle
+	shareMode uint32
+	protocol  uint32
+}
+
+// scardIORequest is the protocol control information passed to SCardTransmit,
+// equivalent to the SCARD_PCI_T0 and SCARD_PCI_T1 globals.
+//
+// https://learn.microsoft.com/en-us/windows/win32/secauthn/scard-io-request
+type scardIORequest struct {
+	protocol  uint32
+	pciLength uint32
 }
 
 func (h *scHandle) Close() error {
@@ -154,50 +228,121 @@ func (h *scHandle) Close() error {
 	return scCheck(r0)
 }
 
-func (h *scHandle) Begin() (*scTx, error) {
-	r0, _, _ := procSCardBeginTransaction.Call(uintptr(h.handle))
+// Reconnect re-establishes the connection to the card after it was reset by
+// another process or lost power.
+func (h *scHandle) Reconnect() error {
+	var activeProtocol uint32
+	r0, _, _ := procSCardReconnect.Call(
+		uintptr(h.handle),
+		uintptr(h.shareMode),
+		scardProtocolT0|scardProtocolT1,
+		scardLeaveCard,
+		uintptr(unsafe.Pointer(&activeProtocol)),
+	)
+	if err := scCheck(r0); err != nil {
+		return err
+	}
+	h.protocol = activeProtocol
+	return nil
+}
+
+// activeProtocol returns the transmission protocol negotiated with the card.
+func (h *scHandle) activeProtocol() uint32 {
+	return h.protocol
+}
+
+func (h *scHandle) ATR() ([]byte, error) {
+	var (
+		atr      [maxATRSize]byte
+		atrN     = uint32(len(atr))
+		state    uint32
+		protocol uint32
+	)
+	r0, _, _ := procSCardStatusW.Call(
+		uintptr(h.handle),
+		uintptr(0),
+		uintptr(0),
+		uintptr(unsafe.Pointer(&state)),
+		uintptr(unsafe.Pointer(&protocol)),
+		uintptr(unsafe.Pointer(&atr[0])),
+		uintptr(unsafe.Pointer(&atrN)),
+	)
 	if err := scCheck(r0); err != nil {
 		return nil, err
 	}
-	return &scTx{h.handle}, nil
+	return append([]byte(nil), atr[:atrN]...), nil
 }
 
-func (t *scTx) Close() error {
-	r0, _, _ := procSCardEndTransaction.Call(uintptr(t.handle), scardLeaveCard)
+func (h *scHandle) BeginTransaction() error {
+	r0, _, _ := procSCardBeginTransaction.Call(uintptr(h.handle))
 	return scCheck(r0)
 }
 
-type scTx struct {
-	handle syscall.Handle
+func (h *scHandle) EndTransaction() error {
+	r0, _, _ := procSCardEndTransaction.Call(uintptr(h.handle), scardLeaveCard)
+	return scCheck(r0)
 }
 
-func (t *scTx) transmit(req []byte) (more bool, b []byte, err error) {
+func (h *scHandle) Transmit(req []byte) ([]byte, error) {
 	var resp [maxBufferSizeExtended]byte
 	reqN := len(req)
-	respN := len(resp)
+	respN := uint32(len(resp))
+	pci := scardIORequest{protocol: h.protocol, pciLength: uint32(unsafe.Sizeof(scardIORequest{}))}
 	r0, _, _ := procSCardTransmit.Call(
-		uintptr(t.handle),
-		uintptr(scardPCIT1),
+		uintptr(h.handle),
+		uintptr(unsafe.Pointer(&pci)),
 		uintptr(unsafe.Pointer(&req[0])),
 		uintptr(reqN),
 		uintptr(0),
 		uintptr(unsafe.Pointer(&resp[0])),
 		uintptr(unsafe.Pointer(&respN)),
 	)
-
 	if err := scCheck(r0); err != nil {
-		return false, nil, fmt.Errorf("transmitting request: %w", err)
+		return nil, err
 	}
-	if respN < 2 {
-		return false, nil, fmt.Errorf("scard response too short: %d", respN)
+	return append([]byte(nil), resp[:respN]...), nil
+}
+
+// maxInput returns the size of the largest command APDU the reader accepts.
+func (h *scHandle) maxInput() (int, error) {
+	var (
+		attr  [8]byte
+		attrN = uint32(len(attr))
+	)
+	r0, _, _ := procSCardGetAttrib.Call(
+		uintptr(h.handle),
+		uintptr(scAttrMaxInput),
+		uintptr(unsafe.Pointer(&attr[0])),
+		uintptr(unsafe.Pointer(&attrN)),
+	)
+	if err := scCheck(r0); err != nil {
+		return 0, err
 	}
-	sw1 := resp[respN-2]
-	sw2 := resp[respN-1]
-	if sw1 == 0x90 && sw2 == 0x00 {
-		return false, resp[:respN-2], nil
+	return parseAttrInt(attr[:attrN])
+}
+
+// Control sends a command directly to the reader, such as a request to verify
+// a PIN using the reader's PIN pad.
+func (h *scHandle) Control(code uint32, req []byte) ([]byte, error) {
+	var (
+		resp   [maxBufferSizeExtended]byte
+		reqPtr uintptr
+		respN  uint32
+	)
+	if len(req) > 0 {
+		reqPtr = uintptr(unsafe.Pointer(&req[0]))
 	}
-	if sw1 == 0x61 {
-		return true, resp[:respN-2], nil
+	r0, _, _ := procSCardControl.Call(
+		uintptr(h.handle),
+		uintptr(code),
+		reqPtr,
+		uintptr(len(req)),
+		uintptr(unsafe.Pointer(&resp[0])),
+		uintptr(len(resp)),
+		uintptr(unsafe.Pointer(&respN)),
+	)
+	if err := scCheck(r0); err != nil {
+		return nil, err
 	}
-	return false, nil, &apduErr{sw1, sw2}
+	return append([]byte(nil), resp[:respN]...), nil
 }
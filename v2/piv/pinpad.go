@@ -0,0 +1,224 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// ControlTransport is an optional interface implemented by Transports that
+// can send commands directly to the smart card reader, rather than the card.
+// YubiKeys using such transports can verify PINs using the reader's PIN pad.
+type ControlTransport interface {
+	Transport
+	// Control sends a command to the reader, equivalent to SCardControl.
+	Control(code uint32, req []byte) ([]byte, error)
+}
+
+// ErrNoPINPad is returned when a PIN pad operation is requested but the
+// reader doesn't support entering PINs on a PIN pad.
+var ErrNoPINPad = errors.New("reader doesn't support pin pad entry")
+
+// scCtlCode returns the control code of a reader function, equivalent to the
+// SCARD_CTL_CODE macro of the platform.
+func scCtlCode(code uint32) uint32 {
+	if runtime.GOOS == "windows" {
+		// CTL_CODE(FILE_DEVICE_SMARTCARD, code, METHOD_BUFFERED, FILE_ANY_ACCESS)
+		return 0x31<<16 | code<<2
+	}
+	return 0x42000000 + code
+}
+
+// PC/SC part 10 features of readers with PIN pads.
+//
+// https://pcscworkgroup.com/Download/Specifications/pcsc10_v2.02.09.pdf
+const (
+	// ctlGetFeatureRequest is the function of CM_IOCTL_GET_FEATURE_REQUEST,
+	// which lists the features supported by a reader.
+	ctlGetFeatureRequest = 3400
+
+	featureVerifyPINDirect = 0x06
+	featureModifyPINDirect = 0x07
+)
+
+// pinPadFeature returns the control code of a PC/SC part 10 feature of the
+// reader.
+func pinPadFeature(tx *scTx, feature byte) (uint32, error) {
+	ct, ok := tx.t.(ControlTransport)
+	if !ok {
+		return 0, ErrNoPINPad
+	}
+	resp, err := ct.Control(scCtlCode(ctlGetFeatureRequest), nil)
+	if err != nil {
+		// Readers without any part 10 features may not implement the
+		// request at all.
+		return 0, fmt.Errorf("%w: getting reader features: %w", ErrNoPINPad, err)
+	}
+	code, ok := parseFeatures(resp)[feature]
+	if !ok {
+		return 0, ErrNoPINPad
+	}
+	return code, nil
+}
+
+// parseFeatures parses the TLV list returned by CM_IOCTL_GET_FEATURE_REQUEST,
+// mapping features to their big endian control codes.
+func parseFeatures(b []byte) map[byte]uint32 {
+	features := make(map[byte]uint32)
+	for len(b) >= 2 {
+		tag, n := b[0], int(b[1])
+		if 2+n > len(b) {
+			break
+		}
+		if n == 4 {
+			features[tag] = binary.BigEndian.Uint32(b[2:6])
+		}
+		b = b[2+n:]
+	}
+	return features
+}
+
+const (
+	// PIN format used by the PIV applet: ASCII digits, left justified and
+	// padded with 0xff to 8 bytes.
+	//
+	// bmFormatString: system units are bytes, PIN at offset 0, left
+	// justified, ASCII.
+	pinPadFormatASCII = 0x82
+	// bmPINBlockString: no PIN length field, 8 byte PIN block.
+	pinPadBlock = 0x08
+	// Minimum and maximum PIN length in digits.
+	pinPadMinDigits = 6
+	pinPadMaxDigits = 8
+	// bEntryValidationCondition: the user presses the validation key.
+	pinPadValidationKey = 0x02
+	// wLangId for English (United States).
+	pinPadLangEnglish = 0x0409
+)
+
+// pinPadAPDU returns a short command APDU whose data consists of n PIN blocks
+// filled with 0xff. The reader replaces the start of each block with the
+// digits entered, leaving the remaining padding in place.
+func pinPadAPDU(ins, p2 byte, n int) []byte {
+	b := []byte{0x00, ins, 0x00, p2, byte(8 * n)}
+	for i := 0; i < 8*n; i++ {
+		b = append(b, 0xff)
+	}
+	return b
+}
+
+// pinVerifyStructure encodes the PIN_VERIFY_STRUCTURE for VERIFY of the given
+// key reference.
+func pinVerifyStructure(p2 byte) []byte {
+	apdu := pinPadAPDU(insVerify, p2, 1)
+	b := []byte{
+		0x00, // bTimerOut: reader default
+		0x00, // bTimerOut2: reader default
+		pinPadFormatASCII,
+		pinPadBlock,
+		0x00,                             // bmPINLengthFormat
+		pinPadMaxDigits, pinPadMinDigits, // wPINMaxExtraDigit
+		pinPadValidationKey,
+		0x01, // bNumberMessage
+		pinPadLangEnglish & 0xff, pinPadLangEnglish >> 8,
+		0x00,             // bMsgIndex
+		0x00, 0x00, 0x00, // bTeoPrologue
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(apdu)))
+	return append(b, apdu...)
+}
+
+// pinModifyStructure encodes the PIN_MODIFY_STRUCTURE for CHANGE REFERENCE
+// DATA of the given key reference.
+func pinModifyStructure(p2 byte) []byte {
+	apdu := pinPadAPDU(insChangeReference, p2, 2)
+	b := []byte{
+		0x00, // bTimerOut: reader default
+		0x00, // bTimerOut2: reader default
+		pinPadFormatASCII,
+		pinPadBlock,
+		0x00,                             // bmPINLengthFormat
+		0x00,                             // bInsertionOffsetOld
+		0x08,                             // bInsertionOffsetNew
+		pinPadMaxDigits, pinPadMinDigits, // wPINMaxExtraDigit
+		0x03, // bConfirmPIN: enter the current PIN and confirm the new one
+		pinPadValidationKey,
+		0x03, // bNumberMessage
+		pinPadLangEnglish & 0xff, pinPadLangEnglish >> 8,
+		0x00, 0x01, 0x02, // bMsgIndex1-3
+		0x00, 0x00, 0x00, // bTeoPrologue
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(apdu)))
+	return append(b, apdu...)
+}
+
+// ykPINPad runs a PIN pad feature of the reader, returning the card's status
+// word as an error.
+func ykPINPad(tx *scTx, feature byte, req []byte, ins, p2 byte) error {
+	code, err := pinPadFeature(tx, feature)
+	if err != nil {
+		return err
+	}
+	resp, err := tx.t.(ControlTransport).Control(code, req)
+	if err != nil {
+		if scCardLost(err) {
+			tx.lost = true
+		}
+		return fmt.Errorf("pin pad entry: %w", err)
+	}
+	if len(resp) < 2 {
+		return fmt.Errorf("pin pad response too short: %d", len(resp))
+	}
+	sw1, sw2 := resp[len(resp)-2], resp[len(resp)-1]
+	if sw1 == 0x90 && sw2 == 0x00 {
+		return nil
+	}
+	// Readers report a timeout or the user cancelling with status words of
+	// the form 0x64xx.
+	return &APDUError{sw1: sw1, sw2: sw2, ins: ins, p2: p2}
+}
+
+func ykLoginPINPad(tx *scTx) error {
+	return ykPINPad(tx, featureVerifyPINDirect, pinVerifyStructure(0x80), insVerify, 0x80)
+}
+
+func ykChangePINPad(tx *scTx) error {
+	return ykPINPad(tx, featureModifyPINDirect, pinModifyStructure(0x80), insChangeReference, 0x80)
+}
+
+// VerifyPINPad is like VerifyPIN, but the PIN is entered on the PIN pad of
+// the reader and never reaches the host. If the reader doesn't have a PIN pad,
+// the returned error wraps ErrNoPINPad.
+//
+// The PIN must be 6 to 8 digits.
+func (yk *YubiKey) VerifyPINPad() error {
+	return yk.with("VerifyPINPad", func(tx *scTx) error {
+		return ykLoginPINPad(tx)
+	})
+}
+
+// SetPINPad is like SetPIN, but both the current and new PIN are entered on
+// the PIN pad of the reader, which usually asks to confirm the new PIN. If the
+// reader doesn't have a PIN pad, the returned error wraps ErrNoPINPad.
+//
+// The PINs must be 6 to 8 digits.
+func (yk *YubiKey) SetPINPad() error {
+	return yk.with("SetPINPad", func(tx *scTx) error {
+		return ykChangePINPad(tx)
+	})
+}
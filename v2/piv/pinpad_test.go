@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// fakeControlTransport is a fakeTransport attached to a reader with a PIN pad.
+type fakeControlTransport struct {
+	*fakeTransport
+	// features is the response to CM_IOCTL_GET_FEATURE_REQUEST.
+	features []byte
+	// controls records the requests sent to each control code.
+	controls map[uint32][]byte
+	// sw is returned for PIN pad requests.
+	sw []byte
+}
+
+func (f *fakeControlTransport) Control(code uint32, req []byte) ([]byte, error) {
+	if code == scCtlCode(ctlGetFeatureRequest) {
+		return f.features, nil
+	}
+	if f.controls == nil {
+		f.controls = make(map[uint32][]byte)
+	}
+	f.controls[code] = append([]byte(nil), req...)
+	return f.sw, nil
+}
+
+func TestVerifyPINPad(t *testing.T) {
+	ft := &fakeControlTransport{
+		fakeTransport: &fakeTransport{
+			resps: [][]byte{
+				{0x90, 0x00},                   // SELECT
+				{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+				testSerialResp,
+			},
+		},
+		features: []byte{
+			0x06, 0x04, 0x42, 0x33, 0x00, 0x06, // FEATURE_VERIFY_PIN_DIRECT
+			0x07, 0x04, 0x42, 0x33, 0x00, 0x07, // FEATURE_MODIFY_PIN_DIRECT
+		},
+		sw: []byte{0x90, 0x00},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	if err := yk.VerifyPINPad(); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	want := []byte{
+		0x00, 0x00, 0x82, 0x08, 0x00, 0x08, 0x06, 0x02, 0x01, 0x09, 0x04, 0x00,
+		0x00, 0x00, 0x00,
+		0x0d, 0x00, 0x00, 0x00,
+		0x00, insVerify, 0x00, 0x80, 0x08,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	}
+	if got := ft.controls[0x42330006]; !bytes.Equal(got, want) {
+		t.Errorf("verify pin structure got=%x, want=%x", got, want)
+	}
+
+	ft.sw = []byte{0x63, 0xc2}
+	var authErr AuthErr
+	if err := yk.VerifyPINPad(); !errors.As(err, &authErr) || authErr.Retries != 2 {
+		t.Errorf("verifying pin: got err=%v, want AuthErr with 2 retries", err)
+	}
+
+	ft.sw = []byte{0x90, 0x00}
+	if err := yk.SetPINPad(); err != nil {
+		t.Fatalf("changing pin: %v", err)
+	}
+	if got := ft.controls[0x42330007]; len(got) != 24+21 || got[9] != 0x03 || got[24+4] != 0x10 {
+		t.Errorf("unexpected modify pin structure: %x", got)
+	}
+}
+
+func TestVerifyPINPadUnsupported(t *testing.T) {
+	ft := &fakeControlTransport{
+		fakeTransport: &fakeTransport{
+			resps: [][]byte{
+				{0x90, 0x00},                   // SELECT
+				{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+				testSerialResp,
+			},
+		},
+		features: []byte{0x12, 0x04, 0x42, 0x33, 0x00, 0x12}, // FEATURE_IFD_PIN_PROPERTIES
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	if err := yk.VerifyPINPad(); !errors.Is(err, ErrNoPINPad) {
+		t.Errorf("verifying pin: got err=%v, want ErrNoPINPad", err)
+	}
+}
@@ -16,6 +16,7 @@ package piv
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
@@ -26,6 +27,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"time"
 )
 
 var (
@@ -49,11 +51,12 @@ var (
 // strings describing the key, such as "Yubico Yubikey NEO OTP+U2F+CCID 00 00".
 //
 // Card names depend on the operating system and what port a card is plugged
-// into. To uniquely identify a card, use its serial number.
+// into. To uniquely identify a card, use its serial number, as reported by
+// ListCards and accepted by OpenBySerial.
 //
 // See: https://ludovicrousseau.blogspot.com/2010/05/what-is-in-pcsc-reader-name.html
 func Cards() ([]string, error) {
-	var c client
+	var c Client
 	return c.Cards()
 }
 
@@ -102,18 +105,80 @@ const (
 	insAttest        = 0xf9
 	insGetSerial     = 0xf8
 	insGetMetadata   = 0xf7
+	insMoveKey       = 0xf6
 )
 
-// YubiKey is an exclusive open connection to a YubiKey smart card. While open,
-// no other process can query the given card.
+// YubiKey is an open connection to a YubiKey smart card. Connections returned
+// by Open are exclusive, and while open, no other process can query the given
+// card. See OpenShared for connections that allow other processes to use the
+// card between operations.
+//
+// A YubiKey automatically reconnects to the card if the connection is lost,
+// for example because another process reset the card, as long as the same card
+// is still present. Since this discards any PIN or management key
+// authentication, the operation that observed the reset returns an error
+// wrapping ErrCardReset. Keys returned by PrivateKey authenticate again using
+// their KeyAuth and retry the operation instead.
+//
+// A YubiKey, and the keys returned by its PrivateKey method, are safe for
+// concurrent use by multiple goroutines. Operations run one at a time, in the
+// order they were started, so commands of different operations never
+// interleave. See SetMaxWaiting to bound the number of waiting operations.
 //
 // To release the connection, call the Close method.
 type YubiKey struct {
-	ctx *scContext
-	h   *scHandle
-	tx  *scTx
+	// ctx is nil if the YubiKey was opened with OpenTransport.
+	ctx scBackend
+
+	// mu serializes operations, which may continue in the background after
+	// their context was cancelled. Operations acquire it in the order they
+	// were started.
+	mu queueLock
+	// reader and shareMode are used to connect to the card again if the
+	// connection is lost.
+	reader    string
+	shareMode uint32
+	h         Transport
+	// tx is the transaction held for the lifetime of an exclusive connection.
+	// It's nil for shared connections, which begin a transaction for each
+	// operation.
+	tx     *scTx
+	shared bool
+	// lost is set if the connection to the card was lost and couldn't be
+	// re-established yet.
+	lost bool
+	// extended is set if the card and reader support extended length APDUs.
+	extended bool
+	// maxInput, if positive, is the size of the largest command APDU the
+	// reader accepts.
+	maxInput int
+	// contactless is set if the card is accessed through a contactless
+	// reader.
+	contactless bool
+	// contactlessRules is set if the card enforces PIV's access rules for the
+	// contactless interface, see scTx.
+	contactlessRules bool
+	// tracer, if set, receives every APDU exchanged with the card. op is the
+	// name of the operation in progress.
+	tracer Tracer
+	op     string
+	// recorder, if set, records every APDU exchanged with the card.
+	recorder *Recorder
+	// serial is the card's serial number, used to verify the same card is
+	// present after reconnecting. It's nil if the card doesn't report one.
+	serial *uint32
 
 	rand io.Reader
+	// timeout bounds operations whose context has no deadline.
+	timeout time.Duration
+	// managementKeyAlg, if non-zero, overrides the management key algorithm
+	// reported by the card.
+	managementKeyAlg byte
+	// pinCache is how long prompted PINs are cached, and pin holds the
+	// cached PIN, which expires at pinExpires unless it's zero.
+	pinCache   time.Duration
+	pin        string
+	pinExpires time.Time
 
 	// Used to determine how to access certain functionality.
 	//
@@ -123,9 +188,202 @@ type YubiKey struct {
 	version *version
 }
 
-// Close releases the connection to the smart card.
+// with runs f within a transaction with the card.
+//
+// For shared connections, a new transaction is started and the PIV applet is
+// selected again, since another process may have used the card since the last
+// operation. Selecting the applet resets the card's PIN verification state, so
+// PIN verification never carries over between operations.
+//
+// If the connection to the card is lost, for example because the card was
+// reset, with reconnects to the card and returns an error wrapping
+// ErrCardReset.
+//
+// The op name identifies the operation in APDU traces.
+func (yk *YubiKey) with(op string, f func(tx *scTx) error) error {
+	return yk.withContext(context.Background(), op, f)
+}
+
+// withContext is like with, but stops waiting for the card when ctx is done,
+// returning an error wrapping ErrCancelled and ctx.Err().
+//
+// The operation keeps running in the background until the card responds, since
+// PC/SC doesn't abort commands in progress; SCardCancel only interrupts waits
+// for card events. Later operations wait for it to finish, see ErrCancelled.
+func (yk *YubiKey) withContext(ctx context.Context, op string, f func(tx *scTx) error) error {
+	if _, ok := ctx.Deadline(); !ok && yk.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, yk.timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrCancelled, err)
+	}
+	if err := yk.mu.lock(ctx); err != nil {
+		if errors.Is(err, ErrBusy) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ErrCancelled, err)
+	}
+	if ctx.Done() == nil {
+		defer yk.mu.unlock()
+		return yk.run(op, f)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// The lock is held until the operation finishes, even if the caller
+		// stopped waiting for it.
+		defer yk.mu.unlock()
+		done <- yk.run(op, f)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if yk.ctx != nil {
+			yk.ctx.Cancel()
+		}
+		return fmt.Errorf("%w: %w", ErrCancelled, ctx.Err())
+	}
+}
+
+// run implements with. The caller must hold yk.mu.
+func (yk *YubiKey) run(op string, f func(tx *scTx) error) error {
+	yk.op = op
+	if yk.lost {
+		if err := yk.reconnect(); err != nil {
+			return fmt.Errorf("reconnecting to card: %w", err)
+		}
+		if !yk.shared {
+			// Authentication from earlier operations was lost.
+			return ErrCardReset
+		}
+	}
+
+	tx := yk.tx
+	if yk.shared {
+		var err error
+		tx, err = yk.begin()
+		if scCardLost(err) {
+			// The card was reset since the last operation, which shared
+			// connections don't rely on.
+			if err := yk.reconnect(); err != nil {
+				return fmt.Errorf("reconnecting to card: %w", err)
+			}
+			tx, err = yk.begin()
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		tx.op = op
+		tx.tracer = yk.tracer
+		tx.recorder = yk.recorder
+		tx.managementKeyAlg = yk.managementKeyAlg
+	}
+
+	err := f(tx)
+	if yk.shared {
+		if cerr := tx.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("ending smart card transaction: %w", cerr)
+		}
+	}
+	if !tx.lost {
+		return err
+	}
+	if rerr := yk.reconnect(); rerr != nil {
+		return fmt.Errorf("%w; reconnecting to card: %w", err, rerr)
+	}
+	return fmt.Errorf("%w: %w", ErrCardReset, err)
+}
+
+// begin starts a transaction and selects the PIV applet.
+func (yk *YubiKey) begin() (*scTx, error) {
+	tx, err := beginTx(yk.h)
+	if err != nil {
+		return nil, fmt.Errorf("beginning smart card transaction: %w", err)
+	}
+	tx.extended = yk.extended
+	tx.maxInput = yk.maxInput
+	tx.contactless = yk.contactless
+	tx.contactlessRules = yk.contactlessRules
+	tx.op = yk.op
+	tx.tracer = yk.tracer
+	tx.recorder = yk.recorder
+	tx.managementKeyAlg = yk.managementKeyAlg
+	if err := ykSelectApplication(tx, aidPIV[:]); err != nil {
+		tx.Close()
+		return nil, fmt.Errorf("selecting piv applet: %w", err)
+	}
+	return tx, nil
+}
+
+// reconnect re-establishes the connection to the card after it was lost, and
+// verifies the same card is still present.
+func (yk *YubiKey) reconnect() error {
+	yk.lost = true
+	if yk.tx != nil {
+		yk.tx.Close()
+		yk.tx = nil
+	}
+
+	var err error
+	if r, ok := yk.h.(ReconnectTransport); ok {
+		err = r.Reconnect()
+	} else {
+		err = errors.New("transport doesn't support reconnecting")
+	}
+	if err != nil {
+		if yk.ctx == nil {
+			return err
+		}
+		// The handle is no longer valid if the reader was removed, for
+		// example if the YubiKey was briefly disconnected. Connect again
+		// using the reader's name.
+		h, cerr := yk.ctx.connect(yk.reader, yk.shareMode)
+		if cerr != nil {
+			return fmt.Errorf("connecting to smart card: %w", cerr)
+		}
+		yk.h.Close()
+		yk.h = h
+	}
+
+	tx, err := yk.begin()
+	if err != nil {
+		return err
+	}
+	if yk.serial != nil {
+		serial, err := ykSerial(tx, yk.version)
+		if err != nil {
+			tx.Close()
+			return fmt.Errorf("getting serial number: %w", err)
+		}
+		if serial != *yk.serial {
+			tx.Close()
+			return fmt.Errorf("card changed, got serial number %d, want %d", serial, *yk.serial)
+		}
+	}
+	if yk.shared {
+		if err := tx.Close(); err != nil {
+			return fmt.Errorf("ending smart card transaction: %w", err)
+		}
+	} else {
+		yk.tx = tx
+	}
+	yk.lost = false
+	return nil
+}
+
+// Close releases the connection to the smart card, waiting for any operation
+// in progress to finish.
 func (yk *YubiKey) Close() error {
+	yk.mu.lockUnbounded()
+	defer yk.mu.unlock()
 	err1 := yk.h.Close()
+	if yk.ctx == nil {
+		return err1
+	}
 	err2 := yk.ctx.Close()
 	if err1 == nil {
 		return err2
@@ -135,21 +393,40 @@ func (yk *YubiKey) Close() error {
 
 // Open connects to a YubiKey smart card.
 func Open(card string) (*YubiKey, error) {
-	var c client
+	var c Client
 	return c.Open(card)
 }
 
-// client is a smart card client and may be exported in the future to allow
-// configuration for the top level Open() and Cards() APIs.
-type client struct {
-	// Rand is a cryptographic source of randomness used for card challenges.
-	//
-	// If nil, defaults to crypto.Rand.
-	Rand io.Reader
+// OpenShared connects to a YubiKey smart card without locking out other
+// processes, such as gpg-agent or ykman. Instead of holding the card for the
+// lifetime of the connection, each method of the returned YubiKey runs in its
+// own short transaction and selects the PIV applet before use.
+//
+// Because other processes may select different applets between operations,
+// PIN verification doesn't persist across method calls on a shared
+// connection. VerifyPIN only checks the PIN, and keys that require a PIN
+// authenticate using their KeyAuth within the same transaction as the signing
+// or decryption operation. As a result, KeyAuth.PINPrompt is called for every
+// operation that requires a PIN, even for keys with PINPolicyOnce.
+func OpenShared(card string) (*YubiKey, error) {
+	c := Client{ShareMode: ShareShared}
+	return c.Open(card)
 }
 
-func (c *client) Cards() ([]string, error) {
-	ctx, err := newSCContext()
+// OpenTransport initializes the PIV applet of a card reachable through the
+// provided transport. This allows the PIV logic of this package to be used
+// over channels other than the system's PC/SC implementation.
+//
+// On success, the returned YubiKey owns the transport and closes it when the
+// YubiKey is closed. On failure, the caller remains responsible for closing t.
+func OpenTransport(t Transport) (*YubiKey, error) {
+	var c Client
+	return c.OpenTransport(t)
+}
+
+// Cards lists all smart cards available through the client's backend.
+func (c *Client) Cards() ([]string, error) {
+	ctx, err := c.backend()
 	if err != nil {
 		return nil, fmt.Errorf("connecting to pcsc: %w", err)
 	}
@@ -157,38 +434,150 @@ func (c *client) Cards() ([]string, error) {
 	return ctx.ListReaders()
 }
 
-func (c *client) Open(card string) (*YubiKey, error) {
-	ctx, err := newSCContext()
+// Open connects to a YubiKey smart card using the client's configuration.
+func (c *Client) Open(card string) (*YubiKey, error) {
+	ctx, err := c.backend()
 	if err != nil {
 		return nil, fmt.Errorf("connecting to smart card daemon: %w", err)
 	}
 
-	h, err := ctx.Connect(card)
+	shareMode := uint32(scShareExclusive)
+	if c.ShareMode == ShareShared {
+		shareMode = scShareShared
+	}
+	h, err := ctx.connect(card, shareMode)
 	if err != nil {
 		ctx.Close()
 		return nil, fmt.Errorf("connecting to smart card: %w", err)
 	}
-	tx, err := h.Begin()
+	yk, err := c.openTransport(h, readerContactless(card))
+	if err != nil {
+		h.Close()
+		ctx.Close()
+		return nil, err
+	}
+	yk.ctx = ctx
+	yk.reader = card
+	yk.shareMode = shareMode
+	return yk, nil
+}
+
+// OpenTransport initializes the PIV applet of a card reachable through the
+// provided transport using the client's configuration. See OpenTransport.
+func (c *Client) OpenTransport(t Transport) (*YubiKey, error) {
+	return c.openTransport(t, false)
+}
+
+// openTransport is like OpenTransport. If readerContactless is set, the card
+// is treated as contactless even if its ATR doesn't say so.
+func (c *Client) openTransport(t Transport, readerContactless bool) (*YubiKey, error) {
+	if c.ShareMode != ShareExclusive && c.ShareMode != ShareShared {
+		return nil, fmt.Errorf("invalid share mode: %d", c.ShareMode)
+	}
+	var mgmtAlg byte
+	if c.ManagementKeyAlgorithm != 0 {
+		alg, ok := managementKeyAlgorithmMap[c.ManagementKeyAlgorithm]
+		if !ok {
+			return nil, fmt.Errorf("unsupported management key algorithm: %d", c.ManagementKeyAlgorithm)
+		}
+		mgmtAlg = alg
+	}
+	tx, err := beginTx(t)
 	if err != nil {
 		return nil, fmt.Errorf("beginning smart card transaction: %w", err)
 	}
+	yk := &YubiKey{
+		h:                t,
+		tx:               tx,
+		shared:           c.ShareMode == ShareShared,
+		tracer:           c.Tracer,
+		recorder:         c.Recorder,
+		timeout:          c.Timeout,
+		pinCache:         c.PINCache,
+		managementKeyAlg: mgmtAlg,
+	}
+	yk.mu.setMax(c.MaxWaiting)
+	tx.op = "Open"
+	tx.tracer = c.Tracer
+	tx.recorder = c.Recorder
+	tx.managementKeyAlg = mgmtAlg
+	if at, ok := t.(ATRTransport); ok {
+		// Cards whose ATR can't be read or parsed fall back to command
+		// chaining, which all cards support.
+		if b, err := at.ATR(); err == nil {
+			c.Recorder.recordATR(b)
+			if a, err := parseATR(b); err == nil {
+				yk.extended = a.extendedLength
+				yk.contactless = a.contactless
+				yk.contactlessRules = !a.yubiKey
+			}
+		}
+	}
+	if pt, ok := t.(protocolTransport); ok {
+		p := pt.activeProtocol()
+		c.Recorder.recordProtocol(p)
+		if p == scProtocolT0 {
+			// T=0 can't carry extended length commands without wrapping
+			// them in ENVELOPE commands, so use command chaining instead.
+			yk.extended = false
+		}
+	}
+	if mt, ok := t.(maxInputTransport); ok && yk.extended {
+		// Readers that don't report accepting more than a short command,
+		// or don't report their limit at all, use command chaining.
+		n, err := mt.maxInput()
+		if err != nil {
+			n = 0
+		}
+		c.Recorder.recordMaxInput(n)
+		if n <= maxShortAPDUSize {
+			yk.extended = false
+		} else {
+			yk.maxInput = n
+		}
+	}
+	if ct, ok := t.(contactlessTransport); ok && ct.contactless() {
+		readerContactless = true
+	}
+	if readerContactless {
+		c.Recorder.recordContactless()
+		yk.contactless = true
+	}
+	if yk.contactless {
+		// Contactless readers often don't support extended length commands.
+		yk.extended = false
+	}
+	tx.extended = yk.extended
+	tx.maxInput = yk.maxInput
+	tx.contactless = yk.contactless
+	tx.contactlessRules = yk.contactlessRules
 	if err := ykSelectApplication(tx, aidPIV[:]); err != nil {
 		tx.Close()
 		return nil, fmt.Errorf("selecting piv applet: %w", err)
 	}
 
-	yk := &YubiKey{ctx: ctx, h: h, tx: tx}
-	v, err := ykVersion(yk.tx)
+	v, err := ykVersion(tx)
 	if err != nil {
-		yk.Close()
+		tx.Close()
 		return nil, fmt.Errorf("getting yubikey version: %w", err)
 	}
 	yk.version = v
+	// Not all cards report a serial number, in which case it isn't verified
+	// when reconnecting.
+	if serial, err := ykSerial(tx, v); err == nil {
+		yk.serial = &serial
+	}
 	if c.Rand != nil {
 		yk.rand = c.Rand
 	} else {
 		yk.rand = rand.Reader
 	}
+	if yk.shared {
+		if err := tx.Close(); err != nil {
+			return nil, fmt.Errorf("ending smart card transaction: %w", err)
+		}
+		yk.tx = nil
+	}
 	return yk, nil
 }
 
@@ -207,7 +596,12 @@ func (yk *YubiKey) Version() Version {
 
 // Serial returns the YubiKey's serial number.
 func (yk *YubiKey) Serial() (uint32, error) {
-	return ykSerial(yk.tx, yk.version)
+	var serial uint32
+	err := yk.with("Serial", func(tx *scTx) (err error) {
+		serial, err = ykSerial(tx, yk.version)
+		return err
+	})
+	return serial, err
 }
 
 func encodePIN(pin string) ([]byte, error) {
@@ -239,8 +633,13 @@ func encodePIN(pin string) ([]byte, error) {
 // point the PUK must be used to unblock the PIN.
 //
 // Use DefaultPIN if the PIN hasn't been set.
+//
+// For connections opened with OpenShared, the PIN is only verified for the
+// duration of the call.
 func (yk *YubiKey) VerifyPIN(pin string) error {
-	return ykLogin(yk.tx, pin)
+	return yk.with("VerifyPIN", func(tx *scTx) error {
+		return ykLogin(tx, pin)
+	})
 }
 
 func ykLogin(tx *scTx, pin string) error {
@@ -268,7 +667,12 @@ func ykLoginNeeded(tx *scTx) bool {
 
 // Retries returns the number of attempts remaining to enter the correct PIN.
 func (yk *YubiKey) Retries() (int, error) {
-	return ykPINRetries(yk.tx)
+	var retries int
+	err := yk.with("Retries", func(tx *scTx) (err error) {
+		retries, err = ykPINRetries(tx)
+		return err
+	})
+	return retries, err
 }
 
 func ykPINRetries(tx *scTx) (int, error) {
@@ -288,7 +692,16 @@ func ykPINRetries(tx *scTx) (int, error) {
 // and resetting the PIN, PUK, and Management Key to their default values. This
 // does NOT affect data on other applets, such as GPG or U2F.
 func (yk *YubiKey) Reset() error {
-	return ykReset(yk.tx, yk.rand)
+	return yk.ResetContext(context.Background())
+}
+
+// ResetContext is like Reset, but stops waiting for the card when ctx is done.
+// The returned error then wraps ErrCancelled and ctx.Err(). The command
+// already sent to the card isn't aborted, see ErrCancelled.
+func (yk *YubiKey) ResetContext(ctx context.Context) error {
+	return yk.withContext(ctx, "Reset", func(tx *scTx) error {
+		return ykReset(tx, yk.rand)
+	})
 }
 
 func ykReset(tx *scTx, r io.Reader) error {
@@ -357,7 +770,9 @@ type version struct {
 //
 // Use DefaultManagementKey if the management key hasn't been set.
 func (yk *YubiKey) authManagementKey(key []byte) error {
-	return ykAuthenticate(yk.tx, key, yk.rand, yk.version)
+	return yk.with("authManagementKey", func(tx *scTx) error {
+		return ykAuthenticate(tx, key, yk.rand, yk.version)
+	})
 }
 
 var (
@@ -383,8 +798,8 @@ func ykAuthenticate(tx *scTx, key []byte, rand io.Reader, version *version) erro
 	// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=92
 	// https://tsapps.nist.gov/publication/get_pdf.cfm?pub_id=918402#page=114
 
-	var managementKeyType byte
-	if supportsVersion(version, 5, 3, 0) {
+	managementKeyType := tx.managementKeyAlg
+	if managementKeyType == 0 && supportsVersion(version, 5, 3, 0) {
 		// if yubikey version >= 5.3.0, determine management key type using slot metadata
 		cmd := apdu{
 			instruction: insGetMetadata,
@@ -522,13 +937,15 @@ func ykAuthenticate(tx *scTx, key []byte, rand io.Reader, version *version) erro
 //		// ...
 //	}
 func (yk *YubiKey) SetManagementKey(oldKey, newKey []byte) error {
-	if err := ykAuthenticate(yk.tx, oldKey, yk.rand, yk.version); err != nil {
-		return fmt.Errorf("authenticating with old key: %w", err)
-	}
-	if err := ykSetManagementKey(yk.tx, newKey, false, yk.version); err != nil {
-		return err
-	}
-	return nil
+	return yk.with("SetManagementKey", func(tx *scTx) error {
+		if err := ykAuthenticate(tx, oldKey, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with old key: %w", err)
+		}
+		if err := ykSetManagementKey(tx, newKey, false, yk.version); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 // ykSetManagementKey updates the management key to a new key. This requires
@@ -586,7 +1003,9 @@ func ykSetManagementKey(tx *scTx, key []byte, touch bool, version *version) erro
 //		// ...
 //	}
 func (yk *YubiKey) SetPIN(oldPIN, newPIN string) error {
-	return ykChangePIN(yk.tx, oldPIN, newPIN)
+	return yk.with("SetPIN", func(tx *scTx) error {
+		return ykChangePIN(tx, oldPIN, newPIN)
+	})
 }
 
 func ykChangePIN(tx *scTx, oldPIN, newPIN string) error {
@@ -609,7 +1028,9 @@ func ykChangePIN(tx *scTx, oldPIN, newPIN string) error {
 
 // Unblock unblocks the PIN, setting it to a new value.
 func (yk *YubiKey) Unblock(puk, newPIN string) error {
-	return ykUnblockPIN(yk.tx, puk, newPIN)
+	return yk.with("Unblock", func(tx *scTx) error {
+		return ykUnblockPIN(tx, puk, newPIN)
+	})
 }
 
 func ykUnblockPIN(tx *scTx, puk, newPIN string) error {
@@ -646,7 +1067,9 @@ func ykUnblockPIN(tx *scTx, puk, newPIN string) error {
 //		// ...
 //	}
 func (yk *YubiKey) SetPUK(oldPUK, newPUK string) error {
-	return ykChangePUK(yk.tx, oldPUK, newPUK)
+	return yk.with("SetPUK", func(tx *scTx) error {
+		return ykChangePUK(tx, oldPUK, newPUK)
+	})
 }
 
 func ykChangePUK(tx *scTx, oldPUK, newPUK string) error {
@@ -681,7 +1104,9 @@ func ykChangePUK(tx *scTx, oldPUK, newPUK string) error {
 //		// ...
 //	}
 func (yk *YubiKey) SetRetries(managementKey []byte, pin string, pinRetries int, pukRetries int) error {
-	return ykSetRetries(yk.tx, managementKey, pin, pinRetries, pukRetries, yk.rand, yk.version)
+	return yk.with("SetRetries", func(tx *scTx) error {
+		return ykSetRetries(tx, managementKey, pin, pinRetries, pukRetries, yk.rand, yk.version)
+	})
 }
 
 func ykSetRetries(tx *scTx, managementKey []byte, pin string, pinRetries int, pukRetries int, rand io.Reader, version *version) error {
@@ -758,10 +1183,14 @@ func ykSerial(tx *scTx, v *version) (uint32, error) {
 // Metadata returns protected data stored on the card. This can be used to
 // retrieve PIN protected management keys.
 func (yk *YubiKey) Metadata(pin string) (*Metadata, error) {
-	m, err := ykGetProtectedMetadata(yk.tx, pin)
+	var m *Metadata
+	err := yk.with("Metadata", func(tx *scTx) (err error) {
+		m, err = ykGetProtectedMetadata(tx, pin)
+		return err
+	})
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
-			return &Metadata{}, nil
+			return &Metadata{raw: []byte{}}, nil
 		}
 		return nil, err
 	}
@@ -771,8 +1200,16 @@ func (yk *YubiKey) Metadata(pin string) (*Metadata, error) {
 // SetMetadata sets PIN protected metadata on the key. This is primarily to
 // store the management key on the smart card instead of managing the PIN and
 // management key seperately.
+//
+// The metadata is stored in the Printed Information object, and any printed
+// information already on the card is kept, see PrintedInfo. Reading the object
+// requires the PIN, so m should be returned by Metadata. Otherwise, the PIN
+// must have been verified using VerifyPIN on an exclusive connection, and the
+// returned error wraps ErrSecurityStatusNotSatisfied if it wasn't.
 func (yk *YubiKey) SetMetadata(key []byte, m *Metadata) error {
-	return ykSetProtectedMetadata(yk.tx, key, m, yk.rand, yk.version)
+	return yk.with("SetMetadata", func(tx *scTx) error {
+		return ykSetProtectedMetadata(tx, key, m, yk.rand, yk.version)
+	})
 }
 
 // Metadata holds protected metadata. This is primarily used by YubiKey manager
@@ -782,12 +1219,13 @@ type Metadata struct {
 	// ManagementKey is the management key stored directly on the YubiKey.
 	ManagementKey *[]byte
 
-	// raw, if not nil, is the full bytes
+	// raw, if not nil, is the full Printed Information object the metadata
+	// was read from, and is empty if the card had none.
 	raw []byte
 }
 
 func (m *Metadata) marshal() ([]byte, error) {
-	if m.raw == nil {
+	if len(m.raw) == 0 {
 		if m.ManagementKey == nil {
 			return []byte{0x88, 0x00}, nil
 		}
@@ -803,12 +1241,17 @@ func (m *Metadata) marshal() ([]byte, error) {
 		return m.raw, nil
 	}
 
-	var metadata asn1.RawValue
-	if _, err := asn1.Unmarshal(m.raw, &metadata); err != nil {
+	// Keep any printed information stored alongside the metadata, see
+	// PrintedInfo.
+	md, rest, err := splitMetadata(m.raw)
+	if err != nil {
 		return nil, fmt.Errorf("updating metadata: %v", err)
 	}
-	if !bytes.HasPrefix(metadata.FullBytes, []byte{0x88}) {
-		return nil, fmt.Errorf("expected tag: 0x88")
+	metadata := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0x08}
+	if md != nil {
+		if _, err := asn1.Unmarshal(md, &metadata); err != nil {
+			return nil, fmt.Errorf("updating metadata: %v", err)
+		}
 	}
 	raw := metadata.Bytes
 
@@ -832,19 +1275,28 @@ func (m *Metadata) marshal() ([]byte, error) {
 	}
 	metadata.Bytes = append(metadata.Bytes, 0x89, 24)
 	metadata.Bytes = append(metadata.Bytes, *m.ManagementKey...)
-	return asn1.Marshal(metadata)
+	b, err := asn1.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, rest...), nil
 }
 
 func (m *Metadata) unmarshal(b []byte) error {
 	m.raw = b
-	var md asn1.RawValue
-	if _, err := asn1.Unmarshal(b, &md); err != nil {
+	md, _, err := splitMetadata(b)
+	if err != nil {
 		return err
 	}
-	if !bytes.HasPrefix(md.FullBytes, []byte{0x88}) {
-		return fmt.Errorf("expected tag: 0x88")
+	if md == nil {
+		// The object only holds printed information.
+		return nil
+	}
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(md, &v); err != nil {
+		return err
 	}
-	d := md.Bytes
+	d := v.Bytes
 	for len(d) > 0 {
 		var (
 			err error
@@ -868,31 +1320,37 @@ func (m *Metadata) unmarshal(b []byte) error {
 	return nil
 }
 
+// splitMetadata separates the metadata element, tag 0x88, from the other
+// elements of the Printed Information object it's stored in. md is nil if the
+// object holds no metadata.
+func splitMetadata(b []byte) (md, rest []byte, err error) {
+	elems, err := parseObjectElements(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, e := range elems {
+		end := len(b)
+		if i+1 < len(elems) {
+			end = elems[i+1].offset
+		}
+		if e.tag == 0x88 && md == nil {
+			md = b[e.offset:end]
+			continue
+		}
+		rest = append(rest, b[e.offset:end]...)
+	}
+	return md, rest, nil
+}
+
 func ykGetProtectedMetadata(tx *scTx, pin string) (*Metadata, error) {
 	// NOTE: for some reason this action requires the PIN to be authenticated on
 	// the same transaction. It doesn't work otherwise.
 	if err := ykLogin(tx, pin); err != nil {
 		return nil, fmt.Errorf("authenticating with pin: %w", err)
 	}
-	cmd := apdu{
-		instruction: insGetData,
-		param1:      0x3f,
-		param2:      0xff,
-		data: []byte{
-			0x5c, // Tag list
-			0x03,
-			0x5f,
-			0xc1,
-			0x09,
-		},
-	}
-	resp, err := tx.Transmit(cmd)
+	obj, err := ykGetData(tx, ObjectPrintedInformation)
 	if err != nil {
-		return nil, fmt.Errorf("command failed: %w", err)
-	}
-	obj, _, err := unmarshalASN1(resp, 1, 0x13) // tag 0x53
-	if err != nil {
-		return nil, fmt.Errorf("unmarshaling response: %v", err)
+		return nil, err
 	}
 	var m Metadata
 	if err := m.unmarshal(obj); err != nil {
@@ -902,32 +1360,31 @@ func ykGetProtectedMetadata(tx *scTx, pin string) (*Metadata, error) {
 }
 
 func ykSetProtectedMetadata(tx *scTx, key []byte, m *Metadata, rand io.Reader, version *version) error {
+	if m.raw == nil {
+		// Keep the printed information stored in the same object. Reading it
+		// requires the PIN to have been verified.
+		cur, err := ykGetData(tx, ObjectPrintedInformation)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("reading printed information: %w", err)
+		}
+		_, rest, err := splitMetadata(cur)
+		if err != nil {
+			return fmt.Errorf("parsing printed information: %v", err)
+		}
+		c := *m
+		c.raw = rest
+		m = &c
+	}
 	data, err := m.marshal()
 	if err != nil {
 		return fmt.Errorf("encoding metadata: %v", err)
 	}
-	data = append([]byte{
-		0x5c, // Tag list
-		0x03,
-		0x5f,
-		0xc1,
-		0x09,
-	}, marshalASN1(0x53, data)...)
 	// NOTE: for some reason this action requires the management key authenticated
 	// on the same transaction. It doesn't work otherwise.
 	if err := ykAuthenticate(tx, key, rand, version); err != nil {
 		return fmt.Errorf("authenticating with key: %w", err)
 	}
-	cmd := apdu{
-		instruction: insPutData,
-		param1:      0x3f,
-		param2:      0xff,
-		data:        data,
-	}
-	if _, err := tx.Transmit(cmd); err != nil {
-		return fmt.Errorf("command failed: %w", err)
-	}
-	return nil
+	return ykPutData(tx, ObjectPrintedInformation, data)
 }
 
 func supportsVersion(v *version, major, minor, patch byte) bool {
@@ -16,7 +16,9 @@ package piv
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"flag"
@@ -24,6 +26,9 @@ import (
 	"math/bits"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv/emulator"
 )
 
 // canModifyYubiKey indicates whether the test running has constented to
@@ -70,6 +75,9 @@ func TestCards(t *testing.T) {
 }
 
 func newTestYubiKey(t *testing.T) (*YubiKey, func()) {
+	if !canModifyYubiKey {
+		return newTestEmulator(t)
+	}
 	cards, err := Cards()
 	if err != nil {
 		t.Fatalf("listing cards: %v", err)
@@ -78,9 +86,6 @@ func newTestYubiKey(t *testing.T) (*YubiKey, func()) {
 		if !strings.Contains(strings.ToLower(card), "yubikey") {
 			continue
 		}
-		if !canModifyYubiKey {
-			t.Skip("not running test that accesses yubikey, provide --wipe-yubikey flag")
-		}
 		yk, err := Open(card)
 		if err != nil {
 			t.Fatalf("getting new yubikey: %v", err)
@@ -95,6 +100,33 @@ func newTestYubiKey(t *testing.T) (*YubiKey, func()) {
 	return nil, nil
 }
 
+// newTestEmulator opens a new emulated YubiKey, used for tests that modify the
+// card unless the --wipe-yubikey flag is provided.
+func newTestEmulator(t *testing.T) (*YubiKey, func()) {
+	card, err := emulator.New(emulator.Config{})
+	if err != nil {
+		t.Fatalf("creating emulator: %v", err)
+	}
+	yk, err := OpenTransport(card)
+	if err != nil {
+		t.Fatalf("opening emulator: %v", err)
+	}
+	return yk, func() {
+		if err := yk.Close(); err != nil {
+			t.Errorf("closing emulator: %v", err)
+		}
+	}
+}
+
+// testAttestationRoots returns the roots that verify attestations of a test
+// YubiKey, or nil for Yubico's CAs.
+func testAttestationRoots(yk *YubiKey) *x509.CertPool {
+	if card, ok := yk.h.(*emulator.Card); ok {
+		return card.CA().CertPool()
+	}
+	return nil
+}
+
 func TestNewYubiKey(t *testing.T) {
 	_, close := newTestYubiKey(t)
 	defer close()
@@ -369,6 +401,10 @@ func TestMetadata(t *testing.T) {
 	m := &Metadata{
 		ManagementKey: &wantKey,
 	}
+	// Reading the printed information kept by SetMetadata requires the PIN.
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
 	if err := yk.SetMetadata(DefaultManagementKey, m); err != nil {
 		t.Fatalf("setting metadata: %v", err)
 	}
@@ -502,3 +538,225 @@ func TestMetadataAdditoinalFields(t *testing.T) {
 		t.Errorf("(*Metadata.marshal, got=0x%x, want=0x%x", got, want)
 	}
 }
+
+func TestOpenShared(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			{0x00, 0x01, 0xe2, 0x40, 0x90, 0x00},
+			{0x90, 0x00}, // SELECT
+			{0x00, 0x01, 0xe2, 0x40, 0x90, 0x00},
+			{0x90, 0x00}, // SELECT
+			{0x00, 0x01, 0xe2, 0x40, 0x90, 0x00},
+		},
+	}
+	c := Client{ShareMode: ShareShared}
+	yk, err := c.OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+	if ft.inTx {
+		t.Fatalf("shared connection held transaction after open")
+	}
+
+	for i := 0; i < 2; i++ {
+		serial, err := yk.Serial()
+		if err != nil {
+			t.Fatalf("getting serial: %v", err)
+		}
+		if serial != 123456 {
+			t.Errorf("serial got=%d, want=%d", serial, 123456)
+		}
+		if ft.inTx {
+			t.Errorf("shared connection held transaction after operation")
+		}
+	}
+	if ft.txs != 3 {
+		t.Errorf("got %d transactions, want 3", ft.txs)
+	}
+	for _, i := range []int{3, 5} {
+		if ft.cmds[i][1] != insSelectApplication {
+			t.Errorf("expected command %d to select piv applet, got %x", i, ft.cmds[i])
+		}
+	}
+}
+
+// testSerialResp is a GET SERIAL response for serial number 123456.
+var testSerialResp = []byte{0x00, 0x01, 0xe2, 0x40, 0x90, 0x00}
+
+func TestReconnect(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+			nil,          // card reset
+			{0x90, 0x00}, // SELECT
+			testSerialResp,
+			testSerialResp,
+		},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	if _, err := yk.Serial(); !errors.Is(err, ErrCardReset) {
+		t.Fatalf("expected ErrCardReset, got: %v", err)
+	}
+	if ft.reconnects != 1 {
+		t.Errorf("got %d reconnects, want 1", ft.reconnects)
+	}
+	if !ft.inTx {
+		t.Errorf("expected exclusive connection to hold a transaction after reconnecting")
+	}
+	serial, err := yk.Serial()
+	if err != nil {
+		t.Fatalf("getting serial after reconnect: %v", err)
+	}
+	if serial != 123456 {
+		t.Errorf("serial got=%d, want=%d", serial, 123456)
+	}
+}
+
+func TestReconnectCardChanged(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+			nil,          // card reset
+			{0x90, 0x00}, // SELECT
+			{0x00, 0x00, 0x00, 0x01, 0x90, 0x00},
+			{0x90, 0x00}, // SELECT
+			{0x00, 0x00, 0x00, 0x01, 0x90, 0x00},
+		},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := yk.Serial()
+		if err == nil || errors.Is(err, ErrCardReset) {
+			t.Fatalf("expected reconnecting to a different card to fail, got: %v", err)
+		}
+	}
+	if ft.reconnects != 2 {
+		t.Errorf("got %d reconnects, want 2", ft.reconnects)
+	}
+}
+
+func TestReconnectKeyAuth(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+			nil,          // card reset
+			{0x90, 0x00}, // SELECT
+			testSerialResp,
+			{0x63, 0xc3}, // VERIFY, login needed
+			{0x90, 0x00}, // VERIFY
+			{0x01, 0x02, 0x90, 0x00},
+		},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	auth := KeyAuth{PIN: DefaultPIN}
+	got, err := auth.do(context.Background(), "Test", yk, PINPolicyOnce, func(tx *scTx) ([]byte, error) {
+		return tx.Transmit(apdu{instruction: insAuthenticate})
+	})
+	if err != nil {
+		t.Fatalf("running operation: %v", err)
+	}
+	if want := []byte{0x01, 0x02}; !bytes.Equal(got, want) {
+		t.Errorf("response got=%x, want=%x", got, want)
+	}
+	pin, err := encodePIN(DefaultPIN)
+	if err != nil {
+		t.Fatalf("encoding pin: %v", err)
+	}
+	if verify := ft.cmds[7]; verify[1] != insVerify || !bytes.Equal(verify[5:], pin) {
+		t.Errorf("expected pin to be verified after reconnecting, got command %x", verify)
+	}
+}
+
+// blockingTransport is a fakeTransport that blocks sending commands until
+// released.
+type blockingTransport struct {
+	*fakeTransport
+	release chan struct{}
+}
+
+func (b *blockingTransport) Transmit(cmd []byte) ([]byte, error) {
+	<-b.release
+	return b.fakeTransport.Transmit(cmd)
+}
+
+func TestWithContext(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+			testSerialResp,
+			testSerialResp,
+		},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+	bt := &blockingTransport{fakeTransport: ft, release: make(chan struct{})}
+	yk.h = bt
+	yk.tx.t = bt
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = yk.withContext(ctx, "Test", func(tx *scTx) error {
+		_, err := ykSerial(tx, yk.version)
+		return err
+	})
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected cancelled operation, got: %v", err)
+	}
+	// Like with PC/SC, the blocked command isn't aborted. It keeps the card
+	// until it completes, and is counted below.
+
+	// Operations cancelled while waiting for the blocked command never run.
+	ctx, cancel = context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- yk.withContext(ctx, "Test", func(tx *scTx) error {
+			t.Errorf("cancelled operation ran")
+			return nil
+		})
+	}()
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled operation, got: %v", err)
+	}
+
+	close(bt.release)
+	serial, err := yk.Serial()
+	if err != nil {
+		t.Fatalf("getting serial after cancellation: %v", err)
+	}
+	if serial != 123456 {
+		t.Errorf("serial got=%d, want=%d", serial, 123456)
+	}
+	if n := len(ft.cmds); n != 5 {
+		t.Errorf("got %d commands, want 5", n)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PrintedInfo is the Printed Information data object, which holds the
+// information printed on the card. Reading it requires the PIN.
+//
+// YubiKeys also use this object to store PIN protected metadata, see
+// Metadata. SetPrintedInfo preserves any metadata already stored on the card.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=43
+type PrintedInfo struct {
+	// Name is the cardholder's name, up to 125 bytes.
+	Name string
+	// EmployeeAffiliation is up to 20 bytes.
+	EmployeeAffiliation string
+	// Expiration is the expiration date printed on the card. Only the date
+	// is stored.
+	Expiration time.Time
+	// AgencyCardSerialNumber is up to 20 bytes.
+	AgencyCardSerialNumber string
+	// IssuerIdentification is up to 15 bytes.
+	IssuerIdentification string
+	// OrganizationAffiliation1 is the optional first line of the
+	// organization affiliation, up to 20 bytes.
+	OrganizationAffiliation1 string
+	// OrganizationAffiliation2 is the optional second line of the
+	// organization affiliation, up to 20 bytes.
+	OrganizationAffiliation2 string
+
+	// other holds the elements of the object not defined by NIST, such as
+	// YubiKey metadata, so they're preserved when updating the object.
+	other []byte
+}
+
+// Printed Information tags.
+//
+// https://nvlpubs.nist.gov/nistpubs/SpecialPublications/NIST.SP.800-73-4.pdf#page=43
+const (
+	tagPrintedName                     = 0x01
+	tagPrintedEmployeeAffiliation      = 0x02
+	tagPrintedExpiration               = 0x04
+	tagPrintedAgencyCardSerialNumber   = 0x05
+	tagPrintedIssuerIdentification     = 0x06
+	tagPrintedOrganizationAffiliation1 = 0x07
+	tagPrintedOrganizationAffiliation2 = 0x08
+
+	// printedDateFormat is the format of the expiration date, YYYYMMMDD,
+	// with an upper case month.
+	printedDateFormat = "2006Jan02"
+)
+
+// ParsePrintedInfo decodes a Printed Information object, as stored in the
+// ObjectPrintedInformation data object.
+func ParsePrintedInfo(b []byte) (*PrintedInfo, error) {
+	elems, err := parseObjectElements(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing printed information: %v", err)
+	}
+	p := &PrintedInfo{}
+	for i, e := range elems {
+		switch e.tag {
+		case tagPrintedName:
+			p.Name = string(e.value)
+		case tagPrintedEmployeeAffiliation:
+			p.EmployeeAffiliation = string(e.value)
+		case tagPrintedExpiration:
+			// Month names are matched case insensitively.
+			t, err := time.Parse(printedDateFormat, string(e.value))
+			if err != nil {
+				return nil, fmt.Errorf("parsing expiration date: %v", err)
+			}
+			p.Expiration = t
+		case tagPrintedAgencyCardSerialNumber:
+			p.AgencyCardSerialNumber = string(e.value)
+		case tagPrintedIssuerIdentification:
+			p.IssuerIdentification = string(e.value)
+		case tagPrintedOrganizationAffiliation1:
+			p.OrganizationAffiliation1 = string(e.value)
+		case tagPrintedOrganizationAffiliation2:
+			p.OrganizationAffiliation2 = string(e.value)
+		case tagErrorDetectionCode:
+		default:
+			end := len(b)
+			if i+1 < len(elems) {
+				end = elems[i+1].offset
+			}
+			p.other = append(p.other, b[e.offset:end]...)
+		}
+	}
+	return p, nil
+}
+
+// Marshal encodes the Printed Information object, to be stored in the
+// ObjectPrintedInformation data object.
+func (p *PrintedInfo) Marshal() ([]byte, error) {
+	if p.Expiration.IsZero() {
+		return nil, errors.New("printed information missing expiration date")
+	}
+	// Elements other than those defined by NIST come first, where YubiKey
+	// tools expect their metadata.
+	b := append([]byte(nil), p.other...)
+	for _, e := range []struct {
+		name     string
+		tag      byte
+		value    string
+		size     int
+		optional bool
+	}{
+		{"name", tagPrintedName, p.Name, 125, false},
+		{"employee affiliation", tagPrintedEmployeeAffiliation, p.EmployeeAffiliation, 20, false},
+		{"expiration date", tagPrintedExpiration, strings.ToUpper(p.Expiration.Format(printedDateFormat)), 9, false},
+		{"agency card serial number", tagPrintedAgencyCardSerialNumber, p.AgencyCardSerialNumber, 20, false},
+		{"issuer identification", tagPrintedIssuerIdentification, p.IssuerIdentification, 15, false},
+		{"organization affiliation line 1", tagPrintedOrganizationAffiliation1, p.OrganizationAffiliation1, 20, true},
+		{"organization affiliation line 2", tagPrintedOrganizationAffiliation2, p.OrganizationAffiliation2, 20, true},
+	} {
+		if len(e.value) > e.size {
+			return nil, fmt.Errorf("%s too long: %d bytes (max %d)", e.name, len(e.value), e.size)
+		}
+		if e.optional && e.value == "" {
+			continue
+		}
+		b = append(b, marshalASN1(e.tag, []byte(e.value))...)
+	}
+	return append(b, marshalASN1(tagErrorDetectionCode, nil)...), nil
+}
+
+// PrintedInfo reads the Printed Information object from the card, verifying
+// the PIN in the same transaction.
+//
+// If the card has no Printed Information object, the returned error wraps
+// ErrNotFound.
+func (yk *YubiKey) PrintedInfo(pin string) (*PrintedInfo, error) {
+	var b []byte
+	err := yk.with("PrintedInfo", func(tx *scTx) (err error) {
+		// Like ykGetProtectedMetadata, reading the object requires the PIN to
+		// be verified on the same transaction.
+		if err := ykLogin(tx, pin); err != nil {
+			return fmt.Errorf("authenticating with pin: %w", err)
+		}
+		b, err = ykGetData(tx, ObjectPrintedInformation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrintedInfo(b)
+}
+
+// SetPrintedInfo stores the Printed Information object on the card, which
+// requires authenticating with the management key.
+//
+// The PIN is needed as well, because YubiKeys store their metadata, such as a
+// PIN protected management key, in the same object. The PIN is used to read
+// the current object, so that the metadata is kept.
+func (yk *YubiKey) SetPrintedInfo(key []byte, pin string, p *PrintedInfo) error {
+	return yk.with("SetPrintedInfo", func(tx *scTx) error {
+		if err := ykLogin(tx, pin); err != nil {
+			return fmt.Errorf("authenticating with pin: %w", err)
+		}
+		cur, err := ykGetData(tx, ObjectPrintedInformation)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("reading printed information: %w", err)
+		}
+		md, _, err := splitMetadata(cur)
+		if err != nil {
+			return fmt.Errorf("parsing printed information: %v", err)
+		}
+		// Replace any metadata carried by p with the card's current metadata.
+		_, other, err := splitMetadata(p.other)
+		if err != nil {
+			return fmt.Errorf("parsing printed information: %v", err)
+		}
+		q := *p
+		q.other = append(append([]byte(nil), md...), other...)
+		b, err := q.Marshal()
+		if err != nil {
+			return fmt.Errorf("encoding printed information: %w", err)
+		}
+		if err := ykAuthenticate(tx, key, yk.rand, yk.version); err != nil {
+			return fmt.Errorf("authenticating with management key: %w", err)
+		}
+		return ykPutData(tx, ObjectPrintedInformation, b)
+	})
+}
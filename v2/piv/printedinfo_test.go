@@ -0,0 +1,247 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintedInfoMarshal(t *testing.T) {
+	p := &PrintedInfo{
+		Name:                     "Jane Doe",
+		EmployeeAffiliation:      "Employee",
+		Expiration:               time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC),
+		AgencyCardSerialNumber:   "1234",
+		IssuerIdentification:     "ACME",
+		OrganizationAffiliation1: "Engineering",
+	}
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling printed information: %v", err)
+	}
+	want := "01084a616e6520446f65" + // Jane Doe
+		"0208456d706c6f796565" + // Employee
+		"0409323033304a414e3031" + // 2030JAN01
+		"050431323334" + // 1234
+		"060441434d45" + // ACME
+		"070b456e67696e656572696e67" + // Engineering
+		"fe00"
+	if got := hex.EncodeToString(b); got != want {
+		t.Errorf("marshaled printed information got=%s, want=%s", got, want)
+	}
+	got, err := ParsePrintedInfo(b)
+	if err != nil {
+		t.Fatalf("parsing printed information: %v", err)
+	}
+	if got.Name != p.Name || got.OrganizationAffiliation1 != p.OrganizationAffiliation1 ||
+		got.OrganizationAffiliation2 != "" || !got.Expiration.Equal(p.Expiration) {
+		t.Errorf("parsed printed information got=%+v, want=%+v", got, p)
+	}
+
+	p.IssuerIdentification = strings.Repeat("A", 16)
+	if _, err := p.Marshal(); err == nil {
+		t.Errorf("expected marshaling long issuer identification to fail")
+	}
+}
+
+func TestPrintedInfoMetadata(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, 24)
+	m := &Metadata{ManagementKey: &key}
+	raw, err := m.marshal()
+	if err != nil {
+		t.Fatalf("marshaling metadata: %v", err)
+	}
+	p, err := ParsePrintedInfo(raw)
+	if err != nil {
+		t.Fatalf("parsing metadata as printed information: %v", err)
+	}
+	p.Name = "Jane Doe"
+	p.Expiration = time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("marshaling printed information: %v", err)
+	}
+
+	// Both the metadata and the printed information survive updates of the
+	// other.
+	var got Metadata
+	if err := got.unmarshal(b); err != nil {
+		t.Fatalf("parsing metadata: %v", err)
+	}
+	if got.ManagementKey == nil || !bytes.Equal(*got.ManagementKey, key) {
+		t.Fatalf("management key not preserved by printed information")
+	}
+	newKey := bytes.Repeat([]byte{0x02}, 24)
+	got.ManagementKey = &newKey
+	b, err = got.marshal()
+	if err != nil {
+		t.Fatalf("marshaling metadata: %v", err)
+	}
+	p, err = ParsePrintedInfo(b)
+	if err != nil {
+		t.Fatalf("parsing printed information: %v", err)
+	}
+	if p.Name != "Jane Doe" {
+		t.Errorf("printed information not preserved by metadata, got name %q", p.Name)
+	}
+}
+
+func TestYubiKeyPrintedInfo(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+
+	if _, err := yk.PrintedInfo(DefaultPIN); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting printed information after reset returned %v, want ErrNotFound", err)
+	}
+	want := &PrintedInfo{
+		Name:                   "Jane Doe",
+		EmployeeAffiliation:    "Contractor",
+		Expiration:             time.Date(2031, time.December, 31, 0, 0, 0, 0, time.UTC),
+		AgencyCardSerialNumber: "0001",
+		IssuerIdentification:   "ACME",
+	}
+	if err := yk.SetPrintedInfo(DefaultManagementKey, DefaultPIN, want); err != nil {
+		t.Fatalf("setting printed information: %v", err)
+	}
+	if _, err := yk.PrintedInfo("000000"); err == nil {
+		t.Errorf("expected getting printed information with wrong pin to fail")
+	}
+	got, err := yk.PrintedInfo(DefaultPIN)
+	if err != nil {
+		t.Fatalf("getting printed information: %v", err)
+	}
+	if got.Name != want.Name || got.EmployeeAffiliation != want.EmployeeAffiliation ||
+		!got.Expiration.Equal(want.Expiration) {
+		t.Errorf("printed information got=%+v, want=%+v", got, want)
+	}
+}
+
+func TestYubiKeyPrintedInfoKeepsMetadata(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+
+	key := bytes.Repeat([]byte{0x01}, 24)
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	if err := yk.SetMetadata(DefaultManagementKey, &Metadata{ManagementKey: &key}); err != nil {
+		t.Fatalf("setting metadata: %v", err)
+	}
+	p := &PrintedInfo{
+		Name:       "Jane Doe",
+		Expiration: time.Date(2031, time.December, 31, 0, 0, 0, 0, time.UTC),
+	}
+	if err := yk.SetPrintedInfo(DefaultManagementKey, DefaultPIN, p); err != nil {
+		t.Fatalf("setting printed information: %v", err)
+	}
+	m, err := yk.Metadata(DefaultPIN)
+	if err != nil {
+		t.Fatalf("getting metadata: %v", err)
+	}
+	if m.ManagementKey == nil || !bytes.Equal(*m.ManagementKey, key) {
+		t.Errorf("management key not preserved by printed information")
+	}
+
+	// Metadata can be read and written when the object was stored without it.
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+	if err := yk.SetPrintedInfo(DefaultManagementKey, DefaultPIN, p); err != nil {
+		t.Fatalf("setting printed information: %v", err)
+	}
+	m, err = yk.Metadata(DefaultPIN)
+	if err != nil {
+		t.Fatalf("getting metadata: %v", err)
+	}
+	if m.ManagementKey != nil {
+		t.Errorf("expected no management key set")
+	}
+	m.ManagementKey = &key
+	if err := yk.SetMetadata(DefaultManagementKey, m); err != nil {
+		t.Fatalf("setting metadata: %v", err)
+	}
+	got, err := yk.PrintedInfo(DefaultPIN)
+	if err != nil {
+		t.Fatalf("getting printed information: %v", err)
+	}
+	if got.Name != p.Name {
+		t.Errorf("printed information not preserved by metadata, got name %q", got.Name)
+	}
+}
+
+func TestYubiKeyMetadataKeepsPrintedInfo(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+	if err := yk.Reset(); err != nil {
+		t.Fatalf("resetting yubikey: %v", err)
+	}
+
+	p := &PrintedInfo{
+		Name:                     "Jane Doe",
+		Expiration:               time.Date(2031, time.December, 31, 0, 0, 0, 0, time.UTC),
+		OrganizationAffiliation1: "Example",
+	}
+	if err := yk.SetPrintedInfo(DefaultManagementKey, DefaultPIN, p); err != nil {
+		t.Fatalf("setting printed information: %v", err)
+	}
+	// Selecting the applet again clears the PIN verified by SetPrintedInfo.
+	err := yk.Do(func(tx *Tx) error {
+		_, err := tx.Transmit(Command{Instruction: insSelectApplication, Param1: 0x04, Data: aidPIV[:]})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("selecting applet: %v", err)
+	}
+
+	// A new Metadata can't be stored without reading the printed information
+	// it shares the object with, which requires the PIN.
+	key := bytes.Repeat([]byte{0x01}, 24)
+	m := &Metadata{ManagementKey: &key}
+	if err := yk.SetMetadata(DefaultManagementKey, m); !errors.Is(err, ErrSecurityStatusNotSatisfied) {
+		t.Fatalf("setting metadata without pin: got err=%v, want ErrSecurityStatusNotSatisfied", err)
+	}
+	if err := yk.VerifyPIN(DefaultPIN); err != nil {
+		t.Fatalf("verifying pin: %v", err)
+	}
+	if err := yk.SetMetadata(DefaultManagementKey, m); err != nil {
+		t.Fatalf("setting metadata: %v", err)
+	}
+
+	got, err := yk.PrintedInfo(DefaultPIN)
+	if err != nil {
+		t.Fatalf("getting printed information: %v", err)
+	}
+	if got.Name != p.Name || got.OrganizationAffiliation1 != p.OrganizationAffiliation1 {
+		t.Errorf("printed information not preserved by metadata, got %+v", got)
+	}
+	gotMD, err := yk.Metadata(DefaultPIN)
+	if err != nil {
+		t.Fatalf("getting metadata: %v", err)
+	}
+	if gotMD.ManagementKey == nil || !bytes.Equal(*gotMD.ManagementKey, key) {
+		t.Errorf("management key not stored with printed information")
+	}
+}
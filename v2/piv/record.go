@@ -0,0 +1,469 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// recordingHeader is the first line of every recording, identifying the
+// format and its version.
+const recordingHeader = "piv-go apdu recording v1"
+
+// Recorder writes every APDU exchanged with a card to a recording that a
+// Replayer can later play back in place of the card. Recordings capture the
+// behavior of specific cards and firmware versions, allowing regression tests
+// to run without the hardware.
+//
+// To record a session, set the Recorder of the Client used to open the card:
+//
+//	f, err := os.Create("testdata/yubikey-5.7.apdu")
+//	// ...
+//	rec := &piv.Recorder{W: f}
+//	c := piv.Client{Recorder: rec}
+//	yk, err := c.Open(card)
+//
+// Recordings are line based text, to be easy to read and review:
+//
+//	piv-go apdu recording v1
+//	atr 3bfd1300008131fe158073c021c057597562694b657940
+//	protocol T=1
+//	maxinput 65544
+//	op Open
+//	> 00a4040005a000000308
+//	< 61114f0600001000010079074f05a0000003089000
+//	op VerifyPIN
+//	> 0020008008 ~8
+//	< 9000
+//
+// Each command sent to the card is a line starting with ">", followed by a
+// line starting with "<" holding the response and status word, or "!" holding
+// the error returned by the transport. Lines starting with "op" name the
+// operation that sent the following commands. Empty lines and lines starting
+// with "#" are ignored.
+//
+// Properties of the transport that change how commands are framed precede the
+// first command, and are reported by the Replayer in turn:
+//
+//	atr <hex>        the card's Answer To Reset
+//	protocol T=0     the transmission protocol negotiated with the card
+//	maxinput <n>     the largest command the reader accepts, zero if unknown
+//	contactless      the reader was detected as contactless by its name
+//
+// Unless KeepSecrets is set, the same secrets that are removed from APDU
+// traces are scrubbed from the recording. "~N" marks the number of bytes
+// scrubbed from the end of a command, or from the response data before the
+// status word.
+type Recorder struct {
+	// W receives the recording.
+	W io.Writer
+	// KeepSecrets records PINs, PUKs, management keys and private keys instead
+	// of scrubbing them. Such recordings must be treated as secrets
+	// themselves.
+	KeepSecrets bool
+
+	mu      sync.Mutex
+	started bool
+	op      string
+	err     error
+}
+
+// Err returns the first error encountered writing the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// writeLine writes a line to the recording, preceded by the header if it's
+// the first one. The caller must hold r.mu.
+func (r *Recorder) writeLine(line string) {
+	if r.err != nil {
+		return
+	}
+	if !r.started {
+		r.started = true
+		line = recordingHeader + "\n" + line
+	}
+	_, r.err = io.WriteString(r.W, line+"\n")
+}
+
+func (r *Recorder) recordATR(atr []byte) {
+	r.recordTransport("atr " + hex.EncodeToString(atr))
+}
+
+// recordProtocol records the transmission protocol negotiated with the card.
+func (r *Recorder) recordProtocol(p uint32) {
+	switch p {
+	case scProtocolT0:
+		r.recordTransport("protocol T=0")
+	case scProtocolT1:
+		r.recordTransport("protocol T=1")
+	default:
+		r.recordTransport(fmt.Sprintf("protocol %d", p))
+	}
+}
+
+// recordMaxInput records the size of the largest command the reader accepts,
+// or zero if the reader didn't report it.
+func (r *Recorder) recordMaxInput(n int) {
+	r.recordTransport("maxinput " + strconv.Itoa(n))
+}
+
+// recordContactless records that the card is accessed through a contactless
+// reader.
+func (r *Recorder) recordContactless() {
+	r.recordTransport("contactless")
+}
+
+// recordTransport writes a line describing the transport. r may be nil, in
+// which case nothing is recorded.
+func (r *Recorder) recordTransport(line string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLine(line)
+}
+
+// record writes a single APDU exchange. redacted is the number of secret bytes
+// at the end of the command, and redactResp is set if the response data is
+// secret.
+func (r *Recorder) record(op string, req, resp []byte, redacted int, redactResp bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if op != r.op && op != "" {
+		r.writeLine("op " + op)
+		r.op = op
+	}
+	if r.KeepSecrets {
+		redacted, redactResp = 0, false
+	}
+
+	line := "> " + hex.EncodeToString(req[:len(req)-redacted])
+	if redacted > 0 {
+		line += fmt.Sprintf(" ~%d", redacted)
+	}
+	r.writeLine(line)
+
+	switch n := len(resp) - 2; {
+	case err != nil:
+		// Errors are recorded on a single line.
+		msg := strings.Join(strings.Fields(err.Error()), " ")
+		r.writeLine("! " + msg)
+	case n > 0 && redactResp:
+		r.writeLine(fmt.Sprintf("< ~%d %s", n, hex.EncodeToString(resp[n:])))
+	default:
+		r.writeLine("< " + hex.EncodeToString(resp))
+	}
+}
+
+// ErrReplayMismatch is wrapped by errors returned by a Replayer when a command
+// differs from the recording.
+var ErrReplayMismatch = errors.New("command doesn't match recording")
+
+// Replayer is a Transport that plays back a recording written by a Recorder.
+// Each command must match the next command of the recording, and receives the
+// recorded response. Bytes scrubbed from a recorded command match any value.
+//
+// Once a command diverges from the recording, that command and all following
+// ones fail with an error wrapping ErrReplayMismatch. Since some operations
+// recover from failed commands, tests should check the Done method after
+// replaying a session:
+//
+//	rp, err := piv.NewReplayer(f)
+//	// ...
+//	yk, err := piv.OpenTransport(rp)
+//	// ...
+//	if err := rp.Done(); err != nil {
+//		t.Errorf("replaying session: %v", err)
+//	}
+//
+// Errors recorded from the transport are replayed with the same message, but
+// don't wrap the original errors.
+type Replayer struct {
+	atr []byte
+	// protocol, maxIn and contactlessReader describe the transport the
+	// recording was made with. protocol is zero and maxIn is negative if
+	// they weren't recorded.
+	protocol          uint32
+	maxIn             int
+	contactlessReader bool
+	exchanges         []exchange
+
+	mu   sync.Mutex
+	next int
+	err  error
+}
+
+var (
+	_ ATRTransport         = (*Replayer)(nil)
+	_ protocolTransport    = (*Replayer)(nil)
+	_ maxInputTransport    = (*Replayer)(nil)
+	_ contactlessTransport = (*Replayer)(nil)
+)
+
+// exchange is a recorded command and its response.
+type exchange struct {
+	// line is the line of the recording holding the command.
+	line int
+	op   string
+
+	cmd         []byte
+	cmdRedacted int
+
+	// resp holds the response, including the status word. If respRedacted
+	// is non-zero, it's just the status word.
+	resp         []byte
+	respRedacted int
+	// err is the error recorded instead of a response, if any.
+	err string
+}
+
+// NewReplayer parses a recording.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	rp := &Replayer{maxIn: -1}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	var (
+		op      string
+		lineNum int
+		started bool
+		pending *exchange
+	)
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !started {
+			if line != recordingHeader {
+				return nil, fmt.Errorf("line %d: expected header %q, got %q", lineNum, recordingHeader, line)
+			}
+			started = true
+			continue
+		}
+		kind, rest, _ := strings.Cut(line, " ")
+		if pending != nil && kind != "<" && kind != "!" {
+			return nil, fmt.Errorf("line %d: expected response to command on line %d", lineNum, pending.line)
+		}
+		switch kind {
+		case "atr":
+			b, err := hex.DecodeString(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid atr: %v", lineNum, err)
+			}
+			if rp.atr == nil {
+				rp.atr = b
+			}
+		case "protocol":
+			switch rest {
+			case "T=0":
+				rp.protocol = scProtocolT0
+			case "T=1":
+				rp.protocol = scProtocolT1
+			default:
+				n, err := strconv.ParseUint(rest, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid protocol %q", lineNum, rest)
+				}
+				rp.protocol = uint32(n)
+			}
+		case "maxinput":
+			n, err := strconv.Atoi(rest)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("line %d: invalid maxinput %q", lineNum, rest)
+			}
+			rp.maxIn = n
+		case "contactless":
+			rp.contactlessReader = true
+		case "op":
+			op = rest
+		case ">":
+			e := exchange{line: lineNum, op: op}
+			data, redacted, err := parseRecorded(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid command: %v", lineNum, err)
+			}
+			e.cmd, e.cmdRedacted = data, redacted
+			rp.exchanges = append(rp.exchanges, e)
+			pending = &rp.exchanges[len(rp.exchanges)-1]
+		case "<":
+			if pending == nil {
+				return nil, fmt.Errorf("line %d: response without command", lineNum)
+			}
+			var (
+				resp     []byte
+				redacted int
+				err      error
+			)
+			if strings.HasPrefix(rest, "~") {
+				// Scrubbed response data, followed by the status word.
+				n, sw, _ := strings.Cut(rest, " ")
+				redacted, err = strconv.Atoi(n[1:])
+				if err == nil {
+					resp, err = hex.DecodeString(sw)
+				}
+			} else {
+				resp, err = hex.DecodeString(rest)
+			}
+			if err != nil || len(resp) < 2 || redacted < 0 || (redacted > 0 && len(resp) != 2) {
+				return nil, fmt.Errorf("line %d: invalid response", lineNum)
+			}
+			pending.resp, pending.respRedacted = resp, redacted
+			pending = nil
+		case "!":
+			if pending == nil {
+				return nil, fmt.Errorf("line %d: error without command", lineNum)
+			}
+			pending.err = rest
+			pending = nil
+		default:
+			return nil, fmt.Errorf("line %d: unknown record %q", lineNum, kind)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading recording: %w", err)
+	}
+	if !started {
+		return nil, errors.New("recording is empty")
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("line %d: command has no response", pending.line)
+	}
+	return rp, nil
+}
+
+// parseRecorded decodes hex encoded bytes, optionally followed by the number
+// of bytes scrubbed as "~N".
+func parseRecorded(s string) ([]byte, int, error) {
+	data, scrubbed, ok := strings.Cut(s, " ")
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return b, 0, nil
+	}
+	if !strings.HasPrefix(scrubbed, "~") {
+		return nil, 0, fmt.Errorf("unexpected %q", scrubbed)
+	}
+	n, err := strconv.Atoi(scrubbed[1:])
+	if err != nil || n < 0 {
+		return nil, 0, fmt.Errorf("invalid scrubbed length %q", scrubbed)
+	}
+	return b, n, nil
+}
+
+// Transmit returns the recorded response of the next command, if it matches
+// cmd.
+func (rp *Replayer) Transmit(cmd []byte) ([]byte, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.err != nil {
+		return nil, rp.err
+	}
+	if rp.next >= len(rp.exchanges) {
+		rp.err = fmt.Errorf("unexpected command %x after end of recording: %w", cmd, ErrReplayMismatch)
+		return nil, rp.err
+	}
+	e := &rp.exchanges[rp.next]
+	if !e.matches(cmd) {
+		want := hex.EncodeToString(e.cmd)
+		if e.cmdRedacted > 0 {
+			want += strings.Repeat("??", e.cmdRedacted)
+		}
+		rp.err = fmt.Errorf("command %d (line %d, op %q): got %x, want %s: %w",
+			rp.next+1, e.line, e.op, cmd, want, ErrReplayMismatch)
+		return nil, rp.err
+	}
+	rp.next++
+	if e.err != "" {
+		return nil, errors.New(e.err)
+	}
+	if e.respRedacted > 0 {
+		return nil, fmt.Errorf("response on line %d was scrubbed from the recording", e.line+1)
+	}
+	return append([]byte(nil), e.resp...), nil
+}
+
+func (e *exchange) matches(cmd []byte) bool {
+	if len(cmd) != len(e.cmd)+e.cmdRedacted {
+		return false
+	}
+	return string(cmd[:len(e.cmd)]) == string(e.cmd)
+}
+
+// Done returns an error if a command diverged from the recording, or if
+// recorded commands weren't sent.
+func (rp *Replayer) Done() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.err != nil {
+		return rp.err
+	}
+	if n := len(rp.exchanges) - rp.next; n > 0 {
+		e := rp.exchanges[rp.next]
+		return fmt.Errorf("%d recorded commands not sent, starting on line %d (op %q)", n, e.line, e.op)
+	}
+	return nil
+}
+
+// ATR returns the Answer To Reset of the recorded card. It returns an error if
+// the recording doesn't include one.
+func (rp *Replayer) ATR() ([]byte, error) {
+	if rp.atr == nil {
+		return nil, errors.New("recording has no atr")
+	}
+	return append([]byte(nil), rp.atr...), nil
+}
+
+// activeProtocol returns the recorded transmission protocol, so that commands
+// are framed as they were when recording.
+func (rp *Replayer) activeProtocol() uint32 {
+	return rp.protocol
+}
+
+// maxInput returns the recorded size of the largest command the reader
+// accepts. Recordings of transports that didn't report it impose no limit.
+func (rp *Replayer) maxInput() (int, error) {
+	if rp.maxIn < 0 {
+		return scMaxBufferSizeExtended, nil
+	}
+	return rp.maxIn, nil
+}
+
+// contactless reports if the recording was made through a contactless reader.
+func (rp *Replayer) contactless() bool {
+	return rp.contactlessReader
+}
+
+// BeginTransaction is a no-op.
+func (rp *Replayer) BeginTransaction() error { return nil }
+
+// EndTransaction is a no-op.
+func (rp *Replayer) EndTransaction() error { return nil }
+
+// Close is a no-op.
+func (rp *Replayer) Close() error { return nil }
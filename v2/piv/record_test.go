@@ -0,0 +1,310 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-piv/piv-go/v2/piv/emulator"
+)
+
+// zeroReader is a source of randomness that makes management key challenges
+// deterministic, so sessions can be replayed.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// recordSession runs a session against an emulated card, returning the
+// result of f and the session's recording.
+func recordSession(t *testing.T, f func(yk *YubiKey) any, keepSecrets bool) (any, []byte) {
+	t.Helper()
+	card, err := emulator.New(emulator.Config{})
+	if err != nil {
+		t.Fatalf("creating emulator: %v", err)
+	}
+	return recordTransport(t, card, f, keepSecrets)
+}
+
+// recordTransport is like recordSession, using the provided transport.
+func recordTransport(t *testing.T, card Transport, f func(yk *YubiKey) any, keepSecrets bool) (any, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	rec := &Recorder{W: &buf, KeepSecrets: keepSecrets}
+	c := Client{Rand: zeroReader{}, Recorder: rec}
+	yk, err := c.OpenTransport(card)
+	if err != nil {
+		t.Fatalf("opening emulator: %v", err)
+	}
+	defer yk.Close()
+	got := f(yk)
+	if err := rec.Err(); err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+	return got, buf.Bytes()
+}
+
+func replaySession(t *testing.T, recording []byte) (*Replayer, *YubiKey) {
+	t.Helper()
+	rp, err := NewReplayer(bytes.NewReader(recording))
+	if err != nil {
+		t.Fatalf("parsing recording: %v", err)
+	}
+	c := Client{Rand: zeroReader{}}
+	yk, err := c.OpenTransport(rp)
+	if err != nil {
+		t.Fatalf("opening replayer: %v", err)
+	}
+	return rp, yk
+}
+
+func TestRecordReplay(t *testing.T) {
+	session := func(yk *YubiKey) any {
+		pub, err := yk.GenerateKey(DefaultManagementKey, SlotAuthentication, Key{
+			Algorithm:   AlgorithmEC256,
+			PINPolicy:   PINPolicyOnce,
+			TouchPolicy: TouchPolicyNever,
+		})
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		priv, err := yk.PrivateKey(SlotAuthentication, pub, KeyAuth{PIN: DefaultPIN})
+		if err != nil {
+			t.Fatalf("getting private key: %v", err)
+		}
+		digest := sha256.Sum256([]byte("hello"))
+		sig, err := priv.(*ECDSAPrivateKey).Sign(nil, digest[:], nil)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return []any{pub, sig}
+	}
+	want, recording := recordSession(t, session, false)
+
+	rp, yk := replaySession(t, recording)
+	defer yk.Close()
+	if got := session(yk); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed session returned %v, want %v", got, want)
+	}
+	if err := rp.Done(); err != nil {
+		t.Errorf("replaying session: %v", err)
+	}
+}
+
+// t0Card is an emulated card reached through a reader that negotiated T=0.
+type t0Card struct {
+	*emulator.Card
+}
+
+func (t0Card) activeProtocol() uint32 { return scProtocolT0 }
+
+// contactlessCard is an emulated card reached through a reader detected as
+// contactless by its name.
+type contactlessCard struct {
+	*emulator.Card
+}
+
+func (contactlessCard) contactless() bool { return true }
+
+// limitedCard is an emulated card reached through a reader that accepts
+// commands of up to 300 bytes.
+type limitedCard struct {
+	*emulator.Card
+}
+
+func (limitedCard) maxInput() (int, error) { return 300, nil }
+
+func TestRecordReplayTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		wrap     func(*emulator.Card) Transport
+		wantLine string
+	}{
+		{"T=0", func(c *emulator.Card) Transport { return t0Card{c} }, "protocol T=0"},
+		{"Contactless", func(c *emulator.Card) Transport { return contactlessCard{c} }, "contactless"},
+		{"MaxInput", func(c *emulator.Card) Transport { return limitedCard{c} }, "maxinput 300"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			card, err := emulator.New(emulator.Config{})
+			if err != nil {
+				t.Fatalf("creating emulator: %v", err)
+			}
+			// Large enough to be sent differently depending on the
+			// transport.
+			data := make([]byte, 400)
+			session := func(yk *YubiKey) any {
+				if err := yk.PutData(DefaultManagementKey, ObjectFacialImage, data); err != nil {
+					t.Fatalf("storing data: %v", err)
+				}
+				got, err := yk.GetData(ObjectFacialImage)
+				if err != nil {
+					t.Fatalf("reading data: %v", err)
+				}
+				return got
+			}
+			want, recording := recordTransport(t, test.wrap(card), session, false)
+			if !strings.Contains(string(recording), "\n"+test.wantLine+"\n") {
+				t.Errorf("recording doesn't contain %q:\n%s", test.wantLine, recording)
+			}
+
+			rp, yk := replaySession(t, recording)
+			defer yk.Close()
+			if got := session(yk); !reflect.DeepEqual(got, want) {
+				t.Errorf("replayed session returned %x, want %x", got, want)
+			}
+			if err := rp.Done(); err != nil {
+				t.Errorf("replaying session: %v", err)
+			}
+		})
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	_, recording := recordSession(t, func(yk *YubiKey) any {
+		if err := yk.VerifyPIN(DefaultPIN); err != nil {
+			t.Fatalf("verifying pin: %v", err)
+		}
+		return nil
+	}, false)
+
+	rp, yk := replaySession(t, recording)
+	defer yk.Close()
+	if _, err := yk.Serial(); !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("getting serial returned %v, want ErrReplayMismatch", err)
+	}
+	// All further commands fail.
+	if err := yk.VerifyPIN(DefaultPIN); !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("verifying pin returned %v, want ErrReplayMismatch", err)
+	}
+	if err := rp.Done(); !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("Done returned %v, want ErrReplayMismatch", err)
+	}
+
+	rp, yk = replaySession(t, recording)
+	defer yk.Close()
+	if err := rp.Done(); err == nil {
+		t.Errorf("Done succeeded without replaying recorded commands")
+	}
+}
+
+func TestRecordScrubsSecrets(t *testing.T) {
+	setMetadata := func(yk *YubiKey) error {
+		m, err := yk.Metadata(DefaultPIN)
+		if err != nil {
+			return err
+		}
+		m.ManagementKey = &DefaultManagementKey
+		return yk.SetMetadata(DefaultManagementKey, m)
+	}
+	session := func(yk *YubiKey) any {
+		if err := setMetadata(yk); err != nil {
+			t.Fatalf("setting metadata: %v", err)
+		}
+		if _, err := yk.Metadata(DefaultPIN); err != nil {
+			t.Fatalf("getting metadata: %v", err)
+		}
+		return nil
+	}
+	pin := []byte(DefaultPIN)
+	_, recording := recordSession(t, session, false)
+	for _, secret := range [][]byte{pin, DefaultManagementKey} {
+		if s := string(recording); strings.Contains(s, hex.EncodeToString(secret)) {
+			t.Errorf("recording contains secret %x:\n%s", secret, recording)
+		}
+	}
+	if !strings.Contains(string(recording), "< ~") {
+		t.Errorf("recording doesn't scrub protected metadata:\n%s", recording)
+	}
+
+	// Commands match regardless of the scrubbed secrets, but scrubbed
+	// responses can't be replayed.
+	rp, yk := replaySession(t, recording)
+	defer yk.Close()
+	if err := setMetadata(yk); err != nil {
+		t.Fatalf("replaying set metadata: %v", err)
+	}
+	if _, err := yk.Metadata(DefaultPIN); err == nil || errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("replaying scrubbed metadata returned %v, want error", err)
+	}
+	if err := rp.Done(); err != nil {
+		t.Errorf("replaying session: %v", err)
+	}
+
+	_, recording = recordSession(t, session, true)
+	if s := string(recording); !strings.Contains(s, hex.EncodeToString(pin)) {
+		t.Errorf("recording doesn't keep pin:\n%s", s)
+	}
+	rp, yk = replaySession(t, recording)
+	defer yk.Close()
+	session(yk)
+	if err := rp.Done(); err != nil {
+		t.Errorf("replaying session: %v", err)
+	}
+}
+
+// neoRetries is a session with a YubiKey NEO, which reports the remaining PIN
+// retries with the non-standard status words 0x630N.
+const neoRetries = `piv-go apdu recording v1
+op Open
+> 00a4040005a000000308
+< 61114f0600001000010079074f05a0000003089000
+> 00fd000000
+< 0304039000
+> 00a4040008a000000527200101
+< 0304039000
+> 0001100000
+< 002dc73b9000
+> 00a4040005a000000308
+< 61114f0600001000010079074f05a0000003089000
+op VerifyPIN
+> 0020008008 ~8
+< 6302
+op Retries
+> 0020008000
+< 6302
+`
+
+func TestReplayNEORetries(t *testing.T) {
+	rp, yk := replaySession(t, []byte(neoRetries))
+	defer yk.Close()
+	if v := yk.Version(); v != (Version{Major: 3, Minor: 4, Patch: 3}) {
+		t.Errorf("version got=%v, want 3.4.3", v)
+	}
+	var authErr AuthErr
+	if err := yk.VerifyPIN("000000"); !errors.As(err, &authErr) || authErr.Retries != 2 {
+		t.Errorf("verifying pin returned %v, want AuthErr with 2 retries", err)
+	}
+	retries, err := yk.Retries()
+	if err != nil {
+		t.Fatalf("getting retries: %v", err)
+	}
+	if retries != 2 {
+		t.Errorf("retries got=%d, want 2", retries)
+	}
+	if err := rp.Done(); err != nil {
+		t.Errorf("replaying session: %v", err)
+	}
+}
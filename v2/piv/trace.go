@@ -0,0 +1,273 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APDUTrace records a command APDU sent to the card and the card's response.
+//
+// Secrets are removed before the trace is reported. This includes PINs and PUKs
+// sent with VERIFY, CHANGE REFERENCE DATA and RESET RETRY COUNTER, management
+// keys sent with SET MANAGEMENT KEY or stored as PIN protected metadata, and
+// private keys sent with IMPORT KEY.
+type APDUTrace struct {
+	// Op is the name of the YubiKey method that sent the command, such as
+	// "Sign" or "GenerateKey".
+	Op string
+	// Command is the command APDU as sent to the card, with secret data
+	// removed from the end.
+	Command []byte
+	// CommandRedacted is the number of bytes removed from the end of Command.
+	CommandRedacted int
+	// Response is the response data, excluding the status word, with secret
+	// data removed. It's nil if the command failed to transmit.
+	Response []byte
+	// ResponseRedacted is the number of bytes removed from the end of
+	// Response.
+	ResponseRedacted int
+	// Status is the status word returned by the card, such as 0x9000 for
+	// success. It's zero if the command failed to transmit.
+	Status uint16
+	// Start is the time the command was sent.
+	Start time.Time
+	// Duration is the time the card took to respond.
+	Duration time.Duration
+	// Err is the error returned by the transport, if any.
+	Err error
+}
+
+// Tracer receives a record of every APDU exchanged with the card. Tracers are
+// called synchronously while the card is held, and must not retain the byte
+// slices of the trace.
+type Tracer func(t *APDUTrace)
+
+// SetTracer installs a tracer that receives every APDU subsequently exchanged
+// with the card. A nil tracer disables tracing.
+//
+//	yk.SetTracer(piv.SlogTracer(slog.Default()))
+func (yk *YubiKey) SetTracer(t Tracer) {
+	// Wait for any operation in progress, which reads the tracer.
+	yk.mu.lockUnbounded()
+	defer yk.mu.unlock()
+	yk.tracer = t
+}
+
+// SlogTracer returns a tracer that logs each APDU at debug level.
+func SlogTracer(l *slog.Logger) Tracer {
+	return func(t *APDUTrace) {
+		ctx := context.Background()
+		if !l.Enabled(ctx, slog.LevelDebug) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("op", t.Op),
+			slog.String("command", hex.EncodeToString(t.Command)),
+		}
+		if t.CommandRedacted > 0 {
+			attrs = append(attrs, slog.Int("command_redacted", t.CommandRedacted))
+		}
+		if t.Err != nil {
+			attrs = append(attrs, slog.Any("err", t.Err))
+		} else {
+			attrs = append(attrs,
+				slog.String("response", hex.EncodeToString(t.Response)),
+				slog.String("sw", fmt.Sprintf("%04x", t.Status)),
+			)
+			if t.ResponseRedacted > 0 {
+				attrs = append(attrs, slog.Int("response_redacted", t.ResponseRedacted))
+			}
+		}
+		attrs = append(attrs, slog.Duration("duration", t.Duration))
+		l.LogAttrs(ctx, slog.LevelDebug, "piv apdu", attrs...)
+	}
+}
+
+// HexDumpTracer returns a tracer that writes each APDU to w in the format used
+// by the verbose output of yubico-piv-tool:
+//
+//	> 00 a4 04 00 05 a0 00 00 03 08  (10)
+//	< 61 11 4f 06 00 00 10 00 01 00 79 07 4f 05 a0 00 00 03 08 90 00  (21)
+//
+// Redacted bytes are elided and their number noted.
+func HexDumpTracer(w io.Writer) Tracer {
+	var mu sync.Mutex
+	return func(t *APDUTrace) {
+		var b strings.Builder
+		b.WriteString("> ")
+		hexDump(&b, t.Command, t.CommandRedacted)
+		fmt.Fprintf(&b, " (%d)\n", len(t.Command)+t.CommandRedacted)
+		if t.Err != nil {
+			fmt.Fprintf(&b, "< error: %v\n", t.Err)
+		} else {
+			resp := append(t.Response[:len(t.Response):len(t.Response)], byte(t.Status>>8), byte(t.Status))
+			b.WriteString("< ")
+			hexDump(&b, resp[:len(t.Response)], t.ResponseRedacted)
+			hexDump(&b, resp[len(t.Response):], 0)
+			fmt.Fprintf(&b, " (%d)\n", len(resp)+t.ResponseRedacted)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, b.String())
+	}
+}
+
+func hexDump(b *strings.Builder, data []byte, redacted int) {
+	for _, c := range data {
+		fmt.Fprintf(b, "%02x ", c)
+	}
+	if redacted > 0 {
+		fmt.Fprintf(b, "<%d bytes redacted> ", redacted)
+	}
+}
+
+// redaction describes the secret parts of a command and its response.
+type redaction struct {
+	// data is the number of leading command data bytes that are safe to
+	// trace, or -1 if the command holds no secrets.
+	data int
+	// response is set if the response data is secret.
+	response bool
+}
+
+// tagProtectedMetadata is the object YubiKeys use to store PIN protected
+// metadata, such as the management key.
+var tagProtectedMetadata = []byte{0x5c, 0x03, 0x5f, 0xc1, 0x09}
+
+// redactAPDU determines the secret parts of a command.
+func redactAPDU(d apdu) redaction {
+	switch d.instruction {
+	case insVerify, insChangeReference, insResetRetry, insImportKey:
+		return redaction{data: 0}
+	case insSetMGMKey:
+		// Algorithm, key reference and length, followed by the key.
+		return redaction{data: 3}
+	case insPutData:
+		if hasPrefix(d.data, tagProtectedMetadata) {
+			return redaction{data: len(tagProtectedMetadata)}
+		}
+	case insGetData:
+		if hasPrefix(d.data, tagProtectedMetadata) {
+			return redaction{data: -1, response: true}
+		}
+	case insAuthenticate:
+		// Decryption and key agreement return session keys and shared
+		// secrets.
+		if d.param2 != keyCardManagement && !isSignRequest(d) {
+			return redaction{data: -1, response: true}
+		}
+	}
+	return redaction{data: -1}
+}
+
+// isSignRequest reports whether a GENERAL AUTHENTICATE command computes an EC
+// or Ed25519 signature, rather than performing key agreement. RSA signing and
+// decryption use the same command, so neither is reported as a signature.
+func isSignRequest(d apdu) bool {
+	switch d.param1 {
+	case algECCP256, algECCP384, algEd25519:
+	default:
+		return false
+	}
+	var tmpl asn1.RawValue
+	if _, err := asn1.Unmarshal(d.data, &tmpl); err != nil {
+		return false
+	}
+	for b := tmpl.Bytes; len(b) > 0; {
+		var v asn1.RawValue
+		rest, err := asn1.Unmarshal(b, &v)
+		if err != nil {
+			return false
+		}
+		// 0x85 holds the peer's public key for key agreement.
+		if v.Class == asn1.ClassContextSpecific && v.Tag == 0x05 {
+			return false
+		}
+		b = rest
+	}
+	return true
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+// redacted returns the number of bytes at the end of a command APDU that hold
+// secrets, and accounts for the data of commands sent in chunks.
+func (t *scTx) redacted(req []byte) int {
+	if t.redact.data < 0 || len(req) <= 5 {
+		return 0
+	}
+	header, n := 5, len(req)-5
+	if req[4] == 0 {
+		// Extended length commands encode Lc in two bytes, and may be followed
+		// by an Le field that isn't part of the data.
+		if len(req) <= 7 {
+			return 0
+		}
+		header, n = 7, int(req[5])<<8|int(req[6])
+		if header+n > len(req) {
+			return 0
+		}
+	}
+	// Commands are split into chunks when chaining, so account for the data
+	// sent in earlier chunks.
+	keep := t.redact.data - t.sent
+	if keep < 0 {
+		keep = 0
+	}
+	if keep > n {
+		keep = n
+	}
+	t.sent += n
+	if keep == n {
+		return 0
+	}
+	// Only the end of a command can be left out, so an Le field following
+	// secret data is left out with it.
+	return len(req) - header - keep
+}
+
+// trace reports a single APDU exchange to the transaction's tracer.
+func (t *scTx) trace(req, resp []byte, redacted int, start time.Time, err error) {
+	tr := &APDUTrace{
+		Op:              t.op,
+		Command:         req[:len(req)-redacted],
+		CommandRedacted: redacted,
+		Start:           start,
+		Duration:        time.Since(start),
+		Err:             err,
+	}
+	if err == nil && len(resp) >= 2 {
+		n := len(resp) - 2
+		tr.Status = uint16(resp[n])<<8 | uint16(resp[n+1])
+		tr.Response = resp[:n]
+		if t.redact.response {
+			tr.Response = resp[:0]
+			tr.ResponseRedacted = n
+		}
+	}
+	t.tracer(tr)
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestTraceRedaction(t *testing.T) {
+	key := make([]byte, 300)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	tests := []struct {
+		name          string
+		cmd           apdu
+		extended      bool
+		resps         [][]byte
+		wantCmds      [][]byte
+		wantRedacted  []int
+		wantResp      [][]byte
+		wantRespRedac []int
+	}{
+		{
+			name:          "verify",
+			cmd:           apdu{instruction: insVerify, param2: 0x80, data: []byte("123456\xff\xff")},
+			resps:         [][]byte{{0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insVerify, 0x00, 0x80, 0x08}},
+			wantRedacted:  []int{8},
+			wantResp:      [][]byte{{}},
+			wantRespRedac: []int{0},
+		},
+		{
+			name:          "set management key",
+			cmd:           apdu{instruction: insSetMGMKey, param1: 0xff, param2: 0xff, data: append([]byte{0x03, 0x9b, 0x18}, key[:24]...)},
+			resps:         [][]byte{{0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insSetMGMKey, 0xff, 0xff, 0x1b, 0x03, 0x9b, 0x18}},
+			wantRedacted:  []int{24},
+			wantResp:      [][]byte{{}},
+			wantRespRedac: []int{0},
+		},
+		{
+			name:  "import key",
+			cmd:   apdu{instruction: insImportKey, param1: 0x07, param2: 0x9a, data: key},
+			resps: [][]byte{{0x90, 0x00}, {0x90, 0x00}},
+			wantCmds: [][]byte{
+				{0x10, insImportKey, 0x07, 0x9a, 0xff},
+				{0x00, insImportKey, 0x07, 0x9a, 0x2d},
+			},
+			wantRedacted:  []int{0xff, 0x2d},
+			wantResp:      [][]byte{{}, {}},
+			wantRespRedac: []int{0, 0},
+		},
+		{
+			name:          "import key extended",
+			cmd:           apdu{instruction: insImportKey, param1: 0x07, param2: 0x9a, data: key},
+			extended:      true,
+			resps:         [][]byte{{0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insImportKey, 0x07, 0x9a, 0x00, 0x01, 0x2c}},
+			wantRedacted:  []int{300},
+			wantResp:      [][]byte{{}},
+			wantRespRedac: []int{0},
+		},
+		{
+			name:     "get data extended",
+			cmd:      apdu{instruction: insGetData, param1: 0x3f, param2: 0xff, data: []byte{0x5c, 0x03, 0x5f, 0xc1, 0x05}},
+			extended: true,
+			resps:    [][]byte{{0x53, 0x00, 0x90, 0x00}},
+			wantCmds: [][]byte{
+				{0x00, insGetData, 0x3f, 0xff, 0x00, 0x00, 0x05, 0x5c, 0x03, 0x5f, 0xc1, 0x05, 0x00, 0x00},
+			},
+			wantRedacted:  []int{0},
+			wantResp:      [][]byte{{0x53, 0x00}},
+			wantRespRedac: []int{0},
+		},
+		{
+			name:  "get protected metadata",
+			cmd:   apdu{instruction: insGetData, param1: 0x3f, param2: 0xff, data: tagProtectedMetadata},
+			resps: [][]byte{{0x53, 0x01, 0x61, 0x01}, {0x02, 0x90, 0x00}},
+			wantCmds: [][]byte{
+				append([]byte{0x00, insGetData, 0x3f, 0xff, 0x05}, tagProtectedMetadata...),
+				{0x00, insGetResponseAPDU, 0x00, 0x00, 0x01},
+			},
+			wantRedacted:  []int{0, 0},
+			wantResp:      [][]byte{{}, {}},
+			wantRespRedac: []int{2, 1},
+		},
+		{
+			name:          "key agreement",
+			cmd:           apdu{instruction: insAuthenticate, param1: algECCP256, param2: 0x9d, data: []byte{0x7c, 0x07, 0x82, 0x00, 0x85, 0x03, 0x04, 0x01, 0x02}},
+			resps:         [][]byte{{0x7c, 0x03, 0x82, 0x01, 0x2a, 0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insAuthenticate, algECCP256, 0x9d, 0x09, 0x7c, 0x07, 0x82, 0x00, 0x85, 0x03, 0x04, 0x01, 0x02}},
+			wantRedacted:  []int{0},
+			wantResp:      [][]byte{{}},
+			wantRespRedac: []int{5},
+		},
+		{
+			name:          "rsa",
+			cmd:           apdu{instruction: insAuthenticate, param1: algRSA2048, param2: 0x9d, data: []byte{0x7c, 0x05, 0x82, 0x00, 0x81, 0x01, 0x2a}},
+			resps:         [][]byte{{0x7c, 0x03, 0x82, 0x01, 0x2a, 0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insAuthenticate, algRSA2048, 0x9d, 0x07, 0x7c, 0x05, 0x82, 0x00, 0x81, 0x01, 0x2a}},
+			wantRedacted:  []int{0},
+			wantResp:      [][]byte{{}},
+			wantRespRedac: []int{5},
+		},
+		{
+			name:          "ecdsa signature",
+			cmd:           apdu{instruction: insAuthenticate, param1: algECCP256, param2: 0x9c, data: []byte{0x7c, 0x05, 0x82, 0x00, 0x81, 0x01, 0x2a}},
+			resps:         [][]byte{{0x7c, 0x03, 0x82, 0x01, 0x2a, 0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insAuthenticate, algECCP256, 0x9c, 0x07, 0x7c, 0x05, 0x82, 0x00, 0x81, 0x01, 0x2a}},
+			wantRedacted:  []int{0},
+			wantResp:      [][]byte{{0x7c, 0x03, 0x82, 0x01, 0x2a}},
+			wantRespRedac: []int{0},
+		},
+		{
+			name:          "get version",
+			cmd:           apdu{instruction: insGetVersion},
+			resps:         [][]byte{{0x05, 0x07, 0x01, 0x90, 0x00}},
+			wantCmds:      [][]byte{{0x00, insGetVersion, 0x00, 0x00, 0x00}},
+			wantRedacted:  []int{0},
+			wantResp:      [][]byte{{0x05, 0x07, 0x01}},
+			wantRespRedac: []int{0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ft := &fakeTransport{resps: test.resps}
+			tx, err := beginTx(ft)
+			if err != nil {
+				t.Fatalf("beginning transaction: %v", err)
+			}
+			defer tx.Close()
+
+			var traces []APDUTrace
+			tx.extended = test.extended
+			tx.op = "Test"
+			tx.tracer = func(tr *APDUTrace) {
+				c := *tr
+				c.Command = append([]byte(nil), tr.Command...)
+				c.Response = append([]byte{}, tr.Response...)
+				traces = append(traces, c)
+			}
+			if _, err := tx.Transmit(test.cmd); err != nil {
+				t.Fatalf("transmit: %v", err)
+			}
+			if len(traces) != len(test.wantCmds) {
+				t.Fatalf("got %d traces, want %d", len(traces), len(test.wantCmds))
+			}
+			for i, tr := range traces {
+				if tr.Op != "Test" {
+					t.Errorf("trace %d op got=%q, want=%q", i, tr.Op, "Test")
+				}
+				if tr.Status != 0x9000 && tr.Status != 0x6101 {
+					t.Errorf("trace %d unexpected status: %04x", i, tr.Status)
+				}
+				if !bytes.Equal(tr.Command, test.wantCmds[i]) {
+					t.Errorf("trace %d command got=%x, want=%x", i, tr.Command, test.wantCmds[i])
+				}
+				if tr.CommandRedacted != test.wantRedacted[i] {
+					t.Errorf("trace %d command redacted got=%d, want=%d", i, tr.CommandRedacted, test.wantRedacted[i])
+				}
+				if !bytes.Equal(tr.Response, test.wantResp[i]) {
+					t.Errorf("trace %d response got=%x, want=%x", i, tr.Response, test.wantResp[i])
+				}
+				if tr.ResponseRedacted != test.wantRespRedac[i] {
+					t.Errorf("trace %d response redacted got=%d, want=%d", i, tr.ResponseRedacted, test.wantRespRedac[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTraceRedactsSecrets(t *testing.T) {
+	yk, close := newTestYubiKey(t)
+	defer close()
+
+	var traces []APDUTrace
+	yk.SetTracer(func(tr *APDUTrace) {
+		c := *tr
+		c.Response = append([]byte{}, tr.Response...)
+		traces = append(traces, c)
+	})
+	// checkSecret verifies that secret wasn't traced in any response, including
+	// responses split across GET RESPONSE commands.
+	checkSecret := func(t *testing.T, secret []byte) {
+		var resps []byte
+		for _, tr := range traces {
+			resps = append(resps, tr.Response...)
+		}
+		if bytes.Contains(resps, secret) {
+			t.Errorf("secret traced in responses: %x", resps)
+		}
+		traces = nil
+	}
+
+	t.Run("SharedKey", func(t *testing.T) {
+		pub, err := yk.GenerateKey(DefaultManagementKey, SlotKeyManagement, Key{
+			Algorithm:   AlgorithmEC256,
+			TouchPolicy: TouchPolicyNever,
+			PINPolicy:   PINPolicyNever,
+		})
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		priv, err := yk.PrivateKey(SlotKeyManagement, pub, KeyAuth{})
+		if err != nil {
+			t.Fatalf("getting private key: %v", err)
+		}
+		eph, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		secret, err := priv.(*ECDSAPrivateKey).SharedKey(&eph.PublicKey)
+		if err != nil {
+			t.Fatalf("key agreement: %v", err)
+		}
+		checkSecret(t, secret)
+	})
+
+	t.Run("Decrypt", func(t *testing.T) {
+		pub, err := yk.GenerateKey(DefaultManagementKey, SlotKeyManagement, Key{
+			Algorithm:   AlgorithmRSA2048,
+			TouchPolicy: TouchPolicyNever,
+			PINPolicy:   PINPolicyNever,
+		})
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+		priv, err := yk.PrivateKey(SlotKeyManagement, pub, KeyAuth{})
+		if err != nil {
+			t.Fatalf("getting private key: %v", err)
+		}
+		want := []byte("session key")
+		ct, err := rsa.EncryptPKCS1v15(rand.Reader, pub.(*rsa.PublicKey), want)
+		if err != nil {
+			t.Fatalf("encrypting: %v", err)
+		}
+		got, err := priv.(crypto.Decrypter).Decrypt(rand.Reader, ct, nil)
+		if err != nil {
+			t.Fatalf("decrypting: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("decrypt got=%q, want=%q", got, want)
+		}
+		checkSecret(t, want)
+	})
+}
+
+func TestHexDumpTracer(t *testing.T) {
+	var b bytes.Buffer
+	tr := HexDumpTracer(&b)
+	tr(&APDUTrace{
+		Command:  []byte{0x00, 0xfd, 0x00, 0x00, 0x00},
+		Response: []byte{0x05, 0x07, 0x01},
+		Status:   0x9000,
+	})
+	tr(&APDUTrace{
+		Command:         []byte{0x00, 0x20, 0x00, 0x80, 0x08},
+		CommandRedacted: 8,
+		Response:        []byte{},
+		Status:          0x63c2,
+	})
+	want := "> 00 fd 00 00 00  (5)\n" +
+		"< 05 07 01 90 00  (5)\n" +
+		"> 00 20 00 80 08 <8 bytes redacted>  (13)\n" +
+		"< 63 c2  (2)\n"
+	if got := b.String(); got != want {
+		t.Errorf("hex dump got:\n%s\nwant:\n%s", got, want)
+	}
+}
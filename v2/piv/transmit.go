@@ -0,0 +1,129 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"context"
+)
+
+// Command is a command APDU sent to the card by Transmit. It allows using card
+// commands this package doesn't implement, such as vendor specific
+// instructions.
+type Command struct {
+	// Class is the CLA byte of the command, usually zero. The command chaining
+	// bit is set automatically for large commands.
+	Class byte
+	// Instruction is the INS byte of the command.
+	Instruction byte
+	// Param1 and Param2 are the P1 and P2 bytes of the command.
+	Param1 byte
+	Param2 byte
+	// Data is the command data. Data too large for a single command is sent
+	// using extended length or command chaining.
+	Data []byte
+}
+
+func (c Command) apdu() apdu {
+	return apdu{
+		class:       c.Class,
+		instruction: c.Instruction,
+		param1:      c.Param1,
+		param2:      c.Param2,
+		data:        c.Data,
+	}
+}
+
+// Transmit sends a command to the PIV applet and returns the response data.
+// Responses split across several APDUs are combined using GET RESPONSE.
+//
+// If the card doesn't report success, the returned error wraps an *APDUError
+// holding the status word:
+//
+//	resp, err := yk.Transmit(piv.Command{Instruction: 0xcb, Param1: 0x3f, Param2: 0xff, Data: tag})
+//	var apduErr *piv.APDUError
+//	if errors.As(err, &apduErr) && apduErr.Status() == 0x6a82 {
+//		// ...
+//	}
+//
+// Transmit is serialized with other operations on the YubiKey, but doesn't
+// isolate commands from each other. Connections opened with OpenShared run
+// each call in its own transaction, so other processes may use the card in
+// between. Exclusive connections hold one transaction for the lifetime of the
+// YubiKey, so the card's state, such as a verified PIN or the selected applet,
+// carries over between calls and from other methods. Use Do to send commands
+// that rely on a verified PIN or authenticated management key.
+func (yk *YubiKey) Transmit(cmd Command) ([]byte, error) {
+	var resp []byte
+	err := yk.with("Transmit", func(tx *scTx) (err error) {
+		resp, err = tx.Transmit(cmd.apdu())
+		return err
+	})
+	return resp, err
+}
+
+// Tx is a transaction with the card, passed to the function run by Do. No
+// other process or goroutine can use the card until the transaction ends, so
+// PIN and management key authentication performed through the Tx apply to all
+// of its commands.
+//
+// A Tx must not be used after the function it was passed to returns.
+type Tx struct {
+	yk *YubiKey
+	tx *scTx
+}
+
+// Transmit sends a command to the card within the transaction. See
+// YubiKey.Transmit.
+func (t *Tx) Transmit(cmd Command) ([]byte, error) {
+	return t.tx.Transmit(cmd.apdu())
+}
+
+// VerifyPIN authenticates the PIN for the remainder of the transaction.
+func (t *Tx) VerifyPIN(pin string) error {
+	return ykLogin(t.tx, pin)
+}
+
+// AuthenticateManagementKey authenticates the management key for the
+// remainder of the transaction.
+func (t *Tx) AuthenticateManagementKey(key []byte) error {
+	return ykAuthenticate(t.tx, key, t.yk.rand, t.yk.version)
+}
+
+// Do runs f within a single transaction with the card, allowing raw commands
+// to be combined with PIN or management key authentication:
+//
+//	err := yk.Do(func(tx *piv.Tx) error {
+//		if err := tx.VerifyPIN(pin); err != nil {
+//			return err
+//		}
+//		_, err := tx.Transmit(cmd)
+//		return err
+//	})
+//
+// For connections opened with OpenShared, the PIV applet is selected before f
+// is called. If the connection to the card was lost and re-established, Do
+// returns an error wrapping ErrCardReset without calling f again.
+func (yk *YubiKey) Do(f func(tx *Tx) error) error {
+	return yk.DoContext(context.Background(), f)
+}
+
+// DoContext is like Do, but stops waiting for the card when ctx is done. The
+// returned error then wraps ErrCancelled and ctx.Err(). f keeps running until
+// it returns, as the commands it sends aren't aborted, see ErrCancelled.
+func (yk *YubiKey) DoContext(ctx context.Context, f func(tx *Tx) error) error {
+	return yk.withContext(ctx, "Do", func(tx *scTx) error {
+		return f(&Tx{yk: yk, tx: tx})
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestYubiKeyTransmit(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+			{0x01, 0x02, 0x90, 0x00},
+			{0x6a, 0x82},
+		},
+	}
+	yk, err := OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	cmd := Command{Class: 0x80, Instruction: 0x42, Param1: 0x01, Param2: 0x02, Data: []byte{0xaa}}
+	resp, err := yk.Transmit(cmd)
+	if err != nil {
+		t.Fatalf("transmit: %v", err)
+	}
+	if want := []byte{0x01, 0x02}; !bytes.Equal(resp, want) {
+		t.Errorf("response got=%x, want=%x", resp, want)
+	}
+	if want := []byte{0x80, 0x42, 0x01, 0x02, 0x01, 0xaa}; !bytes.Equal(ft.cmds[3], want) {
+		t.Errorf("command got=%x, want=%x", ft.cmds[3], want)
+	}
+
+	_, err = yk.Transmit(cmd)
+	var apduErr *APDUError
+	if !errors.As(err, &apduErr) || apduErr.Status() != 0x6a82 {
+		t.Errorf("transmit: got err=%v, want APDUError with status 6a82", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("transmit: got err=%v, want ErrNotFound", err)
+	}
+}
+
+func TestYubiKeyDo(t *testing.T) {
+	ft := &fakeTransport{
+		resps: [][]byte{
+			{0x90, 0x00},                   // SELECT
+			{0x05, 0x07, 0x01, 0x90, 0x00}, // GET VERSION
+			testSerialResp,
+			{0x90, 0x00}, // SELECT
+			{0x90, 0x00}, // VERIFY
+			{0x01, 0x90, 0x00},
+		},
+	}
+	c := Client{ShareMode: ShareShared}
+	yk, err := c.OpenTransport(ft)
+	if err != nil {
+		t.Fatalf("opening transport: %v", err)
+	}
+	defer yk.Close()
+
+	err = yk.Do(func(tx *Tx) error {
+		if err := tx.VerifyPIN(DefaultPIN); err != nil {
+			return err
+		}
+		_, err := tx.Transmit(Command{Instruction: 0x42})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if ft.txs != 2 {
+		t.Errorf("got %d transactions, want 2", ft.txs)
+	}
+	if got := ft.cmds[4][1]; got != insVerify {
+		t.Errorf("expected pin to be verified, got command %x", ft.cmds[4])
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vpcd connects software smart cards to the virtual reader of
+// vsmartcard's vpcd, a PC/SC driver for pcscd. A card served this way appears
+// as a real reader to every PC/SC client, including this module's PC/SC
+// backends, ykman and OpenSC.
+//
+// vpcd listens for virtual cards on TCP port 35963 by default, so an emulated
+// YubiKey can be inserted with:
+//
+//	card, err := emulator.New(emulator.Config{})
+//	if err != nil {
+//		// ...
+//	}
+//	err = vpcd.DialAndServe(ctx, vpcd.DefaultAddr, card)
+//
+// See https://frankmorgner.github.io/vsmartcard/virtualsmartcard/README.html
+package vpcd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// DefaultAddr is the address vpcd listens on for its first reader. Further
+// readers use the following ports.
+const DefaultAddr = "localhost:35963"
+
+// Card is a software smart card. Transmit receives command APDUs and returns
+// the response, including the trailing status word.
+type Card interface {
+	Transmit(cmd []byte) ([]byte, error)
+	ATR() ([]byte, error)
+}
+
+// Resetter is implemented by cards that clear their volatile state, such as
+// PIN verification, when the reader powers them on or off or resets them.
+type Resetter interface {
+	Reset()
+}
+
+// Control messages sent by vpcd, consisting of a single byte.
+const (
+	ctrlPowerOff = 0x00
+	ctrlPowerOn  = 0x01
+	ctrlReset    = 0x02
+	ctrlATR      = 0x04
+)
+
+// swNoDiagnosis is returned to vpcd if the card fails to process a command.
+var swNoDiagnosis = []byte{0x6f, 0x00}
+
+// DialAndServe connects to vpcd at addr and serves card until the connection
+// is closed or ctx is done.
+func DialAndServe(ctx context.Context, addr string, card Card) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connecting to vpcd: %w", err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err = Serve(conn, card)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Serve answers the messages of vpcd received on conn using card, until conn
+// reaches EOF. It's used directly when vpcd connects to the card instead, as
+// configured for remote virtual cards.
+//
+// Each message is prefixed by its length as a big-endian 16 bit integer.
+// Messages of a single byte control the card, and all others are command
+// APDUs. Only APDUs and requests for the ATR are answered.
+func Serve(conn io.ReadWriter, card Card) error {
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading message length: %w", err)
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return fmt.Errorf("reading message: %w", err)
+		}
+
+		var resp []byte
+		if len(msg) == 1 {
+			switch msg[0] {
+			case ctrlPowerOff, ctrlPowerOn, ctrlReset:
+				if r, ok := card.(Resetter); ok {
+					r.Reset()
+				}
+				continue
+			case ctrlATR:
+				atr, err := card.ATR()
+				if err != nil {
+					return fmt.Errorf("getting atr: %w", err)
+				}
+				resp = atr
+			default:
+				return fmt.Errorf("unknown control message: 0x%02x", msg[0])
+			}
+		} else {
+			var err error
+			resp, err = card.Transmit(msg)
+			if err != nil || len(resp) < 2 {
+				resp = swNoDiagnosis
+			}
+		}
+		if err := writeMessage(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func writeMessage(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return fmt.Errorf("message too long: %d bytes", len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+	return nil
+}
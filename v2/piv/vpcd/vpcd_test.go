@@ -0,0 +1,127 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vpcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-piv/piv-go/v2/piv/emulator"
+)
+
+// fakeVPCD plays the reader side of the vpcd protocol.
+type fakeVPCD struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (v *fakeVPCD) send(msg []byte) {
+	v.t.Helper()
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := v.conn.Write(append(buf, msg...)); err != nil {
+		v.t.Fatalf("writing message: %v", err)
+	}
+}
+
+func (v *fakeVPCD) receive() []byte {
+	v.t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(v.conn, hdr[:]); err != nil {
+		v.t.Fatalf("reading message length: %v", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(v.conn, msg); err != nil {
+		v.t.Fatalf("reading message: %v", err)
+	}
+	return msg
+}
+
+func TestServe(t *testing.T) {
+	card, err := emulator.New(emulator.Config{})
+	if err != nil {
+		t.Fatalf("creating emulator: %v", err)
+	}
+	c1, c2 := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() { errCh <- Serve(c1, card) }()
+	v := &fakeVPCD{t: t, conn: c2}
+
+	v.send([]byte{ctrlPowerOn})
+	v.send([]byte{ctrlATR})
+	if got := v.receive(); !bytes.Equal(got, emulator.ATR) {
+		t.Errorf("atr got=%x, want=%x", got, emulator.ATR)
+	}
+
+	selectPIV := []byte{0x00, 0xa4, 0x04, 0x00, 0x05, 0xa0, 0x00, 0x00, 0x03, 0x08}
+	getVersion := []byte{0x00, 0xfd, 0x00, 0x00}
+	v.send(selectPIV)
+	if got := v.receive(); !bytes.HasSuffix(got, []byte{0x90, 0x00}) {
+		t.Errorf("select got=%x, want success", got)
+	}
+	v.send(getVersion)
+	if got, want := v.receive(), []byte{0x05, 0x07, 0x01, 0x90, 0x00}; !bytes.Equal(got, want) {
+		t.Errorf("get version got=%x, want=%x", got, want)
+	}
+
+	// Resetting the card deselects the PIV applet.
+	v.send([]byte{ctrlReset})
+	v.send(getVersion)
+	if got, want := v.receive(), []byte{0x6d, 0x00}; !bytes.Equal(got, want) {
+		t.Errorf("get version after reset got=%x, want=%x", got, want)
+	}
+
+	v.send([]byte{ctrlPowerOff})
+	c2.Close()
+	if err := <-errCh; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
+
+func TestDialAndServe(t *testing.T) {
+	card, err := emulator.New(emulator.Config{})
+	if err != nil {
+		t.Fatalf("creating emulator: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- DialAndServe(ctx, l.Addr().String(), card) }()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accepting connection: %v", err)
+	}
+	defer conn.Close()
+	v := &fakeVPCD{t: t, conn: conn}
+	v.send([]byte{ctrlATR})
+	if got := v.receive(); !bytes.Equal(got, emulator.ATR) {
+		t.Errorf("atr got=%x, want=%x", got, emulator.ATR)
+	}
+
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("DialAndServe returned %v, want context.Canceled", err)
+	}
+}
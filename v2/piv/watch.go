@@ -0,0 +1,311 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EventType identifies the kind of change reported by Watch.
+type EventType int
+
+// Event types reported by Watch.
+const (
+	// ReaderAdded indicates a smart card reader was connected. For YubiKeys,
+	// which act as their own reader, this happens when the YubiKey is plugged
+	// in.
+	ReaderAdded EventType = iota + 1
+	// ReaderRemoved indicates a smart card reader was disconnected.
+	ReaderRemoved
+	// CardInserted indicates a card is present in a reader.
+	CardInserted
+	// CardRemoved indicates a card was removed from a reader. Connections to
+	// the card are no longer usable, and any PIN verification is lost.
+	CardRemoved
+	// ATRChanged indicates the card in a reader reports a different Answer To
+	// Reset, for example because it was swapped for another card between two
+	// observations.
+	ATRChanged
+)
+
+// String returns a human readable name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case ReaderAdded:
+		return "ReaderAdded"
+	case ReaderRemoved:
+		return "ReaderRemoved"
+	case CardInserted:
+		return "CardInserted"
+	case CardRemoved:
+		return "CardRemoved"
+	case ATRChanged:
+		return "ATRChanged"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change to the set of smart card readers, or the cards they hold.
+type Event struct {
+	Type EventType
+	// Reader is the name of the reader, as returned by Cards and accepted by
+	// Open.
+	Reader string
+	// ATR is the Answer To Reset of the card, set for CardInserted and
+	// ATRChanged events.
+	ATR []byte
+}
+
+// watchPollInterval bounds how long a single wait for reader events blocks.
+// Platforms that don't support PnP notifications rely on it to notice new
+// readers.
+const watchPollInterval = time.Second
+
+// watchCancelInterval is how often a cancelled watch retries interrupting its
+// wait for reader events.
+const watchCancelInterval = 50 * time.Millisecond
+
+// scWatcher is implemented by PC/SC contexts that can wait for reader events.
+type scWatcher interface {
+	ListReaders() ([]string, error)
+	GetStatusChange(readers []scReaderState, timeout time.Duration) error
+	Cancel() error
+}
+
+// Watch reports changes to smart card readers and cards on the events channel
+// until ctx is cancelled, at which point it returns ctx.Err(). Watch blocks,
+// and is usually run on its own goroutine:
+//
+//	events := make(chan piv.Event)
+//	go func() {
+//		if err := piv.Watch(ctx, events); err != nil && !errors.Is(err, context.Canceled) {
+//			// ...
+//		}
+//	}()
+//	for e := range events {
+//		// ...
+//	}
+//
+// Watch begins by reporting the readers and cards present when it's called.
+// The events channel isn't closed when Watch returns.
+func Watch(ctx context.Context, events chan<- Event) error {
+	var c Client
+	return c.Watch(ctx, events)
+}
+
+// Watch reports changes to the readers and cards available through the
+// client's backend. See Watch.
+func (c *Client) Watch(ctx context.Context, events chan<- Event) error {
+	sc, err := c.backend()
+	if err != nil {
+		return fmt.Errorf("connecting to smart card daemon: %w", err)
+	}
+	defer sc.Close()
+	return watch(ctx, sc, events)
+}
+
+func watch(ctx context.Context, sc scWatcher, events chan<- Event) error {
+	// Interrupt any blocking wait once the context is cancelled.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		// Cancelling has no effect if the watch loop isn't waiting yet, so
+		// retry until it notices the context is done.
+		t := time.NewTicker(watchCancelInterval)
+		defer t.Stop()
+		for {
+			sc.Cancel()
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	send := func(evs []Event) error {
+		for _, e := range evs {
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	var (
+		// readers holds the last observed state of each reader.
+		readers      []scReaderState
+		pnp          = scReaderState{reader: scPnPNotification}
+		pnpSupported = true
+		refresh      = true
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if refresh {
+			names, err := sc.ListReaders()
+			if err != nil {
+				return fmt.Errorf("listing readers: %w", err)
+			}
+			var evs []Event
+			readers, evs = updateReaders(readers, names)
+			if err := send(evs); err != nil {
+				return err
+			}
+			refresh = false
+		}
+
+		states := append([]scReaderState(nil), readers...)
+		if pnpSupported {
+			states = append(states, pnp)
+		}
+		if len(states) == 0 {
+			t := time.NewTimer(watchPollInterval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+			refresh = true
+			continue
+		}
+
+		if err := sc.GetStatusChange(states, watchPollInterval); err != nil {
+			var e *scErr
+			if !errors.As(err, &e) {
+				return fmt.Errorf("waiting for reader events: %w", err)
+			}
+			switch e.rc {
+			case rcTimeout:
+				refresh = !pnpSupported
+				continue
+			case rcCancelled:
+				continue
+			case rcUnknownReader:
+				// A reader was removed before the wait started.
+				refresh = true
+				continue
+			}
+			return fmt.Errorf("waiting for reader events: %w", err)
+		}
+
+		for i := range readers {
+			s := states[i]
+			if s.eventState&(scStateUnknown|scStateUnavailable) != 0 {
+				// Reported when the reader list is refreshed.
+				refresh = true
+				continue
+			}
+			if err := send(readerEvents(readers[i], s)); err != nil {
+				return err
+			}
+			readers[i].currentState = s.eventState &^ scStateChanged
+			readers[i].atr = s.atr
+		}
+		if pnpSupported {
+			s := states[len(states)-1]
+			if s.eventState&scStateUnknown != 0 {
+				// PnP notifications aren't supported on this platform, poll
+				// the list of readers instead.
+				pnpSupported = false
+				refresh = true
+			} else {
+				if s.eventState&scStateChanged != 0 {
+					refresh = true
+				}
+				pnp.currentState = s.eventState &^ scStateChanged
+			}
+		}
+	}
+}
+
+// updateReaders reconciles the tracked reader states with the current list of
+// readers, returning events for readers that were added or removed.
+func updateReaders(readers []scReaderState, names []string) ([]scReaderState, []Event) {
+	var (
+		next []scReaderState
+		evs  []Event
+	)
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+		found := false
+		for _, r := range readers {
+			if r.reader == name {
+				next = append(next, r)
+				found = true
+				break
+			}
+		}
+		if !found {
+			next = append(next, scReaderState{reader: name, currentState: scStateUnaware})
+			evs = append(evs, Event{Type: ReaderAdded, Reader: name})
+		}
+	}
+	for _, r := range readers {
+		if seen[r.reader] {
+			continue
+		}
+		if r.currentState&scStatePresent != 0 {
+			evs = append(evs, Event{Type: CardRemoved, Reader: r.reader})
+		}
+		evs = append(evs, Event{Type: ReaderRemoved, Reader: r.reader})
+	}
+	return next, evs
+}
+
+// readerEvents compares the last observed state of a reader with the state
+// returned by GetStatusChange.
+func readerEvents(prev, next scReaderState) []Event {
+	wasPresent := prev.currentState&scStatePresent != 0
+	present := next.eventState&scStatePresent != 0
+	switch {
+	case !wasPresent && present:
+		return []Event{{Type: CardInserted, Reader: next.reader, ATR: next.atr}}
+	case wasPresent && !present:
+		return []Event{{Type: CardRemoved, Reader: next.reader}}
+	case wasPresent && present:
+		if !bytes.Equal(prev.atr, next.atr) {
+			return []Event{{Type: ATRChanged, Reader: next.reader, ATR: next.atr}}
+		}
+		// The upper 16 bits hold a counter of card events. If it changed,
+		// the card was swapped for one with the same ATR.
+		if prev.currentState>>16 != next.eventState>>16 {
+			return []Event{
+				{Type: CardRemoved, Reader: next.reader},
+				{Type: CardInserted, Reader: next.reader, ATR: next.atr},
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package piv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReaderEvents(t *testing.T) {
+	const reader = "Reader 00 00"
+	atr1 := []byte{0x3b, 0x00}
+	atr2 := []byte{0x3b, 0x01, 0x00}
+	present := func(counter uint32) uint32 { return counter<<16 | scStatePresent }
+	empty := func(counter uint32) uint32 { return counter<<16 | scStateEmpty }
+
+	tests := []struct {
+		name string
+		prev scReaderState
+		next scReaderState
+		want []Event
+	}{
+		{
+			name: "Inserted",
+			prev: scReaderState{reader: reader, currentState: scStateUnaware},
+			next: scReaderState{reader: reader, eventState: present(1) | scStateChanged, atr: atr1},
+			want: []Event{{Type: CardInserted, Reader: reader, ATR: atr1}},
+		},
+		{
+			name: "Removed",
+			prev: scReaderState{reader: reader, currentState: present(1), atr: atr1},
+			next: scReaderState{reader: reader, eventState: empty(2) | scStateChanged},
+			want: []Event{{Type: CardRemoved, Reader: reader}},
+		},
+		{
+			name: "ATRChanged",
+			prev: scReaderState{reader: reader, currentState: present(1), atr: atr1},
+			next: scReaderState{reader: reader, eventState: present(3) | scStateChanged, atr: atr2},
+			want: []Event{{Type: ATRChanged, Reader: reader, ATR: atr2}},
+		},
+		{
+			name: "Swapped",
+			prev: scReaderState{reader: reader, currentState: present(1), atr: atr1},
+			next: scReaderState{reader: reader, eventState: present(3) | scStateChanged, atr: atr1},
+			want: []Event{
+				{Type: CardRemoved, Reader: reader},
+				{Type: CardInserted, Reader: reader, ATR: atr1},
+			},
+		},
+		{
+			name: "InUse",
+			prev: scReaderState{reader: reader, currentState: present(1), atr: atr1},
+			next: scReaderState{reader: reader, eventState: present(1) | scStateInUse | scStateChanged, atr: atr1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := readerEvents(test.prev, test.next)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readerEvents() got=%v, want=%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpdateReaders(t *testing.T) {
+	readers := []scReaderState{
+		{reader: "a", currentState: scStatePresent},
+		{reader: "b", currentState: scStateEmpty},
+	}
+	got, evs := updateReaders(readers, []string{"b", "c"})
+	want := []scReaderState{
+		{reader: "b", currentState: scStateEmpty},
+		{reader: "c", currentState: scStateUnaware},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("updateReaders() readers got=%v, want=%v", got, want)
+	}
+	wantEvs := []Event{
+		{Type: ReaderAdded, Reader: "c"},
+		{Type: CardRemoved, Reader: "a"},
+		{Type: ReaderRemoved, Reader: "a"},
+	}
+	if !reflect.DeepEqual(evs, wantEvs) {
+		t.Errorf("updateReaders() events got=%v, want=%v", evs, wantEvs)
+	}
+}